@@ -0,0 +1,245 @@
+package wilhelmiina
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const API_KEY_PREFIX = "wsm"
+const API_KEY_ID_BYTES = 6
+
+// DefaultAPIKeyLifetime is used for keys created without a lifetime
+var DefaultAPIKeyLifetime = 90 * 24 * time.Hour
+
+// APIKey lets a service account use the API without a password. Keys look like wsm_<KeyID>_<secret>,
+// the KeyID is stored as is so keys can be recognized in logs and config files, but only a hash of the whole key is stored.
+type APIKey struct {
+	KeyID     string `gorm:"primaryKey"`
+	UUID      string `gorm:"index"` // The service account
+	Name      string
+	Hash      string
+	Scopes    string // Space separated list of the actions the key may be used for
+	CreatedAt int64
+	ExpiresAt int64
+	Revoked   bool
+	RevokedAt int64
+}
+
+// GetScopes returns the actions the key may be used for
+func (k APIKey) GetScopes() []Action {
+	scopes := []Action{}
+	for _, s := range strings.Fields(k.Scopes) {
+		scopes = append(scopes, Action(s))
+	}
+	return scopes
+}
+
+func (k APIKey) HasScope(action Action) bool {
+	return hasAction(action, k.GetScopes())
+}
+
+var ErrServiceAccount = errors.New("service accounts can't log in with a password")
+
+// CreateServiceAccount creates a user for an integration. The role decides what the account can do, like for any other user, and its API keys can be limited further with scopes.
+func CreateServiceAccount(username string, name string, role Role, db *gorm.DB) (User, error) {
+	_, err := GetUserByUn(username, db)
+	if err != ErrUserNotFound {
+		if err == nil {
+			err = ErrUserAlreadyExists
+		}
+		return User{}, err
+	}
+	u := User{
+		UUID:         uuid.New().String(),
+		Username:     username,
+		UsernameKey:  NormalizeUsername(username),
+		Firstname:    name,
+		FirstnameKey: NormalizeUsername(name),
+		Role:         role,
+		IsService:    true,
+	}
+	tx := db.Begin()
+	if err := tx.Create(&u).Error; err != nil {
+		tx.Rollback()
+		return User{}, usernameError(err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return User{}, usernameError(err)
+	}
+	return u, nil
+}
+
+var ErrNotAServiceAccount = errors.New("user is not a service account")
+var ErrInvalidScope = errors.New("invalid API key scope")
+
+// CreateAPIKey creates a new key for a service account. Scopes must be known actions, and a lifetime of 0 means DefaultAPIKeyLifetime.
+// The key is only returned here, so give it to the integration right away.
+func CreateAPIKey(UUID string, name string, scopes []Action, lifetime time.Duration, db *gorm.DB) (string, APIKey, error) {
+	u, err := GetUser(UUID, db)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	if !u.IsService {
+		return "", APIKey{}, ErrNotAServiceAccount
+	}
+	if len(scopes) == 0 {
+		return "", APIKey{}, ErrInvalidScope
+	}
+	var scopeNames []string
+	for _, s := range scopes {
+		if _, ok := DefaultAuthorizer.GetPermission(s); !ok {
+			return "", APIKey{}, ErrInvalidScope
+		}
+		scopeNames = append(scopeNames, string(s))
+	}
+	if lifetime <= 0 {
+		lifetime = DefaultAPIKeyLifetime
+	}
+
+	id := make([]byte, API_KEY_ID_BYTES)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := genToken()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	keyID := hex.EncodeToString(id)
+	key := API_KEY_PREFIX + "_" + keyID + "_" + secret
+
+	now := time.Now()
+	k := APIKey{
+		KeyID:     keyID,
+		UUID:      UUID,
+		Name:      name,
+		Hash:      hashToken(key),
+		Scopes:    strings.Join(scopeNames, " "),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	}
+	tx := db.Begin()
+	tx.Create(&k)
+	err = tx.Commit().Error
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	return key, k, nil
+}
+
+// parseAPIKey returns the key id of a key that looks valid
+func parseAPIKey(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != API_KEY_PREFIX || len(parts[1]) != hex.EncodedLen(API_KEY_ID_BYTES) || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+var ErrAPIKeyRevoked = errors.New("API key has been revoked")
+var ErrAPIKeyExpired = errors.New("API key has expired")
+
+// AuthenticateAPIKey returns the service account and the key matching an API key
+func AuthenticateAPIKey(key string, db *gorm.DB) (User, APIKey, error) {
+	keyID, ok := parseAPIKey(key)
+	if !ok {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	}
+	var k APIKey
+	tx := db.Where("key_id = ?", keyID).Limit(1).Find(&k)
+	if tx.Error != nil {
+		return User{}, APIKey{}, tx.Error
+	}
+	if tx.RowsAffected == 0 || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashToken(key))) != 1 {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	}
+	if k.Revoked {
+		return User{}, APIKey{}, ErrAPIKeyRevoked
+	}
+	if time.Now().Unix() >= k.ExpiresAt {
+		return User{}, APIKey{}, ErrAPIKeyExpired
+	}
+	u, err := GetUser(k.UUID, db)
+	if err != nil {
+		return User{}, APIKey{}, err
+	}
+	if !u.IsActive() {
+		return User{}, APIKey{}, ErrUserInactive
+	}
+	u.Scopes = k.GetScopes()
+	return u, k, nil
+}
+
+// AuthorizeAPIKey checks that an API key may be used for action on targetID and returns the service account, which can then be passed to the As functions.
+// Both the scopes of the key and the permissions of the role of the account must allow the action. The returned user carries the scopes, so the As functions refuse actions outside them.
+func AuthorizeAPIKey(key string, action Action, targetID string, db *gorm.DB) (User, error) {
+	u, _, err := AuthenticateAPIKey(key, db)
+	if err != nil {
+		return User{}, err
+	}
+	if err := DefaultAuthorizer.Authorize(u, action, targetID, db); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// RevokeAPIKey makes a key unusable, the key is kept so the audit log still makes sense
+func RevokeAPIKey(keyID string, db *gorm.DB) error {
+	tx := db.Begin()
+	res := tx.Model(APIKey{}).Where("key_id = ? AND revoked = ?", keyID, false).
+		Updates(map[string]interface{}{"revoked": true, "revoked_at": time.Now().Unix()})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// GetAPIKeys returns all keys of a service account, including revoked and expired ones
+func GetAPIKeys(UUID string, db *gorm.DB) ([]APIKey, error) {
+	keys := []APIKey{}
+	tx := db.Where("uuid = ?", UUID).Order("created_at").Find(&keys)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return keys, nil
+}
+
+// CreateServiceAccountAs creates a service account if actor is allowed to do so
+func CreateServiceAccountAs(actor User, username string, name string, role Role, db *gorm.DB) (User, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionAPIKeyManage, "", db); err != nil {
+		return User{}, err
+	}
+	return CreateServiceAccount(username, name, role, withAudit(db, actor, ActionAPIKeyManage))
+}
+
+// CreateAPIKeyAs creates an API key if actor is allowed to do so
+func CreateAPIKeyAs(actor User, UUID string, name string, scopes []Action, lifetime time.Duration, db *gorm.DB) (string, APIKey, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionAPIKeyManage, UUID, db); err != nil {
+		return "", APIKey{}, err
+	}
+	return CreateAPIKey(UUID, name, scopes, lifetime, withAudit(db, actor, ActionAPIKeyManage))
+}
+
+// RevokeAPIKeyAs revokes an API key if actor is allowed to do so
+func RevokeAPIKeyAs(actor User, keyID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionAPIKeyManage, keyID, db); err != nil {
+		return err
+	}
+	return RevokeAPIKey(keyID, withAudit(db, actor, ActionAPIKeyManage))
+}
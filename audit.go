@@ -0,0 +1,357 @@
+package wilhelmiina
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AuditEvent records a single change to a row in the database. Events can't be changed or removed once written,
+// except that PurgeUser clears the logged values of the personal data of the purged user.
+type AuditEvent struct {
+	ID      uint   `gorm:"primaryKey"`
+	Time    int64  `gorm:"index"`
+	ActorID string `gorm:"index"` // Empty if the change wasn't made through an As function or WithActor
+	// The permission that was checked for the change, e.g. "user.delete", if any
+	Action string
+	// create, update or delete
+	Operation  string
+	EntityType string `gorm:"index:idx_audit_entity"` // Name of the table
+	EntityID   string `gorm:"index:idx_audit_entity"`
+	// JSON objects of the columns that changed, before and after the change
+	Before string
+	After  string
+}
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// Tables that change on every login or request and would only fill the log
+var auditIgnoredTables = map[string]bool{
+	"audit_events":    true,
+	"sessions":        true,
+	"login_attempts":  true,
+	"login_throttles": true,
+}
+
+// Columns whose values are not written to the log
+var auditRedactedColumns = map[string]bool{
+	"password": true,
+	"secret":   true,
+	"hash":     true,
+}
+
+const auditRedacted = "[redacted]"
+
+// Tables whose rows are personal data of the user with the same UUID, see scrubAuditEvents
+var auditPersonalTables = []string{"users", "user_profiles"}
+
+// scrubAuditEvents clears the logged values of the personal data of a user. The events are kept, so the log still shows what was done and by whom.
+// Going through a table name instead of the model skips the callbacks that keep the log immutable.
+func scrubAuditEvents(UUID string, tx *gorm.DB) error {
+	return tx.Table("audit_events").Where("entity_type IN ? AND entity_id = ?", auditPersonalTables, UUID).
+		Updates(map[string]interface{}{"before": "", "after": ""}).Error
+}
+
+var ErrAuditLogImmutable = errors.New("audit events can't be changed or deleted")
+
+type auditContextKey struct{}
+
+type auditActor struct {
+	ID     string
+	Action Action
+}
+
+// WithActor returns a db that records actorID as the actor of every change made through it
+func WithActor(db *gorm.DB, actorID string) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, auditContextKey{}, auditActor{ID: actorID}))
+}
+
+// withAudit is WithActor for As functions, it also records the action that was authorized
+func withAudit(db *gorm.DB, actor User, action Action) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, auditContextKey{}, auditActor{ID: actor.UUID, Action: action}))
+}
+
+func actorFromContext(ctx context.Context) auditActor {
+	if ctx == nil {
+		return auditActor{}
+	}
+	a, _ := ctx.Value(auditContextKey{}).(auditActor)
+	return a
+}
+
+// EnableAuditLog registers the callbacks that write an AuditEvent for every create, update and delete made through db.
+// InitDatabase calls this, so it's only needed for databases opened some other way.
+func EnableAuditLog(db *gorm.DB) error {
+	cb := db.Callback()
+	err := cb.Create().After("gorm:create").Register("wilhelmiina:audit_create", auditAfterCreate)
+	if err != nil {
+		return err
+	}
+	err = cb.Update().Before("gorm:update").Register("wilhelmiina:audit_before_update", auditBefore)
+	if err != nil {
+		return err
+	}
+	err = cb.Update().After("gorm:update").Register("wilhelmiina:audit_update", auditAfterUpdate)
+	if err != nil {
+		return err
+	}
+	err = cb.Delete().Before("gorm:delete").Register("wilhelmiina:audit_before_delete", auditBefore)
+	if err != nil {
+		return err
+	}
+	return cb.Delete().After("gorm:delete").Register("wilhelmiina:audit_delete", auditAfterDelete)
+}
+
+func auditSkipped(db *gorm.DB) bool {
+	stmt := db.Statement
+	return db.Error != nil || stmt.Schema == nil || len(stmt.Schema.PrimaryFields) != 1 || auditIgnoredTables[stmt.Schema.Table] || db.DryRun
+}
+
+// newAuditSession returns a db for queries inside the same transaction as the statement being audited
+func newAuditSession(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true})
+}
+
+// auditedModel returns a pointer to an empty value of the model of the statement, so that queries get its soft delete rules
+func auditedModel(db *gorm.DB) interface{} {
+	return reflect.New(db.Statement.Schema.ModelType).Interface()
+}
+
+// auditConditions returns the conditions of an update or delete, including the primary key of the model if it is set
+func auditConditions(db *gorm.DB) []clause.Expression {
+	stmt := db.Statement
+	var exprs []clause.Expression
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			exprs = append(exprs, where.Exprs...)
+		}
+	}
+	if stmt.Model != nil {
+		rv := reflect.Indirect(reflect.ValueOf(stmt.Model))
+		if rv.Kind() == reflect.Struct && rv.Type() == stmt.Schema.ModelType {
+			pk := stmt.Schema.PrimaryFields[0]
+			if v, isZero := pk.ValueOf(rv); !isZero {
+				exprs = append(exprs, clause.Eq{Column: clause.Column{Table: stmt.Schema.Table, Name: pk.DBName}, Value: v})
+			}
+		}
+	}
+	return exprs
+}
+
+const auditBeforeKey = "wilhelmiina:audit_before"
+
+// auditBefore stores the rows an update or delete is about to change
+func auditBefore(db *gorm.DB) {
+	if db.Statement.Schema != nil && db.Statement.Schema.Table == "audit_events" {
+		db.AddError(ErrAuditLogImmutable)
+		return
+	}
+	if auditSkipped(db) {
+		return
+	}
+	exprs := auditConditions(db)
+	// Updates without conditions are refused by gorm anyway
+	if len(exprs) == 0 {
+		return
+	}
+	q := newAuditSession(db).Model(auditedModel(db)).Clauses(clause.Where{Exprs: exprs})
+	if db.Statement.Unscoped {
+		q = q.Unscoped()
+	}
+	var rows []map[string]interface{}
+	if err := q.Find(&rows).Error; err != nil {
+		db.AddError(err)
+		return
+	}
+	db.Statement.Settings.Store(auditBeforeKey, rows)
+}
+
+func auditRowsBefore(db *gorm.DB) []map[string]interface{} {
+	v, ok := db.Statement.Settings.Load(auditBeforeKey)
+	if !ok {
+		return nil
+	}
+	db.Statement.Settings.Delete(auditBeforeKey)
+	return v.([]map[string]interface{})
+}
+
+func auditJSON(values map[string]interface{}) string {
+	if len(values) == 0 {
+		return ""
+	}
+	for k := range values {
+		if auditRedactedColumns[k] {
+			values[k] = auditRedacted
+		}
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func newAuditEvent(db *gorm.DB, operation string, entityID interface{}, before map[string]interface{}, after map[string]interface{}) AuditEvent {
+	actor := actorFromContext(db.Statement.Context)
+	id, _ := json.Marshal(entityID)
+	if s, ok := entityID.(string); ok {
+		id = []byte(s)
+	}
+	return AuditEvent{
+		Time:       time.Now().Unix(),
+		ActorID:    actor.ID,
+		Action:     string(actor.Action),
+		Operation:  operation,
+		EntityType: db.Statement.Schema.Table,
+		EntityID:   string(id),
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+}
+
+func writeAuditEvents(db *gorm.DB, events []AuditEvent) {
+	if len(events) == 0 {
+		return
+	}
+	if err := newAuditSession(db).Create(&events).Error; err != nil {
+		db.AddError(err)
+	}
+}
+
+func auditAfterCreate(db *gorm.DB) {
+	if auditSkipped(db) {
+		return
+	}
+	stmt := db.Statement
+	var values []reflect.Value
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Struct:
+		values = append(values, stmt.ReflectValue)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			values = append(values, reflect.Indirect(stmt.ReflectValue.Index(i)))
+		}
+	}
+
+	var events []AuditEvent
+	for _, rv := range values {
+		if rv.Kind() != reflect.Struct {
+			continue
+		}
+		after := map[string]interface{}{}
+		for _, f := range stmt.Schema.Fields {
+			if f.DBName == "" {
+				continue
+			}
+			v, _ := f.ValueOf(rv)
+			after[f.DBName] = v
+		}
+		pk, _ := stmt.Schema.PrimaryFields[0].ValueOf(rv)
+		events = append(events, newAuditEvent(db, AuditCreate, pk, nil, after))
+	}
+	writeAuditEvents(db, events)
+}
+
+func auditAfterUpdate(db *gorm.DB) {
+	before := auditRowsBefore(db)
+	if auditSkipped(db) || len(before) == 0 {
+		return
+	}
+	pk := db.Statement.Schema.PrimaryFields[0].DBName
+	var ids []interface{}
+	for _, row := range before {
+		ids = append(ids, row[pk])
+	}
+	var rows []map[string]interface{}
+	err := newAuditSession(db).Model(auditedModel(db)).Unscoped().Where(clause.IN{Column: clause.Column{Name: pk}, Values: ids}).Find(&rows).Error
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	after := map[interface{}]map[string]interface{}{}
+	for _, row := range rows {
+		after[row[pk]] = row
+	}
+
+	var events []AuditEvent
+	for _, old := range before {
+		changedBefore := map[string]interface{}{}
+		changedAfter := map[string]interface{}{}
+		for column, v := range after[old[pk]] {
+			if !reflect.DeepEqual(old[column], v) {
+				changedBefore[column] = old[column]
+				changedAfter[column] = v
+			}
+		}
+		if len(changedAfter) != 0 {
+			events = append(events, newAuditEvent(db, AuditUpdate, old[pk], changedBefore, changedAfter))
+		}
+	}
+	writeAuditEvents(db, events)
+}
+
+func auditAfterDelete(db *gorm.DB) {
+	before := auditRowsBefore(db)
+	if auditSkipped(db) || len(before) == 0 {
+		return
+	}
+	pk := db.Statement.Schema.PrimaryFields[0].DBName
+	var events []AuditEvent
+	for _, row := range before {
+		events = append(events, newAuditEvent(db, AuditDelete, row[pk], row, nil))
+	}
+	writeAuditEvents(db, events)
+}
+
+// AuditQuery selects audit events, empty fields don't filter anything. From and To are unix times and both inclusive.
+type AuditQuery struct {
+	ActorID    string
+	EntityType string
+	EntityID   string
+	From       int64
+	To         int64
+	Limit      int
+}
+
+// GetAuditEvents returns the events matching the query, oldest first
+func GetAuditEvents(q AuditQuery, db *gorm.DB) ([]AuditEvent, error) {
+	tx := db.Model(&AuditEvent{})
+	if q.ActorID != "" {
+		tx = tx.Where("actor_id = ?", q.ActorID)
+	}
+	if q.EntityType != "" {
+		tx = tx.Where("entity_type = ?", q.EntityType)
+	}
+	if q.EntityID != "" {
+		tx = tx.Where("entity_id = ?", q.EntityID)
+	}
+	if q.From != 0 {
+		tx = tx.Where("time >= ?", q.From)
+	}
+	if q.To != 0 {
+		tx = tx.Where("time <= ?", q.To)
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+	events := []AuditEvent{}
+	tx = tx.Order("id").Find(&events)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return events, nil
+}
+
+// GetEntityHistory returns every change made to a single row, e.g. GetEntityHistory("users", UUID, db)
+func GetEntityHistory(entityType string, entityID string, db *gorm.DB) ([]AuditEvent, error) {
+	return GetAuditEvents(AuditQuery{EntityType: entityType, EntityID: entityID}, db)
+}
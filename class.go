@@ -0,0 +1,340 @@
+package wilhelmiina
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Class is a homeroom class like "1A". Unlike groups, every student belongs to exactly one class for the whole time they study in the school.
+type Class struct {
+	ClassID           string `gorm:"primaryKey"`
+	Name              string
+	Cohort            int // The year the students of the class started, e.g. 2021
+	HomeroomTeacherID string
+}
+
+type ClassMember struct {
+	gorm.Model
+	ClassID string `gorm:"index"`
+	UUID    string `gorm:"index"`
+}
+
+var ErrNotATeacher = errors.New("user is not a teacher")
+
+func checkTeacher(teacherID string, db *gorm.DB) error {
+	if teacherID == "" {
+		return nil
+	}
+	teacher, err := GetUser(teacherID, db)
+	if err != nil {
+		return err
+	}
+	if teacher.Role != Teacher {
+		return ErrNotATeacher
+	}
+	return nil
+}
+
+// NewClass creates a class, teacherID can be empty if the class has no homeroom teacher yet
+func NewClass(name string, cohort int, teacherID string, db *gorm.DB) (Class, error) {
+	if err := checkTeacher(teacherID, db); err != nil {
+		return Class{}, err
+	}
+	class := Class{
+		ClassID:           uuid.New().String(),
+		Name:              name,
+		Cohort:            cohort,
+		HomeroomTeacherID: teacherID,
+	}
+	tx := db.Begin()
+	tx.Create(&class)
+	err := tx.Commit().Error
+	if err != nil {
+		return Class{}, err
+	}
+	return class, nil
+}
+
+var ErrClassNotFound = errors.New("class not found")
+
+func GetClass(classID string, db *gorm.DB) (Class, error) {
+	var class Class
+	tx := db.Where("class_id = ?", classID).Limit(1).Find(&class)
+	if tx.Error != nil {
+		return Class{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return Class{}, ErrClassNotFound
+	}
+	return class, nil
+}
+
+// GetClasses returns the classes of a cohort sorted by name, or every class if cohort is 0
+func GetClasses(cohort int, db *gorm.DB) ([]Class, error) {
+	classes := []Class{}
+	tx := db.Model(&Class{})
+	if cohort != 0 {
+		tx = tx.Where("cohort = ?", cohort)
+	}
+	tx = tx.Order("cohort").Order("name").Find(&classes)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return classes, nil
+}
+
+func SetHomeroomTeacher(classID string, teacherID string, db *gorm.DB) error {
+	if _, err := GetClass(classID, db); err != nil {
+		return err
+	}
+	if err := checkTeacher(teacherID, db); err != nil {
+		return err
+	}
+	tx := db.Begin()
+	tx.Model(Class{}).Where("class_id = ?", classID).Update("homeroom_teacher_id", teacherID)
+	return tx.Commit().Error
+}
+
+// setHomeroomClass keeps the homeroom class in the profile of the student in sync with their class membership
+func setHomeroomClass(tx *gorm.DB, UUID string, name string, hasProfile bool) {
+	if hasProfile {
+		tx.Model(UserProfile{}).Where("uuid = ?", UUID).Update("homeroom_class", name)
+	} else {
+		tx.Create(&UserProfile{UUID: UUID, HomeroomClass: name})
+	}
+}
+
+func hasProfile(UUID string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&UserProfile{}).Where("uuid = ?", UUID).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// AddClassMember puts a student in a class. A student can only be in one class, so they are removed from their previous class.
+func AddClassMember(classID string, UUID string, db *gorm.DB) (ClassMember, error) {
+	class, err := GetClass(classID, db)
+	if err != nil {
+		return ClassMember{}, err
+	}
+	student, err := GetUser(UUID, db)
+	if err != nil {
+		return ClassMember{}, err
+	}
+	if student.Role != Student {
+		return ClassMember{}, ErrNotAStudent
+	}
+	profile, err := hasProfile(UUID, db)
+	if err != nil {
+		return ClassMember{}, err
+	}
+
+	member := ClassMember{ClassID: classID, UUID: UUID}
+	tx := db.Begin()
+	tx.Where("uuid = ?", UUID).Delete(&ClassMember{})
+	tx.Create(&member)
+	setHomeroomClass(tx, UUID, class.Name, profile)
+	err = tx.Commit().Error
+	if err != nil {
+		return ClassMember{}, err
+	}
+	return member, nil
+}
+
+var ErrNotClassMember = errors.New("user is not a member of the class")
+
+func RemoveClassMember(classID string, UUID string, db *gorm.DB) error {
+	profile, err := hasProfile(UUID, db)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	res := tx.Where("class_id = ? AND uuid = ?", classID, UUID).Delete(&ClassMember{})
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrNotClassMember
+	}
+	if profile {
+		setHomeroomClass(tx, UUID, "", profile)
+	}
+	return tx.Commit().Error
+}
+
+// DeleteClass deletes a class and removes its students from it
+func DeleteClass(classID string, db *gorm.DB) error {
+	if _, err := GetClass(classID, db); err != nil {
+		return err
+	}
+	tx := db.Begin()
+	tx.Model(UserProfile{}).Where("uuid IN (?)", db.Model(&ClassMember{}).Select("uuid").Where("class_id = ?", classID)).
+		Update("homeroom_class", "")
+	tx.Where("class_id = ?", classID).Delete(&ClassMember{})
+	tx.Where("class_id = ?", classID).Delete(&Class{})
+	return tx.Commit().Error
+}
+
+var ErrNoClass = errors.New("student is not in any class")
+
+// GetStudentClass returns the class of a student
+func GetStudentClass(UUID string, db *gorm.DB) (Class, error) {
+	var member ClassMember
+	tx := db.Where("uuid = ?", UUID).Limit(1).Find(&member)
+	if tx.Error != nil {
+		return Class{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return Class{}, ErrNoClass
+	}
+	return GetClass(member.ClassID, db)
+}
+
+// GetClassMembers returns the students of a class, including ones that have graduated or left
+func GetClassMembers(classID string, db *gorm.DB) ([]User, error) {
+	data := []User{}
+	tx := db.Model(&ClassMember{}).
+		Where("class_members.class_id = ? AND class_members.deleted_at IS NULL", classID).Select("users.*").
+		Joins("JOIN users ON users.uuid = class_members.uuid").
+		Order("users.surname").Order("users.firstname").
+		Scan(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return data, nil
+}
+
+// getActiveClassMembers returns the UUIDs of the active students of a class
+func getActiveClassMembers(classID string, db *gorm.DB) ([]string, error) {
+	members, err := GetClassMembers(classID, db)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range members {
+		if m.IsActive() {
+			ids = append(ids, m.UUID)
+		}
+	}
+	return ids, nil
+}
+
+// GetClassGuardians returns the guardians of the active students of a class, every guardian only once
+func GetClassGuardians(classID string, db *gorm.DB) ([]User, error) {
+	ids, err := getActiveClassMembers(classID, db)
+	if err != nil {
+		return nil, err
+	}
+	data := []User{}
+	if len(ids) == 0 {
+		return data, nil
+	}
+	tx := db.Model(&User{}).
+		Where("uuid IN (?)", db.Model(&GuardianData{}).Select("uuid").Where("guardian_of IN ?", ids)).
+		Order("surname").Order("firstname").
+		Find(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return data, nil
+}
+
+var ErrClassIsEmpty = errors.New("class has no active students")
+
+// SendClassMessage sends a message to every active student of a class, and also to their guardians if includeGuardians is true.
+// Unlike SendMessage, guardians are not added automatically when a teacher sends the message.
+func SendClassMessage(from string, classID string, title string, contents string, includeGuardians bool, db *gorm.DB) (Message, error) {
+	if _, err := GetClass(classID, db); err != nil {
+		return Message{}, err
+	}
+	to, err := getActiveClassMembers(classID, db)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(to) == 0 {
+		return Message{}, ErrClassIsEmpty
+	}
+	if includeGuardians {
+		guardians, err := GetClassGuardians(classID, db)
+		if err != nil {
+			return Message{}, err
+		}
+		for _, g := range guardians {
+			to = append(to, g.UUID)
+		}
+	}
+	to = append(to, from)
+	return saveMessage(from, to, title, contents, "", db)
+}
+
+// Owner is the homeroom teacher of the class
+func isHomeroomTeacher(actor User, classID string, db *gorm.DB) (bool, error) {
+	class, err := GetClass(classID, db)
+	if err == ErrClassNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return class.HomeroomTeacherID == actor.UUID, nil
+}
+
+// NewClassAs creates a class if actor is allowed to do so
+func NewClassAs(actor User, name string, cohort int, teacherID string, db *gorm.DB) (Class, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassCreate, "", db); err != nil {
+		return Class{}, err
+	}
+	return NewClass(name, cohort, teacherID, withAudit(db, actor, ActionClassCreate))
+}
+
+// SetHomeroomTeacherAs changes the homeroom teacher of a class if actor is allowed to do so
+func SetHomeroomTeacherAs(actor User, classID string, teacherID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassEdit, classID, db); err != nil {
+		return err
+	}
+	return SetHomeroomTeacher(classID, teacherID, withAudit(db, actor, ActionClassEdit))
+}
+
+// DeleteClassAs deletes a class if actor is allowed to do so
+func DeleteClassAs(actor User, classID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassDelete, classID, db); err != nil {
+		return err
+	}
+	return DeleteClass(classID, withAudit(db, actor, ActionClassDelete))
+}
+
+// AddClassMemberAs puts a student in a class if actor is allowed to do so.
+// A student already in a class is moved out of it, so actor must be allowed to manage that class too.
+func AddClassMemberAs(actor User, classID string, UUID string, db *gorm.DB) (ClassMember, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassMembers, classID, db); err != nil {
+		return ClassMember{}, err
+	}
+	current, err := GetStudentClass(UUID, db)
+	if err != nil && err != ErrNoClass && err != ErrClassNotFound {
+		return ClassMember{}, err
+	}
+	if err == nil && current.ClassID != classID {
+		if err := DefaultAuthorizer.Authorize(actor, ActionClassMembers, current.ClassID, db); err != nil {
+			return ClassMember{}, err
+		}
+	}
+	return AddClassMember(classID, UUID, withAudit(db, actor, ActionClassMembers))
+}
+
+// RemoveClassMemberAs removes a student from a class if actor is allowed to do so
+func RemoveClassMemberAs(actor User, classID string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassMembers, classID, db); err != nil {
+		return err
+	}
+	return RemoveClassMember(classID, UUID, withAudit(db, actor, ActionClassMembers))
+}
+
+// SendClassMessageAs messages a class if actor is allowed to do so
+func SendClassMessageAs(actor User, classID string, title string, contents string, includeGuardians bool, db *gorm.DB) (Message, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionClassMessage, classID, db); err != nil {
+		return Message{}, err
+	}
+	return SendClassMessage(actor.UUID, classID, title, contents, includeGuardians, withAudit(db, actor, ActionClassMessage))
+}
@@ -0,0 +1,206 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Weekday names for GroupTime.DayOfTheWeek, the week starts from monday
+var weekdayNames = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+func weekdayName(day int64) string {
+	if day < 0 || int(day) >= len(weekdayNames) {
+		return fmt.Sprintf("day %d", day)
+	}
+	return weekdayNames[day]
+}
+
+// formatTimeOfDay formats a time since midnight like GroupTime.StartTime as 08:15
+func formatTimeOfDay(t int64) string {
+	d := time.Duration(t)
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// ScheduleConflict is a lesson of Group that overlaps a lesson of Other. StartTime and EndTime are the overlapping part.
+type ScheduleConflict struct {
+	Group        Group
+	Other        Group
+	DayOfTheWeek int64
+	StartTime    int64
+	EndTime      int64
+}
+
+func (c ScheduleConflict) String() string {
+	return fmt.Sprintf("%s overlaps %s on %s %s-%s", c.Group.Name, c.Other.Name, weekdayName(c.DayOfTheWeek), formatTimeOfDay(c.StartTime), formatTimeOfDay(c.EndTime))
+}
+
+var ErrScheduleConflict = errors.New("schedule conflict")
+
+// ScheduleConflictError lists the lessons that would overlap. It unwraps to ErrScheduleConflict.
+type ScheduleConflictError struct {
+	Conflicts []ScheduleConflict
+}
+
+func (e *ScheduleConflictError) Error() string {
+	var parts []string
+	for _, c := range e.Conflicts {
+		parts = append(parts, c.String())
+	}
+	return ErrScheduleConflict.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *ScheduleConflictError) Unwrap() error {
+	return ErrScheduleConflict
+}
+
+// groupConflicts returns the overlapping lessons of two groups. Groups only conflict if their dates overlap too.
+// Lessons that end when the other one starts don't overlap.
+func groupConflicts(a Group, aTimes []GroupTime, b Group, bTimes []GroupTime) []ScheduleConflict {
+	var conflicts []ScheduleConflict
+	if !overlaps(a.StartDate, a.EndDate, b.StartDate, b.EndDate) {
+		return conflicts
+	}
+	for _, at := range aTimes {
+		for _, bt := range bTimes {
+			if at.DayOfTheWeek != bt.DayOfTheWeek || at.StartTime >= bt.EndTime || bt.StartTime >= at.EndTime {
+				continue
+			}
+			c := ScheduleConflict{Group: a, Other: b, DayOfTheWeek: at.DayOfTheWeek, StartTime: at.StartTime, EndTime: at.EndTime}
+			if bt.StartTime > c.StartTime {
+				c.StartTime = bt.StartTime
+			}
+			if bt.EndTime < c.EndTime {
+				c.EndTime = bt.EndTime
+			}
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// getScheduledGroups returns the groups a user is in or teaches
+func getScheduledGroups(UUID string, db *gorm.DB) ([]Group, error) {
+	groups := []Group{}
+	tx := db.Where("group_id IN (?)", db.Model(&GroupReservation{}).Select("group_id").Where("reserver_uuid = ?", UUID)).
+		Or("teacher_id = ?", UUID).Order("name").Find(&groups)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return groups, nil
+}
+
+// getTimesOfGroups returns the times of the groups by group id
+func getTimesOfGroups(groups []Group, db *gorm.DB) (map[string][]GroupTime, error) {
+	times := map[string][]GroupTime{}
+	if len(groups) == 0 {
+		return times, nil
+	}
+	var ids []string
+	for _, g := range groups {
+		ids = append(ids, g.GroupID)
+	}
+	var rows []GroupTime
+	tx := db.Where("group_id IN ?", ids).Order("day_of_the_week").Order("start_time").Find(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, t := range rows {
+		times[t.GroupID] = append(times[t.GroupID], t)
+	}
+	return times, nil
+}
+
+// FindConflicts returns the lessons of groupID that would overlap the lessons of the groups the user is already in or teaches
+func FindConflicts(UUID string, groupID string, db *gorm.DB) ([]ScheduleConflict, error) {
+	group, err := getGroupInfo(groupID, db)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := getScheduledGroups(UUID, db)
+	if err != nil {
+		return nil, err
+	}
+	times, err := getTimesOfGroups(append(groups, group), db)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []ScheduleConflict{}
+	for _, g := range groups {
+		if g.GroupID == groupID {
+			continue
+		}
+		conflicts = append(conflicts, groupConflicts(group, times[groupID], g, times[g.GroupID])...)
+	}
+	return conflicts, nil
+}
+
+// GetScheduleConflicts returns every overlap between the groups a user is in or teaches
+func GetScheduleConflicts(UUID string, db *gorm.DB) ([]ScheduleConflict, error) {
+	groups, err := getScheduledGroups(UUID, db)
+	if err != nil {
+		return nil, err
+	}
+	times, err := getTimesOfGroups(groups, db)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []ScheduleConflict{}
+	for i, a := range groups {
+		for _, b := range groups[i+1:] {
+			conflicts = append(conflicts, groupConflicts(a, times[a.GroupID], b, times[b.GroupID])...)
+		}
+	}
+	return conflicts, nil
+}
+
+// FindGroupConflicts returns the lessons the group would have with the given dates and times that overlap the schedules of its members and teacher.
+// It is used to check changes to a group before they are saved.
+func FindGroupConflicts(group Group, times []GroupTime, db *gorm.DB) ([]ScheduleConflict, error) {
+	var ids []string
+	if err := db.Model(&GroupReservation{}).Where("group_id = ?", group.GroupID).Pluck("reserver_uuid", &ids).Error; err != nil {
+		return nil, err
+	}
+	if group.TeacherID != "" {
+		ids = append(ids, group.TeacherID)
+	}
+	conflicts := []ScheduleConflict{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		groups, err := getScheduledGroups(id, db)
+		if err != nil {
+			return nil, err
+		}
+		others, err := getTimesOfGroups(groups, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			// Two groups that share members would otherwise be reported for every member
+			if g.GroupID == group.GroupID || seen[g.GroupID] {
+				continue
+			}
+			seen[g.GroupID] = true
+			conflicts = append(conflicts, groupConflicts(group, times, g, others[g.GroupID])...)
+		}
+	}
+	return conflicts, nil
+}
+
+// checkScheduleConflicts returns a *ScheduleConflictError if the group overlaps the schedule of the user
+func checkScheduleConflicts(UUID string, groupID string, db *gorm.DB) error {
+	conflicts, err := FindConflicts(UUID, groupID, db)
+	if err == ErrGroupNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(conflicts) != 0 {
+		return &ScheduleConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
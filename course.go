@@ -2,6 +2,7 @@ package wilhelmiina
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -13,8 +14,34 @@ type Course struct {
 	CourseNameShort   string
 	CourseDescription string
 	SubjectID         string
+	Credits           int // Opintopisteet
+	Type              CourseType
+	Level             string // e.g. "A" or "B1" for languages, "pitkä" or "lyhyt" for mathematics, empty if the subject has only one level
 }
 
+// CourseType tells whether a course is mandatory or elective in the curriculum
+type CourseType int
+
+const Mandatory CourseType = 0
+const NationalElective CourseType = 1
+const SchoolElective CourseType = 2
+
+var courseTypeNames = map[CourseType]string{
+	Mandatory:        "mandatory",
+	NationalElective: "national_elective",
+	SchoolElective:   "school_elective",
+}
+
+func (t CourseType) String() string {
+	if name, ok := courseTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("coursetype(%d)", int(t))
+}
+
+var ErrInvalidCourseType = errors.New("invalid course type")
+var ErrInvalidCredits = errors.New("credits can't be negative")
+
 func NewCourse(courseName string, courseNameShort string, courseDesc string, subjectID string, db *gorm.DB) (Course, error) {
 	courseID := uuid.New().String()
 	course := Course{
@@ -76,11 +103,32 @@ func (c *Course) SetShortName(newName string, db *gorm.DB) error {
 	return nil
 }
 
+// SetStudyInfo sets the credits, type and level of the course
+func (c *Course) SetStudyInfo(credits int, courseType CourseType, level string, db *gorm.DB) error {
+	if credits < 0 {
+		return ErrInvalidCredits
+	}
+	if _, ok := courseTypeNames[courseType]; !ok {
+		return ErrInvalidCourseType
+	}
+	tx := db.Begin()
+	tx.Model(c).Where("course_id = ?", c.CourseID).
+		Updates(map[string]interface{}{"credits": credits, "type": courseType, "level": level})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	c.Credits = credits
+	c.Type = courseType
+	c.Level = level
+	return nil
+}
+
 func (c *Course) Delete(db *gorm.DB) error {
 	return DeleteCourse(c.CourseID, db)
 }
 
-// Deletes course and all groups related to it
+// Deletes course and all groups related to it. The course is also removed from the prerequisites of other courses.
 func DeleteCourse(courseID string, db *gorm.DB) error {
 	groups, err := GetGroupsForCourse(courseID, db)
 	if err != nil {
@@ -89,11 +137,58 @@ func DeleteCourse(courseID string, db *gorm.DB) error {
 	for _, g := range groups {
 		g.GroupInfo.Delete(db)
 	}
-	tx := db.Begin()
-	tx.Delete(Course{}, "course_id = ?", courseID)
-	err = tx.Commit().Error
-	if err != nil {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := deletePrerequisitesOf(courseID, tx); err != nil {
+			return err
+		}
+		return tx.Delete(Course{}, "course_id = ?", courseID).Error
+	})
+}
+
+// NewCourseAs creates a course if actor is allowed to do so
+func NewCourseAs(actor User, courseName string, courseNameShort string, courseDesc string, subjectID string, db *gorm.DB) (Course, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseCreate, "", db); err != nil {
+		return Course{}, err
+	}
+	return NewCourse(courseName, courseNameShort, courseDesc, subjectID, withAudit(db, actor, ActionCourseCreate))
+}
+
+// DeleteCourseAs deletes a course and its groups if actor is allowed to do so
+func DeleteCourseAs(actor User, courseID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseDelete, courseID, db); err != nil {
 		return err
 	}
-	return nil
+	return DeleteCourse(courseID, withAudit(db, actor, ActionCourseDelete))
+}
+
+// SetStudyInfoAs sets the credits, type and level of the course if actor is allowed to do so
+func (c *Course) SetStudyInfoAs(actor User, credits int, courseType CourseType, level string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, c.CourseID, db); err != nil {
+		return err
+	}
+	return c.SetStudyInfo(credits, courseType, level, withAudit(db, actor, ActionCourseEdit))
+}
+
+// SetNameAs renames the course if actor is allowed to do so
+func (c *Course) SetNameAs(actor User, newName string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, c.CourseID, db); err != nil {
+		return err
+	}
+	return c.SetName(newName, withAudit(db, actor, ActionCourseEdit))
+}
+
+// SetShortNameAs changes the short name of the course if actor is allowed to do so
+func (c *Course) SetShortNameAs(actor User, newName string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, c.CourseID, db); err != nil {
+		return err
+	}
+	return c.SetShortName(newName, withAudit(db, actor, ActionCourseEdit))
+}
+
+// SetDescriptionAs changes the description of the course if actor is allowed to do so
+func (c *Course) SetDescriptionAs(actor User, newDesc string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, c.CourseID, db); err != nil {
+		return err
+	}
+	return c.SetDescription(newDesc, withAudit(db, actor, ActionCourseEdit))
 }
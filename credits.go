@@ -0,0 +1,300 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const MIN_GRADE = 4
+const MAX_GRADE = 10
+
+// Grades below this are failed
+const PASSING_GRADE = 5
+
+// Credits needed to graduate, and how many of them must come from national elective courses
+var RequiredTotalCredits = 150
+var RequiredNationalElectiveCredits = 20
+
+// CourseCompletion is a grade a student got from a course. A course can be retaken, only the best grade counts.
+type CourseCompletion struct {
+	gorm.Model
+	UUID        string `gorm:"index"`
+	CourseID    string `gorm:"index"`
+	Grade       int
+	CompletedAt int64
+}
+
+func (c CourseCompletion) Passed() bool {
+	return c.Grade >= PASSING_GRADE
+}
+
+// SubjectRequirement is a curriculum rule: students must complete at least MinCredits credits of courses of Type in the subject.
+// If Level is not empty only courses of that level count.
+type SubjectRequirement struct {
+	gorm.Model
+	SubjectID  string `gorm:"index"`
+	Level      string
+	Type       CourseType
+	MinCredits int
+}
+
+var ErrInvalidGrade = errors.New("grade must be between 4 and 10")
+
+// RecordCompletion saves the grade a student got from a course. If completedAt is 0 the current time is used.
+func RecordCompletion(UUID string, courseID string, grade int, completedAt int64, db *gorm.DB) (CourseCompletion, error) {
+	if grade < MIN_GRADE || grade > MAX_GRADE {
+		return CourseCompletion{}, ErrInvalidGrade
+	}
+	student, err := GetUser(UUID, db)
+	if err != nil {
+		return CourseCompletion{}, err
+	}
+	if student.Role != Student {
+		return CourseCompletion{}, ErrNotAStudent
+	}
+	if _, err := GetCourse(courseID, db); err != nil {
+		return CourseCompletion{}, err
+	}
+	if completedAt == 0 {
+		completedAt = time.Now().Unix()
+	}
+
+	c := CourseCompletion{
+		UUID:        UUID,
+		CourseID:    courseID,
+		Grade:       grade,
+		CompletedAt: completedAt,
+	}
+	tx := db.Begin()
+	tx.Create(&c)
+	err = tx.Commit().Error
+	if err != nil {
+		return CourseCompletion{}, err
+	}
+	return c, nil
+}
+
+// GetCompletions returns every grade of a student, including failed ones and retakes, oldest first
+func GetCompletions(UUID string, db *gorm.DB) ([]CourseCompletion, error) {
+	completions := []CourseCompletion{}
+	tx := db.Where("uuid = ?", UUID).Order("completed_at").Find(&completions)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return completions, nil
+}
+
+// GetBestGrades returns the best grade of a student in every course they have a grade in
+func GetBestGrades(UUID string, db *gorm.DB) (map[string]int, error) {
+	completions, err := GetCompletions(UUID, db)
+	if err != nil {
+		return nil, err
+	}
+	best := map[string]int{}
+	for _, c := range completions {
+		if c.Grade > best[c.CourseID] {
+			best[c.CourseID] = c.Grade
+		}
+	}
+	return best, nil
+}
+
+// getPassedCourses returns the courses a student has passed
+func getPassedCourses(UUID string, db *gorm.DB) ([]Course, error) {
+	best, err := GetBestGrades(UUID, db)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, grade := range best {
+		if grade >= PASSING_GRADE {
+			ids = append(ids, id)
+		}
+	}
+	courses := []Course{}
+	if len(ids) == 0 {
+		return courses, nil
+	}
+	tx := db.Where("course_id IN ?", ids).Find(&courses)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return courses, nil
+}
+
+// CreditSummary is the amount of credits a student has from passed courses
+type CreditSummary struct {
+	Total            int
+	Mandatory        int
+	NationalElective int
+	SchoolElective   int
+	BySubject        map[string]int // Subject id to credits
+}
+
+// GetCreditSummary calculates the credits of a student. Every passed course counts once, no matter how many times it was retaken.
+func GetCreditSummary(UUID string, db *gorm.DB) (CreditSummary, error) {
+	courses, err := getPassedCourses(UUID, db)
+	if err != nil {
+		return CreditSummary{}, err
+	}
+	summary := CreditSummary{BySubject: map[string]int{}}
+	for _, c := range courses {
+		summary.Total += c.Credits
+		summary.BySubject[c.SubjectID] += c.Credits
+		switch c.Type {
+		case Mandatory:
+			summary.Mandatory += c.Credits
+		case NationalElective:
+			summary.NationalElective += c.Credits
+		case SchoolElective:
+			summary.SchoolElective += c.Credits
+		}
+	}
+	return summary, nil
+}
+
+// AddSubjectRequirement adds a curriculum rule to a subject
+func AddSubjectRequirement(subjectID string, level string, courseType CourseType, minCredits int, db *gorm.DB) (SubjectRequirement, error) {
+	if minCredits < 0 {
+		return SubjectRequirement{}, ErrInvalidCredits
+	}
+	if _, ok := courseTypeNames[courseType]; !ok {
+		return SubjectRequirement{}, ErrInvalidCourseType
+	}
+	if _, err := GetSubject(subjectID, db); err != nil {
+		return SubjectRequirement{}, err
+	}
+	r := SubjectRequirement{
+		SubjectID:  subjectID,
+		Level:      level,
+		Type:       courseType,
+		MinCredits: minCredits,
+	}
+	tx := db.Begin()
+	tx.Create(&r)
+	err := tx.Commit().Error
+	if err != nil {
+		return SubjectRequirement{}, err
+	}
+	return r, nil
+}
+
+func RemoveSubjectRequirement(ID uint, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Where("id = ?", ID).Delete(&SubjectRequirement{})
+	return tx.Commit().Error
+}
+
+// GetSubjectRequirements returns the curriculum rules of a subject, or of all subjects if subjectID is empty
+func GetSubjectRequirements(subjectID string, db *gorm.DB) ([]SubjectRequirement, error) {
+	requirements := []SubjectRequirement{}
+	tx := db.Model(&SubjectRequirement{})
+	if subjectID != "" {
+		tx = tx.Where("subject_id = ?", subjectID)
+	}
+	tx = tx.Order("id").Find(&requirements)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return requirements, nil
+}
+
+type RequirementStatus struct {
+	Requirement SubjectRequirement
+	Credits     int
+	Met         bool
+}
+
+// CurriculumStatus tells how far a student is from graduating
+type CurriculumStatus struct {
+	Credits      CreditSummary
+	Requirements []RequirementStatus
+	// All requirements are met and the student has enough credits
+	Complete bool
+}
+
+// CheckCurriculum compares the passed courses of a student against the curriculum rules and the required amount of credits
+func CheckCurriculum(UUID string, db *gorm.DB) (CurriculumStatus, error) {
+	summary, err := GetCreditSummary(UUID, db)
+	if err != nil {
+		return CurriculumStatus{}, err
+	}
+	courses, err := getPassedCourses(UUID, db)
+	if err != nil {
+		return CurriculumStatus{}, err
+	}
+	requirements, err := GetSubjectRequirements("", db)
+	if err != nil {
+		return CurriculumStatus{}, err
+	}
+
+	status := CurriculumStatus{
+		Credits:  summary,
+		Complete: summary.Total >= RequiredTotalCredits && summary.NationalElective >= RequiredNationalElectiveCredits,
+	}
+	for _, r := range requirements {
+		credits := 0
+		for _, c := range courses {
+			if c.SubjectID == r.SubjectID && c.Type == r.Type && (r.Level == "" || c.Level == r.Level) {
+				credits += c.Credits
+			}
+		}
+		rs := RequirementStatus{Requirement: r, Credits: credits, Met: credits >= r.MinCredits}
+		if !rs.Met {
+			status.Complete = false
+		}
+		status.Requirements = append(status.Requirements, rs)
+	}
+	return status, nil
+}
+
+// Owner teaches a group of the course
+func isCourseTeacher(actor User, courseID string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&Group{}).Where("course_id = ? AND teacher_id = ?", courseID, actor.UUID).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// teachesStudent reports whether actor teaches a group of the course that the student is in
+func teachesStudent(actor User, UUID string, courseID string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&GroupReservation{}).
+		Joins("JOIN groups ON groups.group_id = group_reservations.group_id").
+		Where("groups.course_id = ? AND groups.teacher_id = ? AND group_reservations.reserver_uuid = ?", courseID, actor.UUID, UUID).
+		Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// RecordCompletionAs saves a grade if actor is allowed to do so.
+// Teachers who are only allowed as owners can grade the students of their own groups, not everyone taking the course.
+func RecordCompletionAs(actor User, UUID string, courseID string, grade int, completedAt int64, db *gorm.DB) (CourseCompletion, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGradeRecord, courseID, db); err != nil {
+		return CourseCompletion{}, err
+	}
+	if p, ok := DefaultAuthorizer.GetPermission(ActionGradeRecord); ok && !hasRole(actor.Role, p.Roles) {
+		teaches, err := teachesStudent(actor, UUID, courseID, db)
+		if err != nil {
+			return CourseCompletion{}, err
+		}
+		if !teaches {
+			return CourseCompletion{}, ErrForbidden
+		}
+	}
+	return RecordCompletion(UUID, courseID, grade, completedAt, withAudit(db, actor, ActionGradeRecord))
+}
+
+// AddSubjectRequirementAs adds a curriculum rule if actor is allowed to do so
+func AddSubjectRequirementAs(actor User, subjectID string, level string, courseType CourseType, minCredits int, db *gorm.DB) (SubjectRequirement, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectEdit, subjectID, db); err != nil {
+		return SubjectRequirement{}, err
+	}
+	return AddSubjectRequirement(subjectID, level, courseType, minCredits, withAudit(db, actor, ActionSubjectEdit))
+}
@@ -13,11 +13,27 @@ func InitDatabase(databaseName string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = EnableAuditLog(db)
+	if err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
 // Migrates datatypes to database, should be run only on the first run of the app
 func CreateTables(db *gorm.DB) error {
-	err := db.AutoMigrate(&User{}, &Course{}, &Group{}, &GroupReservation{}, &GroupTime{}, &Message{}, &MessageReciever{}, Subject{})
-	return err
+	// The audit log is needed first, because every change made by the migrations is logged
+	err := db.AutoMigrate(&AuditEvent{})
+	if err != nil {
+		return err
+	}
+	err = migrateUsernameKeys(db)
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&User{}, &Course{}, &Group{}, &GroupReservation{}, &GroupTime{}, &Message{}, &MessageReciever{}, Subject{}, &Session{}, &GuardianData{}, &LoginAttempt{}, &LoginThrottle{}, &TOTPSecret{}, &RecoveryCode{}, &PasswordResetToken{}, &UserProfile{}, &APIKey{}, &Class{}, &ClassMember{}, &SchoolYear{}, &Period{}, &CourseCompletion{}, &SubjectRequirement{}, &CoursePrerequisite{}, &WaitlistEntry{}, &EnrollmentWindow{}, &SelectionRound{}, &SelectionChoice{}, &Holiday{})
+	if err != nil {
+		return err
+	}
+	return migrateNameKeys(db)
 }
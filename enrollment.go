@@ -0,0 +1,462 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// EnrollmentWindow is a time when students can join groups. A window is either for a single group or for every group of a period.
+// Groups without any windows, neither their own nor their period's, are always open.
+type EnrollmentWindow struct {
+	gorm.Model
+	PeriodID string `gorm:"index"`
+	GroupID  string `gorm:"index"`
+	Opens    int64
+	Closes   int64
+}
+
+var ErrEnrollmentClosed = errors.New("enrollment to the group is closed")
+
+func newEnrollmentWindow(w EnrollmentWindow, db *gorm.DB) (EnrollmentWindow, error) {
+	if w.Closes <= w.Opens {
+		return EnrollmentWindow{}, ErrInvalidDateRange
+	}
+	tx := db.Begin()
+	tx.Create(&w)
+	err := tx.Commit().Error
+	if err != nil {
+		return EnrollmentWindow{}, err
+	}
+	return w, nil
+}
+
+// AddPeriodEnrollmentWindow opens enrollment to all groups of a period between opens and closes
+func AddPeriodEnrollmentWindow(periodID string, opens int64, closes int64, db *gorm.DB) (EnrollmentWindow, error) {
+	if _, err := GetPeriod(periodID, db); err != nil {
+		return EnrollmentWindow{}, err
+	}
+	return newEnrollmentWindow(EnrollmentWindow{PeriodID: periodID, Opens: opens, Closes: closes}, db)
+}
+
+// AddGroupEnrollmentWindow opens enrollment to a group between opens and closes. Windows of a group replace the windows of its period.
+func AddGroupEnrollmentWindow(groupID string, opens int64, closes int64, db *gorm.DB) (EnrollmentWindow, error) {
+	if _, err := getGroupInfo(groupID, db); err != nil {
+		return EnrollmentWindow{}, err
+	}
+	return newEnrollmentWindow(EnrollmentWindow{GroupID: groupID, Opens: opens, Closes: closes}, db)
+}
+
+func RemoveEnrollmentWindow(ID uint, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Where("id = ?", ID).Delete(&EnrollmentWindow{})
+	return tx.Commit().Error
+}
+
+// GetEnrollmentWindows returns the windows that apply to a group
+func GetEnrollmentWindows(groupID string, db *gorm.DB) ([]EnrollmentWindow, error) {
+	windows := []EnrollmentWindow{}
+	tx := db.Where("group_id = ?", groupID).Order("opens").Find(&windows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if len(windows) != 0 {
+		return windows, nil
+	}
+	group, err := getGroupInfo(groupID, db)
+	if err != nil || group.PeriodID == "" {
+		return windows, err
+	}
+	tx = db.Where("period_id = ?", group.PeriodID).Order("opens").Find(&windows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return windows, nil
+}
+
+// IsEnrollmentOpen reports whether students can join the group at the unix time t
+func IsEnrollmentOpen(groupID string, t int64, db *gorm.DB) (bool, error) {
+	windows, err := GetEnrollmentWindows(groupID, db)
+	if err == ErrGroupNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(windows) == 0 {
+		return true, nil
+	}
+	for _, w := range windows {
+		if w.Opens <= t && t < w.Closes {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkEnrollmentOpen returns ErrEnrollmentClosed if a student tries to join a group outside its enrollment windows
+func checkEnrollmentOpen(UUID string, groupID string, db *gorm.DB) error {
+	user, err := GetUser(UUID, db)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Role != Student {
+		return nil
+	}
+	open, err := IsEnrollmentOpen(groupID, time.Now().Unix(), db)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return ErrEnrollmentClosed
+	}
+	return nil
+}
+
+// SelectionRound is a course selection where students rank the groups of a period they would like to join.
+// After the round closes AllocateRound places students in groups.
+type SelectionRound struct {
+	RoundID  string `gorm:"primaryKey"`
+	PeriodID string `gorm:"index"`
+	Name     string
+	Opens    int64
+	Closes   int64
+	// How many groups every student gets at most
+	Places    int
+	Allocated bool
+}
+
+// SelectionChoice is a group a student would like to join, Rank 1 is the most wanted
+type SelectionChoice struct {
+	gorm.Model
+	RoundID string `gorm:"index"`
+	UUID    string `gorm:"index"`
+	GroupID string
+	Rank    int
+}
+
+func NewSelectionRound(periodID string, name string, opens int64, closes int64, places int, db *gorm.DB) (SelectionRound, error) {
+	if closes <= opens {
+		return SelectionRound{}, ErrInvalidDateRange
+	}
+	if _, err := GetPeriod(periodID, db); err != nil {
+		return SelectionRound{}, err
+	}
+	if places < 1 {
+		places = 1
+	}
+	round := SelectionRound{
+		RoundID:  uuid.New().String(),
+		PeriodID: periodID,
+		Name:     name,
+		Opens:    opens,
+		Closes:   closes,
+		Places:   places,
+	}
+	tx := db.Begin()
+	tx.Create(&round)
+	err := tx.Commit().Error
+	if err != nil {
+		return SelectionRound{}, err
+	}
+	return round, nil
+}
+
+var ErrRoundNotFound = errors.New("selection round not found")
+
+func GetSelectionRound(roundID string, db *gorm.DB) (SelectionRound, error) {
+	var round SelectionRound
+	tx := db.Where("round_id = ?", roundID).Limit(1).Find(&round)
+	if tx.Error != nil {
+		return SelectionRound{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return SelectionRound{}, ErrRoundNotFound
+	}
+	return round, nil
+}
+
+var ErrRoundClosed = errors.New("selection round is not open")
+var ErrGroupNotInRound = errors.New("group is not in the period of the selection round")
+var ErrDuplicateChoice = errors.New("the same group can't be chosen twice")
+
+// SubmitChoices saves the ranked choices of a student, the first group is the most wanted one. Submitting again replaces the earlier choices.
+func SubmitChoices(roundID string, UUID string, groupIDs []string, db *gorm.DB) error {
+	round, err := GetSelectionRound(roundID, db)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if round.Allocated || now < round.Opens || now >= round.Closes {
+		return ErrRoundClosed
+	}
+	student, err := GetUser(UUID, db)
+	if err != nil {
+		return err
+	}
+	if student.Role != Student {
+		return ErrNotAStudent
+	}
+
+	var choices []SelectionChoice
+	seen := map[string]bool{}
+	for i, id := range groupIDs {
+		if seen[id] {
+			return ErrDuplicateChoice
+		}
+		seen[id] = true
+		group, err := getGroupInfo(id, db)
+		if err != nil {
+			return err
+		}
+		if group.PeriodID != round.PeriodID {
+			return ErrGroupNotInRound
+		}
+		err = checkReservationPrerequisites(UUID, id, db)
+		if err != nil {
+			return err
+		}
+		choices = append(choices, SelectionChoice{RoundID: roundID, UUID: UUID, GroupID: id, Rank: i + 1})
+	}
+
+	tx := db.Begin()
+	tx.Unscoped().Where("round_id = ? AND uuid = ?", roundID, UUID).Delete(&SelectionChoice{})
+	if len(choices) != 0 {
+		tx.Create(&choices)
+	}
+	return tx.Commit().Error
+}
+
+// GetChoices returns the groups a student has chosen in a round, most wanted first
+func GetChoices(roundID string, UUID string, db *gorm.DB) ([]string, error) {
+	var choices []SelectionChoice
+	tx := db.Where("round_id = ? AND uuid = ?", roundID, UUID).Order("rank").Find(&choices)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	groups := []string{}
+	for _, c := range choices {
+		groups = append(groups, c.GroupID)
+	}
+	return groups, nil
+}
+
+// AllocationResult tells which groups every student got. Students in Unplaced got fewer groups than the round allows,
+// either because they chose fewer groups or because their choices were full.
+type AllocationResult struct {
+	RoundID  string
+	Assigned map[string][]string
+	Unplaced []string
+}
+
+var ErrRoundStillOpen = errors.New("selection round has not closed yet")
+var ErrRoundAllocated = errors.New("selection round has already been allocated")
+
+// AllocateRound places the students of a closed round in groups. The order of the students is drawn with seed, so the same seed always gives the same result.
+// Everyone's first choices are handled before anyone's second choices, so a student only misses their first choice when the group is full of students who also ranked it first.
+// The order is reversed for every other rank so the students drawn last get the first pick of the next rank.
+// Students who are not active are left out, and nobody is placed in a group that overlaps their schedule.
+func AllocateRound(roundID string, seed int64, db *gorm.DB) (AllocationResult, error) {
+	round, err := GetSelectionRound(roundID, db)
+	if err != nil {
+		return AllocationResult{}, err
+	}
+	if round.Allocated {
+		return AllocationResult{}, ErrRoundAllocated
+	}
+	if time.Now().Unix() < round.Closes {
+		return AllocationResult{}, ErrRoundStillOpen
+	}
+
+	var choices []SelectionChoice
+	tx := db.Where("round_id = ?", roundID).Order("uuid").Order("rank").Find(&choices)
+	if tx.Error != nil {
+		return AllocationResult{}, tx.Error
+	}
+	ranked := map[string][]string{}
+	active := map[string]bool{}
+	var students []string
+	maxRank := 0
+	for _, c := range choices {
+		if _, ok := ranked[c.UUID]; !ok {
+			user, err := GetUser(c.UUID, db)
+			if err != nil && err != ErrUserNotFound {
+				return AllocationResult{}, err
+			}
+			active[c.UUID] = err == nil && user.IsActive()
+			if active[c.UUID] {
+				students = append(students, c.UUID)
+			}
+		}
+		if !active[c.UUID] {
+			ranked[c.UUID] = nil
+			continue
+		}
+		ranked[c.UUID] = append(ranked[c.UUID], c.GroupID)
+		if len(ranked[c.UUID]) > maxRank {
+			maxRank = len(ranked[c.UUID])
+		}
+	}
+	sort.Strings(students)
+	rand.New(rand.NewSource(seed)).Shuffle(len(students), func(i, j int) {
+		students[i], students[j] = students[j], students[i]
+	})
+
+	// Places left in every group and who is already in them
+	free := map[string]int{}
+	members := map[string]map[string]bool{}
+	groups := map[string]Group{}
+	for _, c := range choices {
+		if _, ok := free[c.GroupID]; ok {
+			continue
+		}
+		group, err := getGroupInfo(c.GroupID, db)
+		if err == ErrGroupNotFound {
+			free[c.GroupID] = 0
+			continue
+		}
+		if err != nil {
+			return AllocationResult{}, err
+		}
+		groups[c.GroupID] = group
+		free[c.GroupID], err = freePlaces(group, db)
+		if err != nil {
+			return AllocationResult{}, err
+		}
+		var reservations []GroupReservation
+		tx := db.Where("group_id = ?", c.GroupID).Find(&reservations)
+		if tx.Error != nil {
+			return AllocationResult{}, tx.Error
+		}
+		members[c.GroupID] = map[string]bool{}
+		for _, r := range reservations {
+			members[c.GroupID][r.ReserverUUID] = true
+		}
+	}
+
+	// The groups every student is in or teaches, the groups they get are added as they are placed
+	schedules := map[string][]Group{}
+	all := []Group{}
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	for _, s := range students {
+		schedules[s], err = getScheduledGroups(s, db)
+		if err != nil {
+			return AllocationResult{}, err
+		}
+		all = append(all, schedules[s]...)
+	}
+	times, err := getTimesOfGroups(all, db)
+	if err != nil {
+		return AllocationResult{}, err
+	}
+	fits := func(s string, g string) bool {
+		for _, other := range schedules[s] {
+			if other.GroupID != g && len(groupConflicts(groups[g], times[g], other, times[other.GroupID])) != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	result := AllocationResult{RoundID: roundID, Assigned: map[string][]string{}}
+	var reservations []GroupReservation
+	for rank := 0; rank < maxRank; rank++ {
+		for i := range students {
+			s := students[i]
+			if rank%2 == 1 {
+				s = students[len(students)-1-i]
+			}
+			if rank >= len(ranked[s]) || len(result.Assigned[s]) >= round.Places {
+				continue
+			}
+			g := ranked[s][rank]
+			if free[g] == 0 || members[g][s] || !fits(s, g) {
+				continue
+			}
+			if free[g] > 0 {
+				free[g]--
+			}
+			members[g][s] = true
+			schedules[s] = append(schedules[s], groups[g])
+			result.Assigned[s] = append(result.Assigned[s], g)
+			reservations = append(reservations, GroupReservation{GroupID: g, ReserverUUID: s})
+		}
+	}
+	for _, s := range students {
+		if len(result.Assigned[s]) < round.Places {
+			result.Unplaced = append(result.Unplaced, s)
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// The round is claimed first, so if two allocations run at once only one of them saves its reservations
+		res := tx.Model(SelectionRound{}).Where("round_id = ? AND allocated = ?", roundID, false).Update("allocated", true)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrRoundAllocated
+		}
+		if len(reservations) != 0 {
+			return tx.Create(&reservations).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return AllocationResult{}, err
+	}
+	return result, nil
+}
+
+// AddPeriodEnrollmentWindowAs opens enrollment to a period if actor is allowed to do so
+func AddPeriodEnrollmentWindowAs(actor User, periodID string, opens int64, closes int64, db *gorm.DB) (EnrollmentWindow, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionEnrollmentManage, periodID, db); err != nil {
+		return EnrollmentWindow{}, err
+	}
+	return AddPeriodEnrollmentWindow(periodID, opens, closes, withAudit(db, actor, ActionEnrollmentManage))
+}
+
+// AddGroupEnrollmentWindowAs opens enrollment to a group if actor is allowed to do so
+func AddGroupEnrollmentWindowAs(actor User, groupID string, opens int64, closes int64, db *gorm.DB) (EnrollmentWindow, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionEnrollmentManage, groupID, db); err != nil {
+		return EnrollmentWindow{}, err
+	}
+	return AddGroupEnrollmentWindow(groupID, opens, closes, withAudit(db, actor, ActionEnrollmentManage))
+}
+
+// NewSelectionRoundAs creates a selection round if actor is allowed to do so
+func NewSelectionRoundAs(actor User, periodID string, name string, opens int64, closes int64, places int, db *gorm.DB) (SelectionRound, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionEnrollmentManage, periodID, db); err != nil {
+		return SelectionRound{}, err
+	}
+	return NewSelectionRound(periodID, name, opens, closes, places, withAudit(db, actor, ActionEnrollmentManage))
+}
+
+// SubmitChoicesAs saves the choices of student UUID if actor is allowed to do so
+func SubmitChoicesAs(actor User, roundID string, UUID string, groupIDs []string, db *gorm.DB) error {
+	action := ActionEnrollmentManage
+	if actor.UUID == UUID {
+		action = ActionReservationCreateOwn
+	}
+	if err := DefaultAuthorizer.Authorize(actor, action, UUID, db); err != nil {
+		return err
+	}
+	return SubmitChoices(roundID, UUID, groupIDs, withAudit(db, actor, action))
+}
+
+// AllocateRoundAs allocates a selection round if actor is allowed to do so
+func AllocateRoundAs(actor User, roundID string, seed int64, db *gorm.DB) (AllocationResult, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionEnrollmentManage, roundID, db); err != nil {
+		return AllocationResult{}, err
+	}
+	return AllocateRound(roundID, seed, withAudit(db, actor, ActionEnrollmentManage))
+}
@@ -7,6 +7,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.8 // indirect
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/text v0.3.3
 	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.12
 )
@@ -5,6 +5,7 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Group struct {
@@ -14,6 +15,8 @@ type Group struct {
 	TeacherID string
 	StartDate int64
 	EndDate   int64
+	PeriodID  string `gorm:"index"` // Empty if the group doesn't belong to a period, see SetGroupPeriod
+	Capacity  int    // Maximum number of reservations, 0 means unlimited. See JoinWaitlist.
 }
 
 type GroupReservation struct {
@@ -30,33 +33,104 @@ type GroupTime struct {
 	DayOfTheWeek int64
 }
 
+// CreateReservation adds a user to a group. Students must meet the prerequisites of the course, otherwise a *PrerequisitesError is returned.
+// If the group is full ErrGroupFull is returned and the user can join the waitlist instead.
+// If the lessons of the group overlap the lessons of the user's other groups a *ScheduleConflictError is returned.
 func CreateReservation(UUID string, GroupID string, db *gorm.DB) (GroupReservation, error) {
+	err := checkReservation(UUID, GroupID, db)
+	if err != nil {
+		return GroupReservation{}, err
+	}
+	return saveReservation(UUID, GroupID, db)
+}
+
+// checkUserActive returns ErrUserInactive if the user exists but isn't active
+func checkUserActive(UUID string, db *gorm.DB) error {
+	user, err := GetUser(UUID, db)
+	if err != nil && err != ErrUserNotFound {
+		return err
+	}
+	if err == nil && !user.IsActive() {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// checkReservation runs the checks a user must pass before they are added to a group. The capacity is checked by saveReservation.
+func checkReservation(UUID string, GroupID string, db *gorm.DB) error {
+	err := checkUserActive(UUID, db)
+	if err != nil {
+		return err
+	}
+	err = checkEnrollmentOpen(UUID, GroupID, db)
+	if err != nil {
+		return err
+	}
+	err = checkReservationPrerequisites(UUID, GroupID, db)
+	if err != nil {
+		return err
+	}
+	return checkScheduleConflicts(UUID, GroupID, db)
+}
+
+// reservationRefused reports whether err from checkReservation means the user can't join the group, as opposed to a database error
+func reservationRefused(err error) bool {
+	return err == ErrUserInactive || err == ErrEnrollmentClosed ||
+		errors.Is(err, ErrPrerequisitesNotMet) || errors.Is(err, ErrScheduleConflict)
+}
+
+// saveReservation adds the user to the group if they aren't in it already and the group has room.
+// The checks and the insert run in one transaction with the group row locked, so two users can't both get the last place.
+func saveReservation(UUID string, GroupID string, db *gorm.DB) (GroupReservation, error) {
 	reservation := GroupReservation{
 		GroupID:      GroupID,
 		ReserverUUID: UUID,
 	}
-
-	tx := db.Begin()
-	tx.Create(&reservation)
-	err := tx.Commit().Error
-
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// SELECT ... FOR UPDATE makes concurrent reservations wait for each other, SQLite doesn't need it as it runs one write transaction at a time
+		group, err := getGroupInfo(GroupID, tx.Clauses(clause.Locking{Strength: "UPDATE"}))
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&GroupReservation{}).Where("group_id = ? AND reserver_uuid = ?", GroupID, UUID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 0 {
+			return ErrAlreadyInGroup
+		}
+		free, err := freePlaces(group, tx)
+		if err != nil {
+			return err
+		}
+		if free == 0 {
+			return ErrGroupFull
+		}
+		return tx.Create(&reservation).Error
+	})
 	if err != nil {
 		return GroupReservation{}, err
 	}
 	return reservation, nil
 }
 
+// CancelReservation removes a user from a group and gives the free place to the first user on the waitlist
 func CancelReservation(UUID string, GroupID string, db *gorm.DB) error {
 	tx := db.Begin()
 	tx.Where("reserver_uuid = ? AND group_id = ?", UUID, GroupID).Delete(&GroupReservation{})
 	err := tx.Commit().Error
-	return err
+	if err != nil {
+		return err
+	}
+	return promoteFromWaitlist(GroupID, db)
 }
 
 func DeleteGroup(groupID string, db *gorm.DB) error {
 	tx := db.Begin()
 	tx.Where("group_id = ?", groupID).Delete(&GroupReservation{})
 	tx.Where("group_id = ?", groupID).Delete(&GroupTime{})
+	tx.Where("group_id = ?", groupID).Delete(&WaitlistEntry{})
+	tx.Where("group_id = ?", groupID).Delete(&EnrollmentWindow{})
 	tx.Where("group_id = ?", groupID).Delete(&Group{})
 
 	err := tx.Commit().Error
@@ -77,6 +151,7 @@ func GetGroupTimes(groupID string, db *gorm.DB) ([]GroupTimeData, error) {
 	return data, nil
 }
 
+// UpdateGroupTimes replaces the times of a group. Returns a *ScheduleConflictError if the new times overlap the schedule of a member or the teacher.
 func UpdateGroupTimes(groupID string, newTD []GroupTimeData, db *gorm.DB) error {
 	var groupTimes []GroupTime
 	for _, gt := range newTD {
@@ -88,11 +163,28 @@ func UpdateGroupTimes(groupID string, newTD []GroupTimeData, db *gorm.DB) error
 		}
 		groupTimes = append(groupTimes, time)
 	}
-	tx := db.Begin()
-	tx.Where("group_id = ?", groupID).Delete(&GroupTime{})
-	tx.Create(&groupTimes)
-	err := tx.Commit().Error
-	return err
+	group, err := getGroupInfo(groupID, db)
+	if err != nil && err != ErrGroupNotFound {
+		return err
+	}
+	if err == nil {
+		conflicts, err := FindGroupConflicts(group, groupTimes, db)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) != 0 {
+			return &ScheduleConflictError{Conflicts: conflicts}
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", groupID).Delete(&GroupTime{}).Error; err != nil {
+			return err
+		}
+		if len(groupTimes) == 0 {
+			return nil
+		}
+		return tx.Create(&groupTimes).Error
+	})
 }
 
 func GetGroupReservations(groupID string, db *gorm.DB) ([]GroupReservation, error) {
@@ -134,17 +226,29 @@ func NewGroup(name string, CourseID string, startDate int64, endDate int64, time
 		EndDate:   endDate,
 	}
 
-	tx := db.Begin()
-	tx.Create(&group)
-	tx.Create(&groupTimes)
-	err := tx.Commit().Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		if len(groupTimes) == 0 {
+			return nil
+		}
+		return tx.Create(&groupTimes).Error
+	})
 	if err != nil {
 		return Group{}, err
 	}
 	return group, nil
 }
 
+// AssingTeacher makes teacherID the teacher of the group. If the lessons of the group overlap the other lessons of the teacher a *ScheduleConflictError is returned.
 func (g *Group) AssingTeacher(teacherID string, db *gorm.DB) error {
+	if teacherID != "" {
+		err := checkScheduleConflicts(teacherID, g.GroupID, db)
+		if err != nil {
+			return err
+		}
+	}
 	prev := g.TeacherID
 	g.TeacherID = teacherID
 	tx := db.Begin()
@@ -248,13 +352,7 @@ func GetGroup(groupID string, db *gorm.DB) (GroupData, error) {
 }
 
 func ChangeGroupName(new string, groupID string, db *gorm.DB) error {
-	tx := db.Begin()
-	tx.Model(Group{}).Where("group_id = ?", groupID).Update("group_name", new)
-	err := tx.Commit().Error
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.Model(Group{}).Where("group_id = ?", groupID).Update("name", new).Error
 }
 
 func (g *Group) GetUsers(db *gorm.DB) ([]User, error) {
@@ -263,3 +361,67 @@ func (g *Group) GetUsers(db *gorm.DB) ([]User, error) {
 func (g *Group) Delete(db *gorm.DB) error {
 	return DeleteGroup(g.GroupID, db)
 }
+
+// NewGroupAs creates a group if actor is allowed to do so
+func NewGroupAs(actor User, name string, CourseID string, startDate int64, endDate int64, times []GroupTimeData, db *gorm.DB) (Group, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupCreate, "", db); err != nil {
+		return Group{}, err
+	}
+	return NewGroup(name, CourseID, startDate, endDate, times, withAudit(db, actor, ActionGroupCreate))
+}
+
+// DeleteGroupAs deletes a group if actor is allowed to do so
+func DeleteGroupAs(actor User, groupID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupDelete, groupID, db); err != nil {
+		return err
+	}
+	return DeleteGroup(groupID, withAudit(db, actor, ActionGroupDelete))
+}
+
+// UpdateGroupTimesAs replaces the times of a group if actor is allowed to do so
+func UpdateGroupTimesAs(actor User, groupID string, newTD []GroupTimeData, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupEdit, groupID, db); err != nil {
+		return err
+	}
+	return UpdateGroupTimes(groupID, newTD, withAudit(db, actor, ActionGroupEdit))
+}
+
+// ChangeGroupNameAs renames a group if actor is allowed to do so
+func ChangeGroupNameAs(actor User, new string, groupID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupEdit, groupID, db); err != nil {
+		return err
+	}
+	return ChangeGroupName(new, groupID, withAudit(db, actor, ActionGroupEdit))
+}
+
+// AssingTeacherAs assigns a teacher to the group if actor is allowed to do so
+func (g *Group) AssingTeacherAs(actor User, teacherID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupAssignTeacher, g.GroupID, db); err != nil {
+		return err
+	}
+	return g.AssingTeacher(teacherID, withAudit(db, actor, ActionGroupAssignTeacher))
+}
+
+// CreateReservationAs adds user UUID to the group if actor is allowed to do so
+func CreateReservationAs(actor User, UUID string, GroupID string, db *gorm.DB) (GroupReservation, error) {
+	action := ActionReservationCreate
+	if actor.UUID == UUID {
+		action = ActionReservationCreateOwn
+	}
+	if err := DefaultAuthorizer.Authorize(actor, action, GroupID, db); err != nil {
+		return GroupReservation{}, err
+	}
+	return CreateReservation(UUID, GroupID, withAudit(db, actor, action))
+}
+
+// CancelReservationAs removes user UUID from the group if actor is allowed to do so
+func CancelReservationAs(actor User, UUID string, GroupID string, db *gorm.DB) error {
+	action := ActionReservationCancel
+	if actor.UUID == UUID {
+		action = ActionReservationCancelOwn
+	}
+	if err := DefaultAuthorizer.Authorize(actor, action, GroupID, db); err != nil {
+		return err
+	}
+	return CancelReservation(UUID, GroupID, withAudit(db, actor, action))
+}
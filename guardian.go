@@ -0,0 +1,227 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrNotAGuardian = errors.New("user is not a guardian")
+var ErrNotAStudent = errors.New("user is not a student")
+var ErrGuardianAlreadyLinked = errors.New("guardian is already linked to student")
+
+// LinkGuardian makes guardianID a guardian of studentID. The guardian must have the Guardian role and the student the Student role.
+func LinkGuardian(guardianID string, studentID string, db *gorm.DB) (GuardianData, error) {
+	guardian, err := GetUser(guardianID, db)
+	if err != nil {
+		return GuardianData{}, err
+	}
+	if guardian.Role != Guardian {
+		return GuardianData{}, ErrNotAGuardian
+	}
+	student, err := GetUser(studentID, db)
+	if err != nil {
+		return GuardianData{}, err
+	}
+	if student.Role != Student {
+		return GuardianData{}, ErrNotAStudent
+	}
+	linked, err := IsGuardianOf(guardianID, studentID, db)
+	if err != nil {
+		return GuardianData{}, err
+	}
+	if linked {
+		return GuardianData{}, ErrGuardianAlreadyLinked
+	}
+
+	gd := GuardianData{
+		UUID:       guardianID,
+		GuardianOf: studentID,
+	}
+	tx := db.Begin()
+	tx.Create(&gd)
+	err = tx.Commit().Error
+	if err != nil {
+		return GuardianData{}, err
+	}
+	return gd, nil
+}
+
+var ErrNotGuardianOf = errors.New("user is not a guardian of that student")
+
+func UnlinkGuardian(guardianID string, studentID string, db *gorm.DB) error {
+	tx := db.Begin()
+	res := tx.Where("uuid = ? AND guardian_of = ?", guardianID, studentID).Delete(&GuardianData{})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotGuardianOf
+	}
+	return nil
+}
+
+func IsGuardianOf(guardianID string, studentID string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&GuardianData{}).Where("uuid = ? AND guardian_of = ?", guardianID, studentID).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+var ErrNoGuardiansFound = errors.New("student has no guardians")
+
+func GetGuardians(studentID string, db *gorm.DB) ([]User, error) {
+	var data []User
+	tx := db.Model(&GuardianData{}).
+		Where("guardian_data.guardian_of = ? AND guardian_data.deleted_at IS NULL", studentID).Select("users.*").
+		Joins("JOIN users ON users.uuid = guardian_data.uuid").
+		Scan(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, ErrNoGuardiansFound
+	}
+	return data, nil
+}
+
+var ErrNoWardsFound = errors.New("guardian has no wards")
+
+// GetWards returns the students guardianID is a guardian of
+func GetWards(guardianID string, db *gorm.DB) ([]User, error) {
+	var data []User
+	tx := db.Model(&GuardianData{}).
+		Where("guardian_data.uuid = ? AND guardian_data.deleted_at IS NULL", guardianID).Select("users.*").
+		Joins("JOIN users ON users.uuid = guardian_data.guardian_of").
+		Scan(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, ErrNoWardsFound
+	}
+	return data, nil
+}
+
+func checkGuardian(guardianID string, studentID string, db *gorm.DB) error {
+	linked, err := IsGuardianOf(guardianID, studentID, db)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		return ErrNotGuardianOf
+	}
+	return nil
+}
+
+// GetWardGroups returns the groups of a student, if guardianID is their guardian
+func GetWardGroups(guardianID string, studentID string, db *gorm.DB) ([]Group, error) {
+	if err := checkGuardian(guardianID, studentID, db); err != nil {
+		return nil, err
+	}
+	return GetUserGroups(studentID, db)
+}
+
+// GetWardSchedule returns the groups of a student together with their times, if guardianID is their guardian
+func GetWardSchedule(guardianID string, studentID string, db *gorm.DB) ([]GroupData, error) {
+	groups, err := GetWardGroups(guardianID, studentID, db)
+	if err != nil {
+		return nil, err
+	}
+	return groupArrToGroupDArr(groups, db)
+}
+
+// GetWardMessages returns the messages a student has received, if guardianID is their guardian
+func GetWardMessages(guardianID string, studentID string, db *gorm.DB) ([]Message, error) {
+	if err := checkGuardian(guardianID, studentID, db); err != nil {
+		return nil, err
+	}
+	return GetMessagesForId(studentID, db)
+}
+
+// isMinor reports whether the guardians of a student should be kept informed.
+// Students under 18 are minors, and if the date of birth is not known every student with a linked guardian is treated as one.
+func isMinor(u User, db *gorm.DB) (bool, error) {
+	if u.Role != Student {
+		return false, nil
+	}
+	p, err := getUserProfile(u.UUID, db)
+	if err != nil {
+		return false, err
+	}
+	if p.DateOfBirth != 0 {
+		adult := time.Unix(p.DateOfBirth, 0).AddDate(18, 0, 0)
+		return time.Now().Before(adult), nil
+	}
+	var count int64
+	tx := db.Model(&GuardianData{}).Where("guardian_of = ?", u.UUID).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// addGuardianRecipients adds the guardians of minor students to the reciever list when the message is sent by a teacher
+func addGuardianRecipients(from string, to []string, db *gorm.DB) ([]string, error) {
+	sender, err := GetUser(from, db)
+	if err == ErrUserNotFound {
+		return to, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sender.Role != Teacher {
+		return to, nil
+	}
+
+	var recievers []User
+	tx := db.Where("uuid IN ?", to).Find(&recievers)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, r := range recievers {
+		minor, err := isMinor(r, db)
+		if err != nil {
+			return nil, err
+		}
+		if !minor {
+			continue
+		}
+		guardians, err := GetGuardians(r.UUID, db)
+		if err != nil && err != ErrNoGuardiansFound {
+			return nil, err
+		}
+		for _, g := range guardians {
+			to = append(to, g.UUID)
+		}
+	}
+	return to, nil
+}
+
+func (u *User) GetWards(db *gorm.DB) ([]User, error) {
+	return GetWards(u.UUID, db)
+}
+
+func (u *User) GetGuardians(db *gorm.DB) ([]User, error) {
+	return GetGuardians(u.UUID, db)
+}
+
+// LinkGuardianAs links a guardian to a student if actor is allowed to do so
+func LinkGuardianAs(actor User, guardianID string, studentID string, db *gorm.DB) (GuardianData, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGuardianLink, studentID, db); err != nil {
+		return GuardianData{}, err
+	}
+	return LinkGuardian(guardianID, studentID, withAudit(db, actor, ActionGuardianLink))
+}
+
+// UnlinkGuardianAs unlinks a guardian from a student if actor is allowed to do so
+func UnlinkGuardianAs(actor User, guardianID string, studentID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGuardianLink, studentID, db); err != nil {
+		return err
+	}
+	return UnlinkGuardian(guardianID, studentID, withAudit(db, actor, ActionGuardianLink))
+}
@@ -0,0 +1,87 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Holiday is a break when groups have no lessons, e.g. the autumn break. StartDate and EndDate are the first and the last day of the holiday.
+type Holiday struct {
+	HolidayID string `gorm:"primaryKey"`
+	Name      string
+	StartDate int64
+	EndDate   int64
+}
+
+func NewHoliday(name string, startDate int64, endDate int64, db *gorm.DB) (Holiday, error) {
+	if endDate < startDate {
+		return Holiday{}, ErrInvalidDateRange
+	}
+	holiday := Holiday{
+		HolidayID: uuid.New().String(),
+		Name:      name,
+		StartDate: startDate,
+		EndDate:   endDate,
+	}
+	tx := db.Begin()
+	tx.Create(&holiday)
+	err := tx.Commit().Error
+	if err != nil {
+		return Holiday{}, err
+	}
+	return holiday, nil
+}
+
+var ErrHolidayNotFound = errors.New("holiday not found")
+
+func DeleteHoliday(holidayID string, db *gorm.DB) error {
+	tx := db.Begin()
+	res := tx.Where("holiday_id = ?", holidayID).Delete(&Holiday{})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrHolidayNotFound
+	}
+	return nil
+}
+
+// GetHolidays returns the holidays that are at least partly between from and to, earliest first
+func GetHolidays(from int64, to int64, db *gorm.DB) ([]Holiday, error) {
+	holidays := []Holiday{}
+	tx := db.Where("start_date <= ? AND end_date >= ?", to, startOfDay(time.Unix(from, 0)).Unix()).Order("start_date").Find(&holidays)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return holidays, nil
+}
+
+// isHoliday reports whether the day is one of the days of the holidays
+func isHoliday(day time.Time, holidays []Holiday) bool {
+	for _, h := range holidays {
+		if !day.Before(startOfDay(time.Unix(h.StartDate, 0))) && !day.After(startOfDay(time.Unix(h.EndDate, 0))) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHolidayAs creates a holiday if actor is allowed to do so
+func NewHolidayAs(actor User, name string, startDate int64, endDate int64, db *gorm.DB) (Holiday, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionPeriodManage, "", db); err != nil {
+		return Holiday{}, err
+	}
+	return NewHoliday(name, startDate, endDate, withAudit(db, actor, ActionPeriodManage))
+}
+
+// DeleteHolidayAs deletes a holiday if actor is allowed to do so
+func DeleteHolidayAs(actor User, holidayID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionPeriodManage, holidayID, db); err != nil {
+		return err
+	}
+	return DeleteHoliday(holidayID, withAudit(db, actor, ActionPeriodManage))
+}
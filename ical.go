@@ -0,0 +1,302 @@
+package wilhelmiina
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// ICAL_PRODID identifies wilhelmiina as the program that made a calendar
+const ICAL_PRODID = "-//wilhelmiina//student manager//EN"
+
+// ICAL_UID_DOMAIN is added to the UIDs of events so they are globally unique
+const ICAL_UID_DOMAIN = "wilhelmiina"
+
+// Lines of an iCalendar file can be at most 75 octets long, longer ones are folded
+const ICAL_LINE_LENGTH = 75
+
+var icalWeekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// icalWriter builds an iCalendar (RFC 5545) file
+type icalWriter struct {
+	b strings.Builder
+}
+
+// line writes a content line, folding it if it is too long. Folding never splits a UTF-8 character.
+func (w *icalWriter) line(name string, value string) {
+	l := name + ":" + value
+	limit := ICAL_LINE_LENGTH
+	for len(l) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(l[cut]) {
+			cut--
+		}
+		w.b.WriteString(l[:cut] + "\r\n ")
+		l = l[cut:]
+		// The space in the beginning of the next line counts too
+		limit = ICAL_LINE_LENGTH - 1
+	}
+	w.b.WriteString(l + "\r\n")
+}
+
+func (w *icalWriter) String() string {
+	return w.b.String()
+}
+
+// escapeICalText escapes a TEXT value
+func escapeICalText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// icalTime formats a time as an iCalendar DATE-TIME in ScheduleLocation and returns the TZID parameter for it.
+// UTC times end with Z and times in the local time zone of the server are floating. Other zones are described by the VTIMEZONE writeTimezone writes.
+func icalTime(t time.Time) (string, string) {
+	switch ScheduleLocation {
+	case time.UTC:
+		return "", t.UTC().Format("20060102T150405Z")
+	case time.Local:
+		return "", t.In(time.Local).Format("20060102T150405")
+	}
+	return ";TZID=" + ScheduleLocation.String(), t.In(ScheduleLocation).Format("20060102T150405")
+}
+
+// icalUntil formats the end of a recurrence, it must be in UTC unless the start is floating
+func icalUntil(t time.Time) string {
+	if ScheduleLocation == time.Local {
+		return t.In(time.Local).Format("20060102T150405")
+	}
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icalOffset formats a UTC offset in seconds as a UTC-OFFSET value, e.g. +0300
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	value := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		value += fmt.Sprintf("%02d", offset%60)
+	}
+	return value
+}
+
+// isDaylightTime reports whether t is in daylight saving time, meaning its offset is bigger than the smaller of the offsets in january and july
+func isDaylightTime(t time.Time) bool {
+	_, offset := t.Zone()
+	_, jan := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()).Zone()
+	_, jul := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, t.Location()).Zone()
+	standard := jan
+	if jul < standard {
+		standard = jul
+	}
+	return offset > standard
+}
+
+// writeObservance writes a STANDARD or DAYLIGHT component for an offset starting at t. The start is given in the local time before the change.
+func writeObservance(w *icalWriter, t time.Time, offsetFrom int) {
+	kind := "STANDARD"
+	if isDaylightTime(t) {
+		kind = "DAYLIGHT"
+	}
+	name, offset := t.Zone()
+	w.line("BEGIN", kind)
+	w.line("DTSTART", t.In(time.FixedZone("", offsetFrom)).Format("20060102T150405"))
+	w.line("TZOFFSETFROM", icalOffset(offsetFrom))
+	w.line("TZOFFSETTO", icalOffset(offset))
+	w.line("TZNAME", name)
+	w.line("END", kind)
+}
+
+// writeTimezone writes a VTIMEZONE describing ScheduleLocation between from and to, RFC 5545 requires one for every TZID used.
+// Every change of the UTC offset in the range gets its own observance.
+func writeTimezone(w *icalWriter, from time.Time, to time.Time) {
+	if ScheduleLocation == time.UTC || ScheduleLocation == time.Local {
+		return
+	}
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", ScheduleLocation.String())
+	t := from.In(ScheduleLocation)
+	_, offset := t.Zone()
+	writeObservance(w, t, offset)
+	for day := t; day.Before(to); {
+		next := day.AddDate(0, 0, 1)
+		_, nextOffset := next.Zone()
+		if nextOffset != offset {
+			// Find the second the offset changes
+			lo, hi := day.Unix(), next.Unix()
+			for hi-lo > 1 {
+				mid := lo + (hi-lo)/2
+				if _, o := time.Unix(mid, 0).In(ScheduleLocation).Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			writeObservance(w, time.Unix(hi, 0).In(ScheduleLocation), offset)
+			offset = nextOffset
+		}
+		day = next
+	}
+	w.line("END", "VTIMEZONE")
+}
+
+// groupSummary returns the title of the events of a group: course, group and teacher, e.g. "MAA2 Paraabelit (MAA2.1), Maija Meikäläinen"
+func groupSummary(group Group, db *gorm.DB) (string, error) {
+	summary := group.Name
+	course, err := GetCourse(group.CourseID, db)
+	if err != nil && err != ErrCourseNotFound {
+		return "", err
+	}
+	if err == nil {
+		summary = strings.TrimSpace(course.CourseNameShort+" "+course.CourseName) + " (" + group.Name + ")"
+	}
+	if group.TeacherID != "" {
+		teacher, err := GetUser(group.TeacherID, db)
+		if err != nil && err != ErrUserNotFound {
+			return "", err
+		}
+		if err == nil {
+			summary += ", " + teacher.Firstname + " " + teacher.Surname
+		}
+	}
+	return summary, nil
+}
+
+// writeGroupEvents writes a weekly recurring event for every time of a group. Lessons during holidays are left out with EXDATEs.
+// The UID of an event only depends on the group, the weekday and the start time, so it stays the same when the calendar is generated again.
+func writeGroupEvents(w *icalWriter, group Group, times []GroupTime, stamp string, db *gorm.DB) error {
+	if len(times) == 0 {
+		return nil
+	}
+	summary, err := groupSummary(group, db)
+	if err != nil {
+		return err
+	}
+	holidays, err := GetHolidays(group.StartDate, group.EndDate, db)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range times {
+		if t.DayOfTheWeek < 0 || int(t.DayOfTheWeek) >= len(icalWeekdays) {
+			continue
+		}
+		first := startOfDay(time.Unix(group.StartDate, 0))
+		for dayOfTheWeek(first) != t.DayOfTheWeek {
+			first = first.AddDate(0, 0, 1)
+		}
+		last := startOfDay(time.Unix(group.EndDate, 0))
+		for dayOfTheWeek(last) != t.DayOfTheWeek {
+			last = last.AddDate(0, 0, -1)
+		}
+		if last.Before(first) {
+			continue
+		}
+		var exdates []string
+		tzid := ""
+		for day := first; !day.After(last); day = day.AddDate(0, 0, 7) {
+			if isHoliday(day, holidays) {
+				var value string
+				tzid, value = icalTime(atTimeOfDay(day, t.StartTime))
+				exdates = append(exdates, value)
+			}
+		}
+
+		w.line("BEGIN", "VEVENT")
+		w.line("UID", fmt.Sprintf("%s-%s-%s@%s", group.GroupID, icalWeekdays[t.DayOfTheWeek], strings.Replace(formatTimeOfDay(t.StartTime), ":", "", 1), ICAL_UID_DOMAIN))
+		w.line("DTSTAMP", stamp)
+		param, value := icalTime(atTimeOfDay(first, t.StartTime))
+		w.line("DTSTART"+param, value)
+		param, value = icalTime(atTimeOfDay(first, t.EndTime))
+		w.line("DTEND"+param, value)
+		w.line("RRULE", fmt.Sprintf("FREQ=WEEKLY;BYDAY=%s;UNTIL=%s", icalWeekdays[t.DayOfTheWeek], icalUntil(atTimeOfDay(last, t.StartTime))))
+		if len(exdates) != 0 {
+			w.line("EXDATE"+tzid, strings.Join(exdates, ","))
+		}
+		w.line("SUMMARY", escapeICalText(summary))
+		w.line("END", "VEVENT")
+	}
+	return nil
+}
+
+// writeCalendar writes a calendar containing the lessons of the groups
+func writeCalendar(name string, groups []Group, db *gorm.DB) (string, error) {
+	times, err := getTimesOfGroups(groups, db)
+	if err != nil {
+		return "", err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	w := &icalWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", ICAL_PRODID)
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("X-WR-CALNAME", escapeICalText(name))
+	var from, to time.Time
+	for _, g := range groups {
+		if len(times[g.GroupID]) == 0 {
+			continue
+		}
+		start, end := startOfDay(time.Unix(g.StartDate, 0)), startOfDay(time.Unix(g.EndDate, 0)).AddDate(0, 0, 1)
+		if from.IsZero() || start.Before(from) {
+			from = start
+		}
+		if end.After(to) {
+			to = end
+		}
+	}
+	if !from.IsZero() {
+		writeTimezone(w, from, to)
+	}
+	for _, g := range groups {
+		err := writeGroupEvents(w, g, times[g.GroupID], stamp, db)
+		if err != nil {
+			return "", err
+		}
+	}
+	w.line("END", "VCALENDAR")
+	return w.String(), nil
+}
+
+// GroupCalendar returns the lessons of a group as an iCalendar file
+func GroupCalendar(groupID string, db *gorm.DB) (string, error) {
+	group, err := getGroupInfo(groupID, db)
+	if err != nil {
+		return "", err
+	}
+	return writeCalendar(group.Name, []Group{group}, db)
+}
+
+// UserCalendar returns the schedule of a user as an iCalendar file, see GetSchedule for whose lessons are included
+func UserCalendar(userID string, db *gorm.DB) (string, error) {
+	user, err := GetUser(userID, db)
+	if err != nil {
+		return "", err
+	}
+	ids, err := scheduleUserIDs(user, db)
+	if err != nil {
+		return "", err
+	}
+	var groups []Group
+	seen := map[string]bool{}
+	for _, id := range ids {
+		g, err := getScheduledGroups(id, db)
+		if err != nil {
+			return "", err
+		}
+		for _, group := range g {
+			if !seen[group.GroupID] {
+				seen[group.GroupID] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+	return writeCalendar(user.Firstname+" "+user.Surname, groups, db)
+}
@@ -0,0 +1,615 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// icalProperty is a content line of an iCalendar file, e.g. DTSTART;TZID=Europe/Helsinki:20210901T080000
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+var ErrInvalidCalendar = errors.New("invalid iCalendar file")
+
+// unfoldICal joins folded lines and returns the content lines
+func unfoldICal(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	var lines []string
+	for _, l := range strings.Split(data, "\n") {
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) != 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// parseICalLine splits a content line to its name, parameters and value. Parameter values can be quoted.
+func parseICalLine(l string) (icalProperty, error) {
+	quoted := false
+	colon := -1
+	for i, c := range l {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 1 {
+		return icalProperty{}, ErrInvalidCalendar
+	}
+	p := icalProperty{Params: map[string]string{}, Value: l[colon+1:]}
+	parts := strings.Split(l[:colon], ";")
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return icalProperty{}, ErrInvalidCalendar
+		}
+		p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return p, nil
+}
+
+func unescapeICalText(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	return r.Replace(s)
+}
+
+// parseICalEvents returns the properties of every VEVENT of a calendar. Other components, like VTIMEZONE, are skipped.
+func parseICalEvents(data string) ([]map[string]icalProperty, error) {
+	events := []map[string]icalProperty{}
+	var event map[string]icalProperty
+	var stack []string
+	calendar := false
+	for _, l := range unfoldICal(data) {
+		p, err := parseICalLine(l)
+		if err != nil {
+			return nil, err
+		}
+		switch p.Name {
+		case "BEGIN":
+			stack = append(stack, strings.ToUpper(p.Value))
+			if len(stack) == 1 {
+				if stack[0] != "VCALENDAR" {
+					return nil, ErrInvalidCalendar
+				}
+				calendar = true
+			}
+			if len(stack) == 2 && stack[1] == "VEVENT" {
+				event = map[string]icalProperty{}
+			}
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != strings.ToUpper(p.Value) {
+				return nil, ErrInvalidCalendar
+			}
+			if len(stack) == 2 && stack[1] == "VEVENT" {
+				events = append(events, event)
+				event = nil
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, ErrInvalidCalendar
+			}
+			if len(stack) == 2 && event != nil {
+				if _, ok := event[p.Name]; !ok {
+					event[p.Name] = p
+				}
+			}
+		}
+	}
+	if !calendar || len(stack) != 0 {
+		return nil, ErrInvalidCalendar
+	}
+	return events, nil
+}
+
+// parseICalTime parses a DATE-TIME. Times ending with Z are in UTC, times with a TZID in that time zone and floating times in ScheduleLocation.
+func parseICalTime(p icalProperty) (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		return time.Time{}, fmt.Errorf("%s is a date without a time", p.Name)
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		return time.Parse("20060102T150405Z", p.Value)
+	}
+	loc := ScheduleLocation
+	if tzid, ok := p.Params["TZID"]; ok {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %s", tzid)
+		}
+		loc = l
+	}
+	return time.ParseInLocation("20060102T150405", p.Value, loc)
+}
+
+// Most lessons an event with a COUNT can have, a school year has a few hundred days
+const MAX_ICAL_COUNT = 1000
+
+// importedGroup is a group as described by the events of a calendar
+type importedGroup struct {
+	GroupID    string // Set if the UID of an event is one made by wilhelmiina
+	Name       string
+	Categories []string
+	Times      []GroupTimeData
+	First      time.Time
+	Last       time.Time
+}
+
+// parseICalEvent reads the weekly times and the first and the last lesson of an event
+func parseICalEvent(e map[string]icalProperty) (importedGroup, error) {
+	summary := unescapeICalText(e["SUMMARY"].Value)
+	if summary == "" {
+		return importedGroup{}, errors.New("event has no summary")
+	}
+	start, err := parseICalTime(e["DTSTART"])
+	if err != nil {
+		return importedGroup{}, err
+	}
+	end, err := parseICalTime(e["DTEND"])
+	if err != nil {
+		return importedGroup{}, err
+	}
+	start = start.In(ScheduleLocation)
+	end = end.In(ScheduleLocation)
+	if !end.After(start) || startOfDay(end) != startOfDay(start) {
+		return importedGroup{}, fmt.Errorf("%s: lessons must end on the day they start", summary)
+	}
+	rrule, ok := e["RRULE"]
+	if !ok {
+		return importedGroup{}, fmt.Errorf("%s: event doesn't repeat weekly", summary)
+	}
+
+	rule := map[string]string{}
+	for _, part := range strings.Split(rrule.Value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			rule[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+	if rule["FREQ"] != "WEEKLY" || (rule["INTERVAL"] != "" && rule["INTERVAL"] != "1") {
+		return importedGroup{}, fmt.Errorf("%s: event doesn't repeat weekly", summary)
+	}
+	days := []int64{dayOfTheWeek(start)}
+	if byday, ok := rule["BYDAY"]; ok {
+		days = nil
+		for _, d := range strings.Split(byday, ",") {
+			found := false
+			for i, name := range icalWeekdays {
+				if d == name {
+					days = append(days, int64(i))
+					found = true
+				}
+			}
+			if !found {
+				return importedGroup{}, fmt.Errorf("%s: invalid weekday %s", summary, d)
+			}
+		}
+	}
+
+	day := startOfDay(start)
+	g := importedGroup{Name: summary, First: day, Last: day}
+	startTime := int64(start.Sub(day))
+	endTime := int64(end.Sub(day))
+	for _, d := range days {
+		g.Times = append(g.Times, GroupTimeData{StartTime: startTime, EndTime: endTime, DayOfTheWeek: d})
+	}
+	if until, ok := rule["UNTIL"]; ok {
+		var t time.Time
+		if len(until) == 8 {
+			t, err = time.ParseInLocation("20060102", until, ScheduleLocation)
+		} else {
+			t, err = parseICalTime(icalProperty{Name: "UNTIL", Params: e["DTSTART"].Params, Value: until})
+		}
+		if err != nil {
+			return importedGroup{}, err
+		}
+		g.Last = startOfDay(t)
+	} else if count, ok := rule["COUNT"]; ok {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > MAX_ICAL_COUNT {
+			return importedGroup{}, fmt.Errorf("%s: invalid count %s", summary, count)
+		}
+		// The first lesson counts even if it isn't on one of the days of BYDAY
+		for d := day; n > 0; d = d.AddDate(0, 0, 1) {
+			for _, weekday := range days {
+				if d == day || weekday == dayOfTheWeek(d) {
+					g.Last = d
+					n--
+					break
+				}
+			}
+		}
+	} else {
+		return importedGroup{}, fmt.Errorf("%s: event repeats forever", summary)
+	}
+	if g.Last.Before(g.First) {
+		return importedGroup{}, fmt.Errorf("%s: event ends before it starts", summary)
+	}
+
+	if uid := e["UID"].Value; strings.HasSuffix(uid, "@"+ICAL_UID_DOMAIN) {
+		parts := strings.Split(strings.TrimSuffix(uid, "@"+ICAL_UID_DOMAIN), "-")
+		if len(parts) > 2 {
+			g.GroupID = strings.Join(parts[:len(parts)-2], "-")
+		}
+	}
+	if c, ok := e["CATEGORIES"]; ok {
+		for _, cat := range strings.Split(c.Value, ",") {
+			g.Categories = append(g.Categories, unescapeICalText(cat))
+		}
+	}
+	return g, nil
+}
+
+type ImportAction int
+
+const ImportCreate ImportAction = 0
+const ImportUpdate ImportAction = 1
+const ImportUnchanged ImportAction = 2
+
+// GroupChange is what an import does to a group. GroupID is empty for groups a dry run would create.
+type GroupChange struct {
+	Action    ImportAction
+	GroupID   string
+	Name      string
+	CourseID  string
+	StartDate int64
+	EndDate   int64
+	// Dates of the group before the import, only set for updates
+	OldStartDate int64
+	OldEndDate   int64
+	Added        []GroupTimeData
+	Removed      []GroupTimeData
+}
+
+func formatGroupTime(t GroupTimeData) string {
+	return fmt.Sprintf("%s %s-%s", weekdayName(t.DayOfTheWeek), formatTimeOfDay(t.StartTime), formatTimeOfDay(t.EndTime))
+}
+
+func formatDate(d int64) string {
+	return time.Unix(d, 0).In(ScheduleLocation).Format("2006-01-02")
+}
+
+// String describes the change as a diff, e.g. "update MAA2.1\n  + Monday 08:00-09:15\n  - Tuesday 10:00-11:15"
+func (c GroupChange) String() string {
+	var b strings.Builder
+	switch c.Action {
+	case ImportCreate:
+		fmt.Fprintf(&b, "create %s (%s - %s)\n", c.Name, formatDate(c.StartDate), formatDate(c.EndDate))
+	case ImportUpdate:
+		fmt.Fprintf(&b, "update %s\n", c.Name)
+		if c.StartDate != c.OldStartDate || c.EndDate != c.OldEndDate {
+			fmt.Fprintf(&b, "  ~ %s - %s -> %s - %s\n", formatDate(c.OldStartDate), formatDate(c.OldEndDate), formatDate(c.StartDate), formatDate(c.EndDate))
+		}
+	default:
+		fmt.Fprintf(&b, "unchanged %s\n", c.Name)
+	}
+	for _, t := range c.Added {
+		fmt.Fprintf(&b, "  + %s\n", formatGroupTime(t))
+	}
+	for _, t := range c.Removed {
+		fmt.Fprintf(&b, "  - %s\n", formatGroupTime(t))
+	}
+	return b.String()
+}
+
+// CalendarImportReport lists the changes of an import and the events that couldn't be imported
+type CalendarImportReport struct {
+	DryRun   bool
+	Changes  []GroupChange
+	Warnings []string
+}
+
+func (r CalendarImportReport) String() string {
+	var b strings.Builder
+	for _, c := range r.Changes {
+		b.WriteString(c.String())
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	return b.String()
+}
+
+func sortGroupTimes(times []GroupTimeData) {
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].DayOfTheWeek != times[j].DayOfTheWeek {
+			return times[i].DayOfTheWeek < times[j].DayOfTheWeek
+		}
+		return times[i].StartTime < times[j].StartTime
+	})
+}
+
+func containsGroupTime(times []GroupTimeData, t GroupTimeData) bool {
+	for _, other := range times {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
+
+// diffGroupTimes returns the times that are only in new and the times that are only in old
+func diffGroupTimes(old []GroupTimeData, new []GroupTimeData) ([]GroupTimeData, []GroupTimeData) {
+	oldSet := map[GroupTimeData]bool{}
+	for _, t := range old {
+		oldSet[t] = true
+	}
+	newSet := map[GroupTimeData]bool{}
+	var added []GroupTimeData
+	for _, t := range new {
+		newSet[t] = true
+		if !oldSet[t] {
+			added = append(added, t)
+		}
+	}
+	var removed []GroupTimeData
+	for _, t := range old {
+		if !newSet[t] {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+// findImportTarget returns the existing group the imported group belongs to: the group in the UID, or a group with the same name and overlapping dates
+func findImportTarget(g importedGroup, db *gorm.DB) (Group, bool, error) {
+	if g.GroupID != "" {
+		group, err := getGroupInfo(g.GroupID, db)
+		if err == nil {
+			return group, true, nil
+		}
+		if err != ErrGroupNotFound {
+			return Group{}, false, err
+		}
+	}
+	var groups []Group
+	tx := db.Where("name = ?", g.Name).Find(&groups)
+	if tx.Error != nil {
+		return Group{}, false, tx.Error
+	}
+	for _, group := range groups {
+		if overlaps(group.StartDate, group.EndDate, g.First.Unix(), g.Last.Unix()) {
+			return group, true, nil
+		}
+	}
+	return Group{}, false, nil
+}
+
+// findImportCourse returns the course of a new group: a course whose short name is one of the categories of the events,
+// or the part of the group name before the last dot, e.g. MAA2 for MAA2.1
+func findImportCourse(g importedGroup, db *gorm.DB) (string, error) {
+	names := g.Categories
+	if i := strings.LastIndex(g.Name, "."); i > 0 {
+		names = append(names, g.Name[:i])
+	}
+	for _, name := range names {
+		var course Course
+		tx := db.Where("course_name_short = ?", strings.TrimSpace(name)).Limit(1).Find(&course)
+		if tx.Error != nil {
+			return "", tx.Error
+		}
+		if tx.RowsAffected != 0 {
+			return course.CourseID, nil
+		}
+	}
+	return "", ErrCourseNotFound
+}
+
+// ImportCalendar creates and updates groups from the weekly repeating events of an iCalendar file.
+// The events of a group are recognized by the UIDs made by GroupCalendar, or by the summary being the name of the group.
+// Existing groups get the times of the calendar with UpdateGroupTimes and their dates are extended to cover the events.
+// Updates that would move a group outside its period or make lessons overlap for its members or teacher are skipped with a warning.
+// New groups are made with NewGroup, their course is found by CATEGORIES or by the group name.
+// EXDATEs are ignored, so breaks are not imported and have to be added with NewHoliday.
+// The import is saved in one transaction. With dryRun nothing is saved and the report tells what would change.
+func ImportCalendar(r io.Reader, dryRun bool, db *gorm.DB) (CalendarImportReport, error) {
+	return importCalendar(r, dryRun, nil, db)
+}
+
+// checkImportUpdate returns a warning if the new dates or times of a group are outside its period or overlap the schedules of its members or teacher
+func checkImportUpdate(group Group, change GroupChange, times []GroupTimeData, db *gorm.DB) (string, error) {
+	if group.PeriodID != "" && (change.StartDate != change.OldStartDate || change.EndDate != change.OldEndDate) {
+		period, err := GetPeriod(group.PeriodID, db)
+		if err != nil && err != ErrPeriodNotFound {
+			return "", err
+		}
+		if err == nil && (change.StartDate < period.StartDate || change.EndDate > period.EndDate) {
+			return fmt.Sprintf("%s: %s", group.Name, ErrGroupOutsidePeriod), nil
+		}
+	}
+	updated := group
+	updated.StartDate = change.StartDate
+	updated.EndDate = change.EndDate
+	var groupTimes []GroupTime
+	for _, t := range times {
+		groupTimes = append(groupTimes, GroupTime{GroupID: group.GroupID, StartTime: t.StartTime, EndTime: t.EndTime, DayOfTheWeek: t.DayOfTheWeek})
+	}
+	conflicts, err := FindGroupConflicts(updated, groupTimes, db)
+	if err != nil {
+		return "", err
+	}
+	if len(conflicts) != 0 {
+		return (&ScheduleConflictError{Conflicts: conflicts}).Error(), nil
+	}
+	return "", nil
+}
+
+// importCalendar does the work of ImportCalendar. canUpdate is called before an existing group is changed, an error from it stops the import.
+func importCalendar(r io.Reader, dryRun bool, canUpdate func(group Group) error, db *gorm.DB) (CalendarImportReport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return CalendarImportReport{}, err
+	}
+	events, err := parseICalEvents(string(data))
+	if err != nil {
+		return CalendarImportReport{}, err
+	}
+
+	report := CalendarImportReport{DryRun: dryRun, Changes: []GroupChange{}, Warnings: []string{}}
+	var order []string
+	merged := map[string]*importedGroup{}
+	for _, e := range events {
+		g, err := parseICalEvent(e)
+		if err != nil {
+			report.Warnings = append(report.Warnings, err.Error())
+			continue
+		}
+		key := "name:" + g.Name
+		if g.GroupID != "" {
+			key = "id:" + g.GroupID
+		}
+		m, ok := merged[key]
+		if !ok {
+			order = append(order, key)
+			merged[key] = &g
+			continue
+		}
+		for _, t := range g.Times {
+			if !containsGroupTime(m.Times, t) {
+				m.Times = append(m.Times, t)
+			}
+		}
+		m.Categories = append(m.Categories, g.Categories...)
+		if g.First.Before(m.First) {
+			m.First = g.First
+		}
+		if g.Last.After(m.Last) {
+			m.Last = g.Last
+		}
+	}
+
+	apply := func(tx *gorm.DB) error {
+		for _, key := range order {
+			g := merged[key]
+			sortGroupTimes(g.Times)
+			group, exists, err := findImportTarget(*g, tx)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				courseID, err := findImportCourse(*g, tx)
+				if err == ErrCourseNotFound {
+					report.Warnings = append(report.Warnings, fmt.Sprintf("%s: no course found for the group", g.Name))
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				change := GroupChange{
+					Action:    ImportCreate,
+					Name:      g.Name,
+					CourseID:  courseID,
+					StartDate: g.First.Unix(),
+					EndDate:   g.Last.Unix(),
+					Added:     g.Times,
+				}
+				if !dryRun {
+					created, err := NewGroup(g.Name, courseID, change.StartDate, change.EndDate, g.Times, tx)
+					if err != nil {
+						return err
+					}
+					change.GroupID = created.GroupID
+				}
+				report.Changes = append(report.Changes, change)
+				continue
+			}
+
+			times, err := getTimesOfGroups([]Group{group}, tx)
+			if err != nil {
+				return err
+			}
+			var old []GroupTimeData
+			for _, t := range times[group.GroupID] {
+				old = append(old, GroupTimeData{StartTime: t.StartTime, EndTime: t.EndTime, DayOfTheWeek: t.DayOfTheWeek})
+			}
+			added, removed := diffGroupTimes(old, g.Times)
+			change := GroupChange{
+				Action:       ImportUnchanged,
+				GroupID:      group.GroupID,
+				Name:         group.Name,
+				CourseID:     group.CourseID,
+				StartDate:    group.StartDate,
+				EndDate:      group.EndDate,
+				OldStartDate: group.StartDate,
+				OldEndDate:   group.EndDate,
+				Added:        added,
+				Removed:      removed,
+			}
+			if g.First.Unix() < change.StartDate {
+				change.StartDate = g.First.Unix()
+			}
+			if g.Last.Unix() > change.EndDate {
+				change.EndDate = g.Last.Unix()
+			}
+			datesChanged := change.StartDate != change.OldStartDate || change.EndDate != change.OldEndDate
+			if len(added) != 0 || len(removed) != 0 || datesChanged {
+				change.Action = ImportUpdate
+				if canUpdate != nil {
+					if err := canUpdate(group); err != nil {
+						return err
+					}
+				}
+				warning, err := checkImportUpdate(group, change, g.Times, tx)
+				if err != nil {
+					return err
+				}
+				if warning != "" {
+					report.Warnings = append(report.Warnings, warning)
+					continue
+				}
+			}
+			if !dryRun && (len(added) != 0 || len(removed) != 0) {
+				err = UpdateGroupTimes(group.GroupID, g.Times, tx)
+				if err != nil {
+					return err
+				}
+			}
+			if !dryRun && datesChanged {
+				err = tx.Model(Group{}).Where("group_id = ?", group.GroupID).Updates(map[string]interface{}{"start_date": change.StartDate, "end_date": change.EndDate}).Error
+				if err != nil {
+					return err
+				}
+			}
+			report.Changes = append(report.Changes, change)
+		}
+		return nil
+	}
+	if dryRun {
+		err = apply(db)
+	} else {
+		err = db.Transaction(apply)
+	}
+	if err != nil {
+		return CalendarImportReport{}, err
+	}
+	return report, nil
+}
+
+// ImportCalendarAs imports a calendar if actor is allowed to create groups and to edit every existing group the calendar changes
+func ImportCalendarAs(actor User, r io.Reader, dryRun bool, db *gorm.DB) (CalendarImportReport, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupCreate, "", db); err != nil {
+		return CalendarImportReport{}, err
+	}
+	canUpdate := func(group Group) error {
+		return DefaultAuthorizer.Authorize(actor, ActionGroupEdit, group.GroupID, db)
+	}
+	return importCalendar(r, dryRun, canUpdate, withAudit(db, actor, ActionGroupCreate))
+}
@@ -0,0 +1,340 @@
+package wilhelmiina
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RosterRow is a single user in a roster file
+type RosterRow struct {
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Surname   string `json:"surname"`
+	// If the password is empty the user gets an invitation token instead, see IssueInvitationToken
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	// Usernames of the students this user is a guardian of. The students can be in the same roster or already in the database.
+	GuardianOf []string `json:"guardian_of"`
+}
+
+// ImportRowResult tells what happened to a single row of the roster. Row is the 1-based index of the row, not counting the CSV header.
+type ImportRowResult struct {
+	Row             int
+	Username        string
+	UUID            string
+	Errors          []string
+	InvitationToken string
+}
+
+type ImportReport struct {
+	Rows    []ImportRowResult
+	DryRun  bool
+	Created int
+}
+
+// Valid reports whether every row of the roster passed validation
+func (r ImportReport) Valid() bool {
+	for _, row := range r.Rows {
+		if len(row.Errors) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ImportHashWorkers is the number of passwords hashed in parallel during an import.
+// Every worker uses the memory set in the hash policy, so keep this small with the default policy.
+var ImportHashWorkers = minInt(runtime.NumCPU(), 4)
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var rosterColumns = []string{"username", "firstname", "surname", "password", "role", "guardian_of"}
+
+// ParseRosterCSV reads a roster from CSV. The first line must be a header naming the columns username, firstname, surname, password, role and guardian_of in any order.
+// Password and guardian_of are optional, guardian_of can contain many usernames separated by semicolons.
+func ParseRosterCSV(r io.Reader) ([]RosterRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"username", "firstname", "surname", "role"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("roster is missing column %q", required)
+		}
+	}
+
+	var rows []RosterRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		values := map[string]string{}
+		for _, name := range rosterColumns {
+			if i, ok := columns[name]; ok && i < len(record) {
+				values[name] = strings.TrimSpace(record[i])
+			}
+		}
+		row := RosterRow{
+			Username:  values["username"],
+			Firstname: values["firstname"],
+			Surname:   values["surname"],
+			Password:  values["password"],
+			Role:      values["role"],
+		}
+		for _, un := range strings.Split(values["guardian_of"], ";") {
+			if un = strings.TrimSpace(un); un != "" {
+				row.GuardianOf = append(row.GuardianOf, un)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseRosterJSON reads a roster from a JSON array of RosterRows
+func ParseRosterJSON(r io.Reader) ([]RosterRow, error) {
+	var rows []RosterRow
+	err := json.NewDecoder(r).Decode(&rows)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// validateRoster checks every row and returns the users that would be created
+func validateRoster(rows []RosterRow, db *gorm.DB) ([]ImportRowResult, []User, error) {
+	results := make([]ImportRowResult, len(rows))
+	users := make([]User, len(rows))
+	rosterRoles := map[string]Role{}
+	seen := map[string]int{}
+
+	for i, row := range rows {
+		res := ImportRowResult{Row: i + 1, Username: row.Username}
+		addErr := func(format string, args ...interface{}) {
+			res.Errors = append(res.Errors, fmt.Sprintf(format, args...))
+		}
+
+		key := NormalizeUsername(row.Username)
+		if row.Username == "" {
+			addErr("username is missing")
+		} else if first, ok := seen[key]; ok {
+			addErr("username %q is already used on row %d", row.Username, first)
+		} else {
+			seen[key] = i + 1
+			_, err := GetUserByUn(row.Username, db)
+			if err == nil {
+				addErr("username %q already exists", row.Username)
+			} else if err != ErrUserNotFound {
+				return nil, nil, err
+			}
+		}
+		if row.Firstname == "" {
+			addErr("firstname is missing")
+		}
+		if row.Surname == "" {
+			addErr("surname is missing")
+		}
+		role, roleErr := ParseRole(row.Role)
+		if roleErr != nil {
+			addErr("invalid role %q", row.Role)
+		} else {
+			rosterRoles[key] = role
+		}
+
+		u := User{
+			UUID:         uuid.New().String(),
+			Username:     row.Username,
+			UsernameKey:  key,
+			Firstname:    row.Firstname,
+			Surname:      row.Surname,
+			FirstnameKey: NormalizeUsername(row.Firstname),
+			SurnameKey:   NormalizeUsername(row.Surname),
+			Role:         role,
+		}
+		if row.Password != "" {
+			if err := CheckPasswordPolicy(row.Password, u); err != nil {
+				addErr("%s", err.Error())
+			}
+		} else {
+			u.MustChangePassword = true
+		}
+		if len(row.GuardianOf) != 0 && roleErr == nil && role != Guardian {
+			addErr("only guardians can have guardian_of")
+		}
+
+		res.UUID = u.UUID
+		results[i] = res
+		users[i] = u
+	}
+
+	// Guardian links are checked last because the students can be anywhere in the roster
+	for i, row := range rows {
+		for _, studentUn := range row.GuardianOf {
+			role, ok := rosterRoles[NormalizeUsername(studentUn)]
+			if !ok {
+				student, err := GetUserByUn(studentUn, db)
+				if err == ErrUserNotFound {
+					results[i].Errors = append(results[i].Errors, fmt.Sprintf("student %q not found", studentUn))
+					continue
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+				role = student.Role
+			}
+			if role != Student {
+				results[i].Errors = append(results[i].Errors, fmt.Sprintf("%q is not a student", studentUn))
+			}
+		}
+	}
+	return results, users, nil
+}
+
+// hashRosterPasswords hashes the passwords of all users in parallel, users without a password get a random one
+func hashRosterPasswords(rows []RosterRow, users []User) error {
+	jobs := make(chan int)
+	errs := make(chan error, len(users))
+	var wg sync.WaitGroup
+
+	workers := ImportHashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				password := rows[i].Password
+				if password == "" {
+					random, err := genToken()
+					if err != nil {
+						errs <- err
+						continue
+					}
+					password = random
+				}
+				hash, err := genHashString(password)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				users[i].Password = hash
+			}
+		}()
+	}
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+var ErrInvalidRoster = errors.New("roster contains invalid rows")
+
+// ImportRoster creates all users of a roster in a single transaction, either every user is created or none are.
+// With dryRun only validation is done. The report tells what happened to every row, if some row is invalid ErrInvalidRoster is returned together with the report.
+// Users without a password in the roster get an invitation token, which is returned in the report.
+func ImportRoster(rows []RosterRow, dryRun bool, db *gorm.DB) (ImportReport, error) {
+	results, users, err := validateRoster(rows, db)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report := ImportReport{Rows: results, DryRun: dryRun}
+	if !report.Valid() {
+		return report, ErrInvalidRoster
+	}
+	if dryRun || len(rows) == 0 {
+		return report, nil
+	}
+
+	err = hashRosterPasswords(rows, users)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	uuids := map[string]string{}
+	for _, u := range users {
+		uuids[u.UsernameKey] = u.UUID
+	}
+	var links []GuardianData
+	for i, row := range rows {
+		for _, studentUn := range row.GuardianOf {
+			studentID, ok := uuids[NormalizeUsername(studentUn)]
+			if !ok {
+				student, err := GetUserByUn(studentUn, db)
+				if err != nil {
+					return ImportReport{}, err
+				}
+				studentID = student.UUID
+			}
+			links = append(links, GuardianData{UUID: users[i].UUID, GuardianOf: studentID})
+		}
+	}
+
+	now := time.Now()
+	var tokens []PasswordResetToken
+	for i, u := range users {
+		if !u.MustChangePassword {
+			continue
+		}
+		token, t, err := newResetToken(u.UUID, InvitationToken, InvitationTokenLifetime, now)
+		if err != nil {
+			return ImportReport{}, err
+		}
+		report.Rows[i].InvitationToken = token
+		tokens = append(tokens, t)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(&users, 100).Error; err != nil {
+			return err
+		}
+		if len(links) != 0 {
+			if err := tx.Create(&links).Error; err != nil {
+				return err
+			}
+		}
+		if len(tokens) != 0 {
+			if err := tx.Create(&tokens).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report.Created = len(users)
+	return report, nil
+}
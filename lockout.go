@@ -0,0 +1,284 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginAttempt is a row in the login history, one is saved for every call to Login
+type LoginAttempt struct {
+	gorm.Model
+	UUID      string `gorm:"index"` // Empty if no user was found with the username
+	Username  string
+	SourceKey string `gorm:"index"`
+	Success   bool
+	Reason    string // Why the attempt failed
+	Time      int64
+}
+
+const (
+	AttemptUnknownUser     = "unknown_user"
+	AttemptInvalidPassword = "invalid_password"
+	AttemptInvalidCode     = "invalid_code"
+	AttemptThrottled       = "throttled"
+	AttemptLocked          = "locked"
+	AttemptInactive        = "inactive"
+	AttemptServiceAccount  = "service_account"
+)
+
+// LoginThrottle tracks failed logins for a single user or source
+type LoginThrottle struct {
+	ThrottleKey  string `gorm:"primaryKey"`
+	Failures     int
+	LastFailure  int64
+	BlockedUntil int64
+	Locked       bool
+	LockedUntil  int64 // 0 means the lock lasts until an admin unlocks it
+}
+
+// LockoutPolicy controls how failed logins are throttled.
+// After FreeAttempts failures every new failure doubles the time the user or source has to wait before trying again, starting from BaseDelay and capped at MaxDelay.
+// After LockoutAfter failures the account is locked for LockoutDuration, or until UnlockUser is called if LockoutDuration is 0.
+type LockoutPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int // 0 disables locking
+	LockoutDuration time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:    3,
+	BaseDelay:       2 * time.Second,
+	MaxDelay:        15 * time.Minute,
+	LockoutAfter:    10,
+	LockoutDuration: 30 * time.Minute,
+}
+
+var lockoutPolicy = DefaultLockoutPolicy
+
+func SetLockoutPolicy(p LockoutPolicy) {
+	lockoutPolicy = p
+}
+
+func GetLockoutPolicy() LockoutPolicy {
+	return lockoutPolicy
+}
+
+var ErrAccountLocked = errors.New("account is locked")
+var ErrTooManyAttempts = errors.New("too many failed login attempts")
+
+// ThrottleError is returned by Login when the user or source has to wait before trying again
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s, try again in %s", ErrTooManyAttempts.Error(), e.RetryAfter)
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+func userThrottleKey(UUID string) string {
+	return "user:" + UUID
+}
+
+func sourceThrottleKey(sourceKey string) string {
+	return "source:" + sourceKey
+}
+
+func getThrottle(key string, db *gorm.DB) (LoginThrottle, error) {
+	var t LoginThrottle
+	tx := db.Where("throttle_key = ?", key).Limit(1).Find(&t)
+	if tx.Error != nil {
+		return LoginThrottle{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return LoginThrottle{ThrottleKey: key}, nil
+	}
+	return t, nil
+}
+
+// checkThrottle returns an error if logins are currently not allowed for key
+func checkThrottle(key string, now time.Time, db *gorm.DB) error {
+	t, err := getThrottle(key, db)
+	if err != nil {
+		return err
+	}
+	if t.Locked && (t.LockedUntil == 0 || now.Unix() < t.LockedUntil) {
+		return ErrAccountLocked
+	}
+	if now.Unix() < t.BlockedUntil {
+		return &ThrottleError{RetryAfter: time.Unix(t.BlockedUntil, 0).Sub(now)}
+	}
+	return nil
+}
+
+func backoffDelay(failures int, p LockoutPolicy) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < over; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// recordFailure increments the failure count of key, lock is true if the key may be locked out completely.
+// The count is incremented in the database so concurrent failures are all counted.
+func recordFailure(key string, lock bool, now time.Time, db *gorm.DB) error {
+	p := lockoutPolicy
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginThrottle{ThrottleKey: key}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&LoginThrottle{}).Where("throttle_key = ?", key).
+			Updates(map[string]interface{}{"failures": gorm.Expr("failures + 1"), "last_failure": now.Unix()}).Error
+		if err != nil {
+			return err
+		}
+		t, err := getThrottle(key, tx)
+		if err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"blocked_until": now.Add(backoffDelay(t.Failures, p)).Unix()}
+		if lock && p.LockoutAfter > 0 && t.Failures >= p.LockoutAfter {
+			updates["locked"] = true
+			updates["locked_until"] = 0
+			if p.LockoutDuration != 0 {
+				updates["locked_until"] = now.Add(p.LockoutDuration).Unix()
+			}
+		}
+		return tx.Model(&LoginThrottle{}).Where("throttle_key = ?", key).Updates(updates).Error
+	})
+}
+
+func resetThrottle(key string, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Where("throttle_key = ?", key).Delete(&LoginThrottle{})
+	return tx.Commit().Error
+}
+
+func recordAttempt(user User, username string, sourceKey string, reason string, now time.Time, db *gorm.DB) error {
+	a := LoginAttempt{
+		UUID:      user.UUID,
+		Username:  username,
+		SourceKey: sourceKey,
+		Success:   reason == "",
+		Reason:    reason,
+		Time:      now.Unix(),
+	}
+	tx := db.Begin()
+	tx.Create(&a)
+	return tx.Commit().Error
+}
+
+// checkLoginAllowed checks the throttles of the source and the user before the expensive password check
+func checkLoginAllowed(user User, username string, sourceKey string, now time.Time, db *gorm.DB) error {
+	if sourceKey != "" {
+		err := checkThrottle(sourceThrottleKey(sourceKey), now, db)
+		if err != nil {
+			recordAttempt(user, username, sourceKey, AttemptThrottled, now, db)
+			return err
+		}
+	}
+	if user.UUID == "" {
+		return nil
+	}
+	err := checkThrottle(userThrottleKey(user.UUID), now, db)
+	if err == ErrAccountLocked {
+		recordAttempt(user, username, sourceKey, AttemptLocked, now, db)
+		return err
+	}
+	if err != nil {
+		recordAttempt(user, username, sourceKey, AttemptThrottled, now, db)
+	}
+	return err
+}
+
+// loginFailed records a failed login for the user and the source
+func loginFailed(user User, username string, sourceKey string, reason string, now time.Time, db *gorm.DB) error {
+	err := recordAttempt(user, username, sourceKey, reason, now, db)
+	if err != nil {
+		return err
+	}
+	if sourceKey != "" {
+		err = recordFailure(sourceThrottleKey(sourceKey), false, now, db)
+		if err != nil {
+			return err
+		}
+	}
+	if user.UUID != "" {
+		return recordFailure(userThrottleKey(user.UUID), true, now, db)
+	}
+	return nil
+}
+
+// loginSucceeded records a succesful login and clears the failure count of the user
+func loginSucceeded(user User, username string, sourceKey string, now time.Time, db *gorm.DB) error {
+	err := recordAttempt(user, username, sourceKey, "", now, db)
+	if err != nil {
+		return err
+	}
+	return resetThrottle(userThrottleKey(user.UUID), db)
+}
+
+// UnlockUser removes a lockout and clears the failed login count of a user
+func UnlockUser(UUID string, db *gorm.DB) error {
+	return resetThrottle(userThrottleKey(UUID), db)
+}
+
+// UnlockUserAs unlocks a user if actor is allowed to do so
+func UnlockUserAs(actor User, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserUnlock, UUID, db); err != nil {
+		return err
+	}
+	return UnlockUser(UUID, withAudit(db, actor, ActionUserUnlock))
+}
+
+// IsLocked reports whether the account of the user is currently locked
+func IsLocked(UUID string, db *gorm.DB) (bool, error) {
+	err := checkThrottle(userThrottleKey(UUID), time.Now(), db)
+	if err == ErrAccountLocked {
+		return true, nil
+	}
+	if _, ok := err.(*ThrottleError); ok {
+		return false, nil
+	}
+	return false, err
+}
+
+// GetLoginAttempts returns the login history of a user, newest first
+func GetLoginAttempts(UUID string, db *gorm.DB) ([]LoginAttempt, error) {
+	var data []LoginAttempt
+	tx := db.Model(LoginAttempt{}).Where("uuid = ?", UUID).Order("id DESC").Find(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return data, nil
+}
+
+// GetLoginAttemptsFromSource returns the login history of a source, newest first
+func GetLoginAttemptsFromSource(sourceKey string, db *gorm.DB) ([]LoginAttempt, error) {
+	var data []LoginAttempt
+	tx := db.Model(LoginAttempt{}).Where("source_key = ?", sourceKey).Order("id DESC").Find(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return data, nil
+}
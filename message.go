@@ -23,14 +23,29 @@ type MessageReciever struct {
 
 func createRecieverList(messageID string, recievers []string) []MessageReciever {
 	var list []MessageReciever
+	seen := map[string]bool{}
 	for _, reciever := range recievers {
+		if seen[reciever] {
+			continue
+		}
+		seen[reciever] = true
 		list = append(list, MessageReciever{MessageID: messageID, UUID: reciever})
 	}
 	return list
 }
 
-// Creates and sends a message by saving it to database:
+// Creates and sends a message by saving it to database.
+// Messages sent by teachers to minor students are also sent to the guardians of the students:
 func SendMessage(from string, to []string, title string, contents string, respondsTo string, db *gorm.DB) (Message, error) {
+	to, err := addGuardianRecipients(from, to, db)
+	if err != nil {
+		return Message{}, err
+	}
+	return saveMessage(from, to, title, contents, respondsTo, db)
+}
+
+// saveMessage saves a message for exactly the given recievers, without adding guardians
+func saveMessage(from string, to []string, title string, contents string, respondsTo string, db *gorm.DB) (Message, error) {
 	messageID := uuid.New().String()
 	mr := createRecieverList(messageID, to)
 	message := Message{
@@ -41,10 +56,12 @@ func SendMessage(from string, to []string, title string, contents string, respon
 		RespondsTo: respondsTo,
 	}
 
-	tx := db.Begin()
-	db.Create(&message)
-	db.Create(&mr)
-	err := tx.Commit().Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		return tx.Create(&mr).Error
+	})
 
 	if err != nil {
 		return Message{}, err
@@ -119,3 +136,19 @@ func (m *Message) GetReplies(db *gorm.DB) ([]Message, error) {
 func (m *Message) Delete(db *gorm.DB) error {
 	return DeleteMessage(m.MessageID, db)
 }
+
+// SendMessageAs sends a message from actor if actor is allowed to send messages
+func SendMessageAs(actor User, to []string, title string, contents string, respondsTo string, db *gorm.DB) (Message, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionMessageSend, "", db); err != nil {
+		return Message{}, err
+	}
+	return SendMessage(actor.UUID, to, title, contents, respondsTo, withAudit(db, actor, ActionMessageSend))
+}
+
+// DeleteMessageAs deletes a message if actor is allowed to do so
+func DeleteMessageAs(actor User, messageID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionMessageDelete, messageID, db); err != nil {
+		return err
+	}
+	return DeleteMessage(messageID, withAudit(db, actor, ActionMessageDelete))
+}
@@ -4,11 +4,14 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/argon2"
+	"gorm.io/gorm"
 )
 
 const (
@@ -19,8 +22,65 @@ const (
 	ARGON2_THREADS = 4
 )
 
-func genSalt() (salt []byte, err error) {
-	salt = make([]byte, PW_SALT_BYTES)
+// Limits for argon2 parameters, both in the hash policy and in stored hashes.
+// argon2 panics with zero time or threads and a huge memory parameter in a stored hash could run the server out of memory.
+const (
+	MAX_ARGON2_TIME = 64
+	MAX_ARGON2_MEM  = 1024 * 1024 * 2
+	MIN_SALT_BYTES  = 8
+	MIN_HASH_LEN    = 16
+	MAX_SALT_BYTES  = 1024
+	MAX_HASH_LEN    = 1024
+)
+
+// HashPolicy contains the argon2id parameters used when hashing new passwords.
+// Existing hashes are always verified with the parameters stored in the hash itself, so the policy can be changed without breaking logins.
+type HashPolicy struct {
+	Time    uint32
+	Memory  uint32 // In KiB
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var DefaultHashPolicy = HashPolicy{
+	Time:    ARGON2_TIME,
+	Memory:  ARGON2_MEM,
+	Threads: ARGON2_THREADS,
+	SaltLen: PW_SALT_BYTES,
+	KeyLen:  PW_HASH_LEN,
+}
+
+var hashPolicy = DefaultHashPolicy
+
+var ErrInvalidHashPolicy = errors.New("hash policy parameters are out of bounds")
+
+// validArgon2Params checks the parameters against the limits above
+func validArgon2Params(p HashPolicy) bool {
+	return p.Time >= 1 && p.Time <= MAX_ARGON2_TIME &&
+		p.Threads >= 1 &&
+		p.Memory >= 8*uint32(p.Threads) && p.Memory <= MAX_ARGON2_MEM &&
+		p.SaltLen >= MIN_SALT_BYTES && p.SaltLen <= MAX_SALT_BYTES &&
+		p.KeyLen >= MIN_HASH_LEN && p.KeyLen <= MAX_HASH_LEN
+}
+
+// SetHashPolicy changes the parameters used for hashing new passwords. Should be called before the app starts handling requests.
+// Passwords hashed with different parameters are rehashed the next time the user logs in.
+// Returns ErrInvalidHashPolicy and keeps the old policy if the parameters are out of bounds.
+func SetHashPolicy(p HashPolicy) error {
+	if !validArgon2Params(p) {
+		return ErrInvalidHashPolicy
+	}
+	hashPolicy = p
+	return nil
+}
+
+func GetHashPolicy() HashPolicy {
+	return hashPolicy
+}
+
+func genSalt(length uint32) (salt []byte, err error) {
+	salt = make([]byte, length)
 	_, err = io.ReadFull(rand.Reader, salt)
 	if err != nil {
 		return nil, err
@@ -28,56 +88,137 @@ func genSalt() (salt []byte, err error) {
 	return
 }
 
-func hashPassword(password string, salt []byte) []byte {
-	hash := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEM, ARGON2_THREADS, PW_HASH_LEN)
+func hashPassword(password string, salt []byte, p HashPolicy) []byte {
+	hash := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
 	return hash
 
 }
 
-func encodeHash(hash []byte, salt []byte) (encoded string) {
+func encodeHash(hash []byte, salt []byte, p HashPolicy) (encoded string) {
 	b64Hash := base64.RawStdEncoding.EncodeToString(hash)
 	b64Salt := base64.RawStdEncoding.EncodeToString(salt)
 
 	encoded = fmt.Sprintf(
 		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
-		argon2.Version, ARGON2_MEM, ARGON2_TIME, ARGON2_THREADS, b64Salt, b64Hash,
+		argon2.Version, p.Memory, p.Time, p.Threads, b64Salt, b64Hash,
 	)
 
 	return
 }
 
 func validatePassword(password string, hashString string) (bool, error) {
-	hash, salt, err := decodeHash(hashString)
+	hash, salt, p, err := decodeHash(hashString)
 	if err != nil {
 		return false, err
 	}
 
-	hash2 := hashPassword(password, salt)
+	hash2 := hashPassword(password, salt, p)
 	return subtle.ConstantTimeCompare(hash, hash2) == 1, nil
 }
 
-func decodeHash(hashString string) (hash []byte, salt []byte, err error) {
+// Hashes of an empty password, one for each hash policy in use, see checkDummyPassword
+var dummyHashes = map[HashPolicy]string{}
+var dummyHashesLock sync.Mutex
+
+// checkDummyPassword checks password against a hash made with the current policy, so a login for an unknown user
+// takes as long as one for a real user and doesn't reveal which usernames exist
+func checkDummyPassword(password string) error {
+	dummyHashesLock.Lock()
+	p := hashPolicy
+	hash, ok := dummyHashes[p]
+	if !ok {
+		salt, err := genSalt(p.SaltLen)
+		if err != nil {
+			dummyHashesLock.Unlock()
+			return err
+		}
+		hash = encodeHash(hashPassword("", salt, p), salt, p)
+		dummyHashes[p] = hash
+	}
+	dummyHashesLock.Unlock()
+	_, err := validatePassword(password, hash)
+	return err
+}
+
+var ErrInvalidHash = errors.New("password hash is not in the expected format")
+var ErrIncompatibleVersion = errors.New("password hash uses an incompatible version of argon2")
+
+func decodeHash(hashString string) (hash []byte, salt []byte, p HashPolicy, err error) {
 	vals := strings.Split(hashString, "$")
+	if len(vals) != 6 || vals[1] != "argon2id" {
+		return nil, nil, HashPolicy{}, ErrInvalidHash
+	}
+
+	var version int
+	_, err = fmt.Sscanf(vals[2], "v=%d", &version)
+	if err != nil {
+		return nil, nil, HashPolicy{}, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return nil, nil, HashPolicy{}, ErrIncompatibleVersion
+	}
+
+	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return nil, nil, HashPolicy{}, ErrInvalidHash
+	}
+
 	b64salt := vals[4]
 	b64hash := vals[5]
 
 	hash, err = base64.RawStdEncoding.Strict().DecodeString(b64hash)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, HashPolicy{}, err
 	}
 	salt, err = base64.RawStdEncoding.Strict().DecodeString(b64salt)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, HashPolicy{}, err
+	}
+	p.KeyLen = uint32(len(hash))
+	p.SaltLen = uint32(len(salt))
+	if !validArgon2Params(p) {
+		return nil, nil, HashPolicy{}, ErrInvalidHash
 	}
 	return
 }
 
 func genHashString(password string) (string, error) {
-	salt, err := genSalt()
+	p := hashPolicy
+	salt, err := genSalt(p.SaltLen)
 	if err != nil {
 		return "", err
 	}
-	hash := hashPassword(password, salt)
-	encoded := encodeHash(hash, salt)
+	hash := hashPassword(password, salt, p)
+	encoded := encodeHash(hash, salt, p)
 	return encoded, nil
 }
+
+// needsRehash reports whether hashString was created with different parameters than the current hash policy
+func needsRehash(hashString string) (bool, error) {
+	_, _, p, err := decodeHash(hashString)
+	if err != nil {
+		return false, err
+	}
+	return p != hashPolicy, nil
+}
+
+// rehashPassword hashes an already verified password again using the current hash policy if the stored hash is outdated
+func rehashPassword(u *User, password string, db *gorm.DB) error {
+	outdated, err := needsRehash(u.Password)
+	if err != nil || !outdated {
+		return err
+	}
+	newHash, err := genHashString(password)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	tx.Model(User{}).Where("uuid = ?", u.UUID).Update("password", newHash)
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	u.Password = newHash
+	return nil
+}
@@ -0,0 +1,188 @@
+package wilhelmiina
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes the requirements new passwords must meet. It is enforced by CreateUser and ChangePassword.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Forbids passwords containing the username, firstname or surname of the user
+	ForbidPersonalInfo bool
+	// Lowercased passwords that are not allowed, see LoadDenyList
+	DenyList map[string]bool
+}
+
+// DefaultPasswordPolicy only forbids empty passwords so that existing apps keep working, use RecommendedPasswordPolicy or your own policy in production
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 1,
+}
+
+// RecommendedPasswordPolicy returns a reasonably strict policy. Remember to load a deny list of common passwords to it.
+func RecommendedPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:          10,
+		RequireLower:       true,
+		RequireUpper:       true,
+		RequireDigit:       true,
+		ForbidPersonalInfo: true,
+		DenyList:           map[string]bool{},
+	}
+}
+
+var passwordPolicy = DefaultPasswordPolicy
+
+// SetPasswordPolicy changes the policy enforced by CreateUser and ChangePassword
+func SetPasswordPolicy(p PasswordPolicy) {
+	passwordPolicy = p
+}
+
+func GetPasswordPolicy() PasswordPolicy {
+	return passwordPolicy
+}
+
+// LoadDenyList adds passwords from a file to the deny list of the policy. The file should contain one password per line, empty lines and lines starting with # are ignored.
+func (p *PasswordPolicy) LoadDenyList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if p.DenyList == nil {
+		p.DenyList = map[string]bool{}
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.DenyList[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+type ViolationCode string
+
+const (
+	ViolationTooShort             ViolationCode = "too_short"
+	ViolationMissingLower         ViolationCode = "missing_lowercase"
+	ViolationMissingUpper         ViolationCode = "missing_uppercase"
+	ViolationMissingDigit         ViolationCode = "missing_digit"
+	ViolationMissingSymbol        ViolationCode = "missing_symbol"
+	ViolationContainsPersonalInfo ViolationCode = "contains_personal_info"
+	ViolationCommonPassword       ViolationCode = "common_password"
+)
+
+// PasswordViolation is a single requirement of the policy the password did not meet. Code is meant for programs, Message for humans.
+type PasswordViolation struct {
+	Code    ViolationCode
+	Message string
+}
+
+var ErrWeakPassword = errors.New("password does not meet the password policy")
+
+// PasswordPolicyError is returned when a password breaks the password policy, it lists every violation so a UI can show them all at once
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return ErrWeakPassword.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrWeakPassword
+}
+
+// personalInfoParts returns the parts of the users names that should not appear in their password
+func personalInfoParts(u User) []string {
+	var parts []string
+	fields := []string{u.Username, u.Firstname, u.Surname}
+	for _, f := range fields {
+		for _, part := range strings.FieldsFunc(strings.ToLower(f), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if utf8.RuneCountInString(part) >= 3 {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// Check returns a *PasswordPolicyError if password doesn't meet the policy for user u
+func (p PasswordPolicy) Check(password string, u User) error {
+	var violations []PasswordViolation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Code:    ViolationTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters long", p.MinLength),
+		})
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireLower && !hasLower {
+		violations = append(violations, PasswordViolation{Code: ViolationMissingLower, Message: "password must contain a lowercase letter"})
+	}
+	if p.RequireUpper && !hasUpper {
+		violations = append(violations, PasswordViolation{Code: ViolationMissingUpper, Message: "password must contain an uppercase letter"})
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, PasswordViolation{Code: ViolationMissingDigit, Message: "password must contain a digit"})
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, PasswordViolation{Code: ViolationMissingSymbol, Message: "password must contain a symbol"})
+	}
+
+	lower := strings.ToLower(password)
+	if p.ForbidPersonalInfo {
+		for _, part := range personalInfoParts(u) {
+			if strings.Contains(lower, part) {
+				violations = append(violations, PasswordViolation{Code: ViolationContainsPersonalInfo, Message: "password must not contain your name or username"})
+				break
+			}
+		}
+	}
+	if p.DenyList[lower] {
+		violations = append(violations, PasswordViolation{Code: ViolationCommonPassword, Message: "password is too common"})
+	}
+
+	if len(violations) != 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// CheckPasswordPolicy checks password against the current password policy
+func CheckPasswordPolicy(password string, u User) error {
+	return passwordPolicy.Check(password, u)
+}
@@ -0,0 +1,299 @@
+package wilhelmiina
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SchoolYear is a school year like "2021-2022", dates are unix times
+type SchoolYear struct {
+	SchoolYearID string `gorm:"primaryKey"`
+	Name         string
+	StartDate    int64
+	EndDate      int64
+}
+
+// Period is a part of a school year, e.g. one of the five periods of a lukio year. Groups belong to periods.
+type Period struct {
+	PeriodID     string `gorm:"primaryKey"`
+	SchoolYearID string `gorm:"index"`
+	Number       int
+	Name         string
+	StartDate    int64
+	EndDate      int64
+}
+
+var ErrInvalidDateRange = errors.New("end date must be after start date")
+var ErrSchoolYearOverlap = errors.New("school year overlaps another school year")
+
+// overlaps reports whether the date ranges [aStart, aEnd] and [bStart, bEnd] have any common dates
+func overlaps(aStart int64, aEnd int64, bStart int64, bEnd int64) bool {
+	return aStart <= bEnd && bStart <= aEnd
+}
+
+func NewSchoolYear(name string, startDate int64, endDate int64, db *gorm.DB) (SchoolYear, error) {
+	if endDate <= startDate {
+		return SchoolYear{}, ErrInvalidDateRange
+	}
+	years, err := GetSchoolYears(db)
+	if err != nil {
+		return SchoolYear{}, err
+	}
+	for _, y := range years {
+		if overlaps(startDate, endDate, y.StartDate, y.EndDate) {
+			return SchoolYear{}, ErrSchoolYearOverlap
+		}
+	}
+
+	year := SchoolYear{
+		SchoolYearID: uuid.New().String(),
+		Name:         name,
+		StartDate:    startDate,
+		EndDate:      endDate,
+	}
+	tx := db.Begin()
+	tx.Create(&year)
+	err = tx.Commit().Error
+	if err != nil {
+		return SchoolYear{}, err
+	}
+	return year, nil
+}
+
+var ErrSchoolYearNotFound = errors.New("school year not found")
+
+func GetSchoolYear(schoolYearID string, db *gorm.DB) (SchoolYear, error) {
+	var year SchoolYear
+	tx := db.Where("school_year_id = ?", schoolYearID).Limit(1).Find(&year)
+	if tx.Error != nil {
+		return SchoolYear{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return SchoolYear{}, ErrSchoolYearNotFound
+	}
+	return year, nil
+}
+
+// GetSchoolYears returns all school years, oldest first
+func GetSchoolYears(db *gorm.DB) ([]SchoolYear, error) {
+	years := []SchoolYear{}
+	tx := db.Order("start_date").Find(&years)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return years, nil
+}
+
+var ErrSchoolYearHasPeriods = errors.New("school year still has periods")
+
+// DeleteSchoolYear deletes a school year, its periods must be deleted first
+func DeleteSchoolYear(schoolYearID string, db *gorm.DB) error {
+	periods, err := GetPeriods(schoolYearID, db)
+	if err != nil {
+		return err
+	}
+	if len(periods) != 0 {
+		return ErrSchoolYearHasPeriods
+	}
+	tx := db.Begin()
+	tx.Where("school_year_id = ?", schoolYearID).Delete(&SchoolYear{})
+	return tx.Commit().Error
+}
+
+var ErrPeriodOutsideSchoolYear = errors.New("period is not within its school year")
+var ErrPeriodOverlap = errors.New("period overlaps another period of the school year")
+var ErrPeriodExists = errors.New("school year already has a period with that number")
+
+// NewPeriod adds a period to a school year. Periods must be within the school year and can't overlap each other.
+func NewPeriod(schoolYearID string, number int, name string, startDate int64, endDate int64, db *gorm.DB) (Period, error) {
+	if endDate <= startDate {
+		return Period{}, ErrInvalidDateRange
+	}
+	year, err := GetSchoolYear(schoolYearID, db)
+	if err != nil {
+		return Period{}, err
+	}
+	if startDate < year.StartDate || endDate > year.EndDate {
+		return Period{}, ErrPeriodOutsideSchoolYear
+	}
+	periods, err := GetPeriods(schoolYearID, db)
+	if err != nil {
+		return Period{}, err
+	}
+	for _, p := range periods {
+		if p.Number == number {
+			return Period{}, ErrPeriodExists
+		}
+		if overlaps(startDate, endDate, p.StartDate, p.EndDate) {
+			return Period{}, ErrPeriodOverlap
+		}
+	}
+
+	period := Period{
+		PeriodID:     uuid.New().String(),
+		SchoolYearID: schoolYearID,
+		Number:       number,
+		Name:         name,
+		StartDate:    startDate,
+		EndDate:      endDate,
+	}
+	tx := db.Begin()
+	tx.Create(&period)
+	err = tx.Commit().Error
+	if err != nil {
+		return Period{}, err
+	}
+	return period, nil
+}
+
+var ErrPeriodNotFound = errors.New("period not found")
+
+func GetPeriod(periodID string, db *gorm.DB) (Period, error) {
+	var period Period
+	tx := db.Where("period_id = ?", periodID).Limit(1).Find(&period)
+	if tx.Error != nil {
+		return Period{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return Period{}, ErrPeriodNotFound
+	}
+	return period, nil
+}
+
+// GetPeriods returns the periods of a school year in order
+func GetPeriods(schoolYearID string, db *gorm.DB) ([]Period, error) {
+	periods := []Period{}
+	tx := db.Where("school_year_id = ?", schoolYearID).Order("number").Find(&periods)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return periods, nil
+}
+
+// GetPeriodAt returns the period going on at the unix time t
+func GetPeriodAt(t int64, db *gorm.DB) (Period, error) {
+	var period Period
+	tx := db.Where("start_date <= ? AND end_date >= ?", t, t).Limit(1).Find(&period)
+	if tx.Error != nil {
+		return Period{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return Period{}, ErrPeriodNotFound
+	}
+	return period, nil
+}
+
+var ErrPeriodHasGroups = errors.New("period still has groups")
+
+// DeletePeriod deletes a period that has no groups
+func DeletePeriod(periodID string, db *gorm.DB) error {
+	var count int64
+	tx := db.Model(&Group{}).Where("period_id = ?", periodID).Count(&count)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if count != 0 {
+		return ErrPeriodHasGroups
+	}
+	tx = db.Begin()
+	tx.Where("period_id = ?", periodID).Delete(&Period{})
+	return tx.Commit().Error
+}
+
+var ErrGroupOutsidePeriod = errors.New("group dates are not within the period")
+
+// SetGroupPeriod moves a group to a period, the dates of the group must be within the period
+func SetGroupPeriod(groupID string, periodID string, db *gorm.DB) error {
+	var group Group
+	tx := db.Where("group_id = ?", groupID).Limit(1).Find(&group)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+	period, err := GetPeriod(periodID, db)
+	if err != nil {
+		return err
+	}
+	if group.StartDate < period.StartDate || group.EndDate > period.EndDate {
+		return ErrGroupOutsidePeriod
+	}
+
+	tx = db.Begin()
+	tx.Model(Group{}).Where("group_id = ?", groupID).Update("period_id", periodID)
+	return tx.Commit().Error
+}
+
+// NewGroupInPeriod creates a group that lasts for the whole period
+func NewGroupInPeriod(name string, CourseID string, periodID string, times []GroupTimeData, db *gorm.DB) (Group, error) {
+	period, err := GetPeriod(periodID, db)
+	if err != nil {
+		return Group{}, err
+	}
+	group, err := NewGroup(name, CourseID, period.StartDate, period.EndDate, times, db)
+	if err != nil {
+		return Group{}, err
+	}
+	err = SetGroupPeriod(group.GroupID, periodID, db)
+	if err != nil {
+		return Group{}, err
+	}
+	group.PeriodID = periodID
+	return group, nil
+}
+
+// GetGroupsInPeriod returns all groups of a period
+func GetGroupsInPeriod(periodID string, db *gorm.DB) ([]Group, error) {
+	groups := []Group{}
+	tx := db.Where("period_id = ?", periodID).Order("name").Find(&groups)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return groups, nil
+}
+
+// GetGroupsInSchoolYear returns all groups in the periods of a school year
+func GetGroupsInSchoolYear(schoolYearID string, db *gorm.DB) ([]Group, error) {
+	groups := []Group{}
+	tx := db.Where("period_id IN (?)", db.Model(&Period{}).Select("period_id").Where("school_year_id = ?", schoolYearID)).
+		Order("name").Find(&groups)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return groups, nil
+}
+
+// NewSchoolYearAs creates a school year if actor is allowed to do so
+func NewSchoolYearAs(actor User, name string, startDate int64, endDate int64, db *gorm.DB) (SchoolYear, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionPeriodManage, "", db); err != nil {
+		return SchoolYear{}, err
+	}
+	return NewSchoolYear(name, startDate, endDate, withAudit(db, actor, ActionPeriodManage))
+}
+
+// NewPeriodAs creates a period if actor is allowed to do so
+func NewPeriodAs(actor User, schoolYearID string, number int, name string, startDate int64, endDate int64, db *gorm.DB) (Period, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionPeriodManage, schoolYearID, db); err != nil {
+		return Period{}, err
+	}
+	return NewPeriod(schoolYearID, number, name, startDate, endDate, withAudit(db, actor, ActionPeriodManage))
+}
+
+// DeletePeriodAs deletes a period if actor is allowed to do so
+func DeletePeriodAs(actor User, periodID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionPeriodManage, periodID, db); err != nil {
+		return err
+	}
+	return DeletePeriod(periodID, withAudit(db, actor, ActionPeriodManage))
+}
+
+// SetGroupPeriodAs moves a group to a period if actor is allowed to do so
+func SetGroupPeriodAs(actor User, groupID string, periodID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupEdit, groupID, db); err != nil {
+		return err
+	}
+	return SetGroupPeriod(groupID, periodID, withAudit(db, actor, ActionGroupEdit))
+}
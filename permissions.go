@@ -0,0 +1,244 @@
+package wilhelmiina
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// Action is something a user can try to do, for example "group.assign_teacher"
+type Action string
+
+const (
+	ActionUserCreate         Action = "user.create"
+	ActionUserEdit           Action = "user.edit"
+	ActionUserChangePassword Action = "user.change_password"
+	ActionUserDelete         Action = "user.delete"
+	ActionUserUnlock         Action = "user.unlock"
+	ActionUserSetStatus      Action = "user.set_status"
+	ActionUserPurge          Action = "user.purge"
+	// Editing contact details of a profile, users can change their own
+	ActionUserEditProfile Action = "user.edit_profile"
+
+	ActionSubjectCreate Action = "subject.create"
+	ActionSubjectEdit   Action = "subject.edit"
+	ActionSubjectDelete Action = "subject.delete"
+
+	ActionCourseCreate Action = "course.create"
+	ActionCourseEdit   Action = "course.edit"
+	ActionCourseDelete Action = "course.delete"
+	// Recording course grades of students, the target is the course
+	ActionGradeRecord Action = "grade.record"
+
+	ActionGroupCreate        Action = "group.create"
+	ActionGroupEdit          Action = "group.edit"
+	ActionGroupDelete        Action = "group.delete"
+	ActionGroupAssignTeacher Action = "group.assign_teacher"
+
+	// Reserving a place in a group for yourself
+	ActionReservationCreateOwn Action = "reservation.create_own"
+	ActionReservationCancelOwn Action = "reservation.cancel_own"
+	// Adding or removing other users to and from a group, the target is the group
+	ActionReservationCreate Action = "reservation.create"
+	ActionReservationCancel Action = "reservation.cancel"
+
+	ActionGuardianLink Action = "guardian.link"
+
+	// Managing school years and periods
+	ActionPeriodManage Action = "period.manage"
+	// Managing enrollment windows and selection rounds
+	ActionEnrollmentManage Action = "enrollment.manage"
+
+	ActionClassCreate  Action = "class.create"
+	ActionClassEdit    Action = "class.edit"
+	ActionClassDelete  Action = "class.delete"
+	ActionClassMembers Action = "class.members"
+	ActionClassMessage Action = "class.message"
+
+	ActionMessageSend   Action = "message.send"
+	ActionMessageDelete Action = "message.delete"
+
+	// Creating service accounts and managing their API keys
+	ActionAPIKeyManage Action = "apikey.manage"
+)
+
+// OwnershipCheck reports whether actor owns the entity identified by targetID
+type OwnershipCheck func(actor User, targetID string, db *gorm.DB) (bool, error)
+
+// Permission describes who may perform an action.
+// Users with a role in Roles are always allowed, users with a role in OwnerRoles are allowed only if IsOwner returns true for the target.
+// If Limit is set it must also return true for the target, whichever role allowed the actor.
+type Permission struct {
+	Roles      []Role
+	OwnerRoles []Role
+	IsOwner    OwnershipCheck
+	Limit      OwnershipCheck
+}
+
+// Authorizer maps actions to permissions
+type Authorizer struct {
+	permissions map[Action]Permission
+}
+
+var ErrForbidden = errors.New("user is not allowed to do that")
+
+var allRoles = []Role{Student, Guardian, Teacher, Moderator, Admin}
+var staffRoles = []Role{Moderator, Admin}
+
+// Owner is the user themselves
+func isSelf(actor User, targetID string, db *gorm.DB) (bool, error) {
+	return actor.UUID == targetID, nil
+}
+
+// Target user doesn't have a higher role than the actor, so moderators can't manage admins
+func isNotHigherRole(actor User, UUID string, db *gorm.DB) (bool, error) {
+	target, err := GetUser(UUID, db)
+	if err == ErrUserNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return target.Role <= actor.Role, nil
+}
+
+// Owner is the teacher of the group
+func isGroupTeacher(actor User, groupID string, db *gorm.DB) (bool, error) {
+	var g Group
+	tx := db.First(&g, "group_id = ?", groupID)
+	if tx.RowsAffected == 0 {
+		return false, nil
+	}
+	return g.TeacherID == actor.UUID, nil
+}
+
+// Owner is the sender of the message
+func isMessageSender(actor User, messageID string, db *gorm.DB) (bool, error) {
+	m, err := GetMessage(messageID, db)
+	if err == ErrMessageNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return m.From == actor.UUID, nil
+}
+
+// NewAuthorizer returns an authorizer with the default permissions of wilhelmiina
+func NewAuthorizer() *Authorizer {
+	a := &Authorizer{permissions: map[Action]Permission{}}
+
+	a.SetPermission(ActionUserCreate, Permission{Roles: []Role{Admin}})
+	a.SetPermission(ActionUserEdit, Permission{Roles: staffRoles, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserChangePassword, Permission{Roles: []Role{Admin}, OwnerRoles: allRoles, IsOwner: isSelf, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserDelete, Permission{Roles: []Role{Admin}, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserUnlock, Permission{Roles: []Role{Admin}, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserSetStatus, Permission{Roles: staffRoles, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserPurge, Permission{Roles: []Role{Admin}, Limit: isNotHigherRole})
+	a.SetPermission(ActionUserEditProfile, Permission{Roles: staffRoles, OwnerRoles: allRoles, IsOwner: isSelf, Limit: isNotHigherRole})
+
+	a.SetPermission(ActionSubjectCreate, Permission{Roles: staffRoles})
+	a.SetPermission(ActionSubjectEdit, Permission{Roles: staffRoles})
+	a.SetPermission(ActionSubjectDelete, Permission{Roles: staffRoles})
+
+	a.SetPermission(ActionCourseCreate, Permission{Roles: staffRoles})
+	a.SetPermission(ActionCourseEdit, Permission{Roles: staffRoles})
+	a.SetPermission(ActionCourseDelete, Permission{Roles: staffRoles})
+	a.SetPermission(ActionGradeRecord, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isCourseTeacher})
+
+	a.SetPermission(ActionGroupCreate, Permission{Roles: staffRoles})
+	a.SetPermission(ActionGroupEdit, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isGroupTeacher})
+	a.SetPermission(ActionGroupDelete, Permission{Roles: staffRoles})
+	a.SetPermission(ActionGroupAssignTeacher, Permission{Roles: staffRoles})
+
+	a.SetPermission(ActionReservationCreateOwn, Permission{Roles: []Role{Student}})
+	a.SetPermission(ActionReservationCancelOwn, Permission{Roles: []Role{Student}})
+	a.SetPermission(ActionReservationCreate, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isGroupTeacher})
+	a.SetPermission(ActionReservationCancel, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isGroupTeacher})
+
+	a.SetPermission(ActionGuardianLink, Permission{Roles: staffRoles})
+
+	a.SetPermission(ActionPeriodManage, Permission{Roles: staffRoles})
+	a.SetPermission(ActionEnrollmentManage, Permission{Roles: staffRoles})
+
+	a.SetPermission(ActionClassCreate, Permission{Roles: staffRoles})
+	a.SetPermission(ActionClassEdit, Permission{Roles: staffRoles})
+	a.SetPermission(ActionClassDelete, Permission{Roles: staffRoles})
+	a.SetPermission(ActionClassMembers, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isHomeroomTeacher})
+	a.SetPermission(ActionClassMessage, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isHomeroomTeacher})
+
+	a.SetPermission(ActionMessageSend, Permission{Roles: allRoles})
+	a.SetPermission(ActionMessageDelete, Permission{Roles: staffRoles, OwnerRoles: allRoles, IsOwner: isMessageSender})
+
+	a.SetPermission(ActionAPIKeyManage, Permission{Roles: []Role{Admin}})
+	return a
+}
+
+// DefaultAuthorizer is used by all of the ...As functions. Change its permissions to customize access control for the whole app.
+var DefaultAuthorizer = NewAuthorizer()
+
+// SetPermission replaces the permission for action
+func (a *Authorizer) SetPermission(action Action, p Permission) {
+	a.permissions[action] = p
+}
+
+// GetPermission returns the permission for action, ok is false if action is unknown
+func (a *Authorizer) GetPermission(action Action) (p Permission, ok bool) {
+	p, ok = a.permissions[action]
+	return
+}
+
+func hasRole(role Role, roles []Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAction(action Action, actions []Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether actor may perform action on the target. Unknown actions and inactive users are always denied,
+// and so are actions outside the scopes of an actor authenticated with an API key.
+func (a *Authorizer) Can(actor User, action Action, targetID string, db *gorm.DB) (bool, error) {
+	p, ok := a.permissions[action]
+	if !ok || !actor.IsActive() {
+		return false, nil
+	}
+	if actor.Scopes != nil && !hasAction(action, actor.Scopes) {
+		return false, nil
+	}
+	if p.Limit != nil {
+		ok, err := p.Limit(actor, targetID, db)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if hasRole(actor.Role, p.Roles) {
+		return true, nil
+	}
+	if p.IsOwner == nil || !hasRole(actor.Role, p.OwnerRoles) {
+		return false, nil
+	}
+	return p.IsOwner(actor, targetID, db)
+}
+
+// Authorize is like Can but returns ErrForbidden if actor is not allowed to perform action
+func (a *Authorizer) Authorize(actor User, action Action, targetID string, db *gorm.DB) error {
+	ok, err := a.Can(actor, action, targetID, db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type PrerequisiteKind int
+
+// AllOf rules need every listed course, AnyOf rules need at least one of them
+const AllOf PrerequisiteKind = 0
+const AnyOf PrerequisiteKind = 1
+
+// CoursePrerequisite is a rule that must be met before a student can join a group of the course.
+// A course can have many rules and all of them must be met.
+type CoursePrerequisite struct {
+	gorm.Model
+	CourseID        string `gorm:"index"`
+	Kind            PrerequisiteKind
+	RequiredCourses string // Space separated list of course ids
+	MinGrade        int    // 0 means any passing grade
+}
+
+func (p CoursePrerequisite) GetRequiredCourses() []string {
+	return strings.Fields(p.RequiredCourses)
+}
+
+var ErrInvalidPrerequisite = errors.New("invalid prerequisite")
+var ErrPrerequisiteCycle = errors.New("prerequisite would make courses depend on each other")
+
+// AddPrerequisite adds a rule to a course, see CoursePrerequisite
+func AddPrerequisite(courseID string, kind PrerequisiteKind, required []string, minGrade int, db *gorm.DB) (CoursePrerequisite, error) {
+	if (kind != AllOf && kind != AnyOf) || len(required) == 0 {
+		return CoursePrerequisite{}, ErrInvalidPrerequisite
+	}
+	if minGrade != 0 && (minGrade < PASSING_GRADE || minGrade > MAX_GRADE) {
+		return CoursePrerequisite{}, ErrInvalidGrade
+	}
+	if _, err := GetCourse(courseID, db); err != nil {
+		return CoursePrerequisite{}, err
+	}
+	for _, id := range required {
+		if _, err := GetCourse(id, db); err != nil {
+			return CoursePrerequisite{}, err
+		}
+		dependsOn, err := requiresCourse(id, courseID, map[string]bool{}, db)
+		if err != nil {
+			return CoursePrerequisite{}, err
+		}
+		if id == courseID || dependsOn {
+			return CoursePrerequisite{}, ErrPrerequisiteCycle
+		}
+	}
+
+	p := CoursePrerequisite{
+		CourseID:        courseID,
+		Kind:            kind,
+		RequiredCourses: strings.Join(required, " "),
+		MinGrade:        minGrade,
+	}
+	tx := db.Begin()
+	tx.Create(&p)
+	err := tx.Commit().Error
+	if err != nil {
+		return CoursePrerequisite{}, err
+	}
+	return p, nil
+}
+
+// requiresCourse reports whether courseID has target as a direct or indirect prerequisite
+func requiresCourse(courseID string, target string, seen map[string]bool, db *gorm.DB) (bool, error) {
+	if seen[courseID] {
+		return false, nil
+	}
+	seen[courseID] = true
+	rules, err := GetPrerequisites(courseID, db)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rules {
+		for _, id := range r.GetRequiredCourses() {
+			if id == target {
+				return true, nil
+			}
+			found, err := requiresCourse(id, target, seen, db)
+			if err != nil || found {
+				return found, err
+			}
+		}
+	}
+	return false, nil
+}
+
+var ErrPrerequisiteNotFound = errors.New("prerequisite not found")
+
+func GetPrerequisite(ID uint, db *gorm.DB) (CoursePrerequisite, error) {
+	var p CoursePrerequisite
+	tx := db.Where("id = ?", ID).Limit(1).Find(&p)
+	if tx.Error != nil {
+		return CoursePrerequisite{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return CoursePrerequisite{}, ErrPrerequisiteNotFound
+	}
+	return p, nil
+}
+
+// deletePrerequisitesOf removes the rules of a deleted course and drops it from the rules of other courses.
+// Rules left without any required courses are deleted.
+func deletePrerequisitesOf(courseID string, tx *gorm.DB) error {
+	if err := tx.Where("course_id = ?", courseID).Delete(&CoursePrerequisite{}).Error; err != nil {
+		return err
+	}
+	var rules []CoursePrerequisite
+	if err := tx.Where("required_courses LIKE ?", "%"+courseID+"%").Find(&rules).Error; err != nil {
+		return err
+	}
+	for _, r := range rules {
+		var left []string
+		for _, id := range r.GetRequiredCourses() {
+			if id != courseID {
+				left = append(left, id)
+			}
+		}
+		var err error
+		if len(left) == 0 {
+			err = tx.Delete(&r).Error
+		} else {
+			err = tx.Model(&r).Update("required_courses", strings.Join(left, " ")).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RemovePrerequisite(ID uint, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Where("id = ?", ID).Delete(&CoursePrerequisite{})
+	return tx.Commit().Error
+}
+
+// GetPrerequisites returns the prerequisite rules of a course
+func GetPrerequisites(courseID string, db *gorm.DB) ([]CoursePrerequisite, error) {
+	rules := []CoursePrerequisite{}
+	tx := db.Where("course_id = ?", courseID).Order("id").Find(&rules)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return rules, nil
+}
+
+var ErrPrerequisitesNotMet = errors.New("prerequisites not met")
+
+// MissingPrerequisite is a rule the student doesn't meet, Courses are the required courses the student hasn't passed with a good enough grade
+type MissingPrerequisite struct {
+	Rule    CoursePrerequisite
+	Courses []Course
+}
+
+// PrerequisitesError lists the rules a student doesn't meet. It unwraps to ErrPrerequisitesNotMet.
+type PrerequisitesError struct {
+	CourseID string
+	Missing  []MissingPrerequisite
+}
+
+func (e *PrerequisitesError) Error() string {
+	var parts []string
+	for _, m := range e.Missing {
+		var names []string
+		for _, c := range m.Courses {
+			names = append(names, c.CourseNameShort)
+		}
+		part := "all of "
+		if m.Rule.Kind == AnyOf {
+			part = "one of "
+		}
+		part += strings.Join(names, ", ")
+		if m.Rule.MinGrade != 0 {
+			part += fmt.Sprintf(" with grade %d or better", m.Rule.MinGrade)
+		}
+		parts = append(parts, part)
+	}
+	return ErrPrerequisitesNotMet.Error() + ": requires " + strings.Join(parts, "; ")
+}
+
+func (e *PrerequisitesError) Unwrap() error {
+	return ErrPrerequisitesNotMet
+}
+
+// CheckPrerequisites returns a *PrerequisitesError if the student doesn't meet every prerequisite rule of the course
+func CheckPrerequisites(UUID string, courseID string, db *gorm.DB) error {
+	rules, err := GetPrerequisites(courseID, db)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	best, err := GetBestGrades(UUID, db)
+	if err != nil {
+		return err
+	}
+
+	var missing []MissingPrerequisite
+	for _, r := range rules {
+		minGrade := r.MinGrade
+		if minGrade == 0 {
+			minGrade = PASSING_GRADE
+		}
+		var notPassed []string
+		for _, id := range r.GetRequiredCourses() {
+			if best[id] < minGrade {
+				notPassed = append(notPassed, id)
+			}
+		}
+		required := len(r.GetRequiredCourses())
+		if (r.Kind == AllOf && len(notPassed) == 0) || (r.Kind == AnyOf && len(notPassed) < required) {
+			continue
+		}
+		m := MissingPrerequisite{Rule: r}
+		for _, id := range notPassed {
+			c, err := GetCourse(id, db)
+			if err == ErrCourseNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			m.Courses = append(m.Courses, c)
+		}
+		missing = append(missing, m)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return &PrerequisitesError{CourseID: courseID, Missing: missing}
+}
+
+// checkReservationPrerequisites checks the prerequisites of the course of a group when a student joins it
+func checkReservationPrerequisites(UUID string, groupID string, db *gorm.DB) error {
+	user, err := GetUser(UUID, db)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Role != Student {
+		return nil
+	}
+	var group Group
+	tx := db.Where("group_id = ?", groupID).Limit(1).Find(&group)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil
+	}
+	return CheckPrerequisites(UUID, group.CourseID, db)
+}
+
+// AddPrerequisiteAs adds a prerequisite rule if actor is allowed to do so
+func AddPrerequisiteAs(actor User, courseID string, kind PrerequisiteKind, required []string, minGrade int, db *gorm.DB) (CoursePrerequisite, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, courseID, db); err != nil {
+		return CoursePrerequisite{}, err
+	}
+	return AddPrerequisite(courseID, kind, required, minGrade, withAudit(db, actor, ActionCourseEdit))
+}
+
+// RemovePrerequisiteAs removes a prerequisite rule if actor is allowed to do so
+func RemovePrerequisiteAs(actor User, ID uint, db *gorm.DB) error {
+	rule, err := GetPrerequisite(ID, db)
+	if err != nil {
+		return err
+	}
+	if err := DefaultAuthorizer.Authorize(actor, ActionCourseEdit, rule.CourseID, db); err != nil {
+		return err
+	}
+	return RemovePrerequisite(ID, withAudit(db, actor, ActionCourseEdit))
+}
@@ -0,0 +1,290 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserProfile holds the personal details of a user that aren't needed for logging in
+type UserProfile struct {
+	UUID  string `gorm:"primaryKey"`
+	Email string
+	Phone string
+	// A pointer so that the unique index doesn't apply to users without a student number
+	StudentNumber     *string `gorm:"uniqueIndex"`
+	DateOfBirth       int64   // Unix time, 0 if not known
+	HomeroomClass     string
+	PreferredLanguage string // ISO 639-1 code like "fi"
+}
+
+// ProfileData is a profile as shown to other users. Fields the viewer is not allowed to see are left empty.
+type ProfileData struct {
+	Email             string
+	Phone             string
+	StudentNumber     string
+	DateOfBirth       int64
+	HomeroomClass     string
+	PreferredLanguage string
+}
+
+// ProfileField is a set of profile fields
+type ProfileField int
+
+const (
+	ProfileEmail ProfileField = 1 << iota
+	ProfilePhone
+	ProfileStudentNumber
+	ProfileDateOfBirth
+	ProfileHomeroomClass
+	ProfilePreferredLanguage
+)
+
+const AllProfileFields = ProfileEmail | ProfilePhone | ProfileStudentNumber | ProfileDateOfBirth | ProfileHomeroomClass | ProfilePreferredLanguage
+
+// The profile fields of other users that users with each role can see.
+// Everyone sees their own profile in full, and so do guardians the profiles of their wards.
+var profileVisibility = map[Role]ProfileField{
+	Student:   ProfileEmail,
+	Guardian:  ProfileEmail,
+	Teacher:   AllProfileFields &^ ProfileDateOfBirth,
+	Moderator: AllProfileFields,
+	Admin:     AllProfileFields,
+}
+
+// SetProfileVisibility changes which profile fields of other users are shown to users with role
+func SetProfileVisibility(role Role, fields ProfileField) {
+	profileVisibility[role] = fields
+}
+
+var ErrInvalidEmail = errors.New("invalid email address")
+var ErrInvalidPhone = errors.New("invalid phone number")
+var ErrInvalidStudentNumber = errors.New("invalid student number")
+var ErrInvalidDateOfBirth = errors.New("invalid date of birth")
+var ErrInvalidHomeroomClass = errors.New("invalid homeroom class")
+var ErrInvalidLanguage = errors.New("invalid language code")
+
+const MAX_HOMEROOM_CLASS_LEN = 32
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+
+// Finnish national student numbers (oppijanumero) are OIDs like 1.2.246.562.24.12345678901
+var studentNumberPattern = regexp.MustCompile(`^1\.2\.246\.562\.24\.[0-9]{11}$`)
+var languagePattern = regexp.MustCompile(`^[a-z]{2}$`)
+
+// Earliest accepted date of birth
+var minDateOfBirth = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// normalizeProfile trims the fields, removes separators from the phone number and checks every field. Empty fields are always valid.
+func normalizeProfile(p ProfileData) (ProfileData, error) {
+	p.Email = strings.TrimSpace(p.Email)
+	p.Phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(p.Phone)
+	p.StudentNumber = strings.TrimSpace(p.StudentNumber)
+	p.HomeroomClass = strings.TrimSpace(p.HomeroomClass)
+	p.PreferredLanguage = strings.ToLower(strings.TrimSpace(p.PreferredLanguage))
+
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Name != "" || addr.Address != p.Email {
+			return ProfileData{}, ErrInvalidEmail
+		}
+	}
+	if p.Phone != "" && !phonePattern.MatchString(p.Phone) {
+		return ProfileData{}, ErrInvalidPhone
+	}
+	if p.StudentNumber != "" && !studentNumberPattern.MatchString(p.StudentNumber) {
+		return ProfileData{}, ErrInvalidStudentNumber
+	}
+	if p.DateOfBirth != 0 && (p.DateOfBirth < minDateOfBirth || p.DateOfBirth > time.Now().Unix()) {
+		return ProfileData{}, ErrInvalidDateOfBirth
+	}
+	if len(p.HomeroomClass) > MAX_HOMEROOM_CLASS_LEN {
+		return ProfileData{}, ErrInvalidHomeroomClass
+	}
+	if p.PreferredLanguage != "" && !languagePattern.MatchString(p.PreferredLanguage) {
+		return ProfileData{}, ErrInvalidLanguage
+	}
+	return p, nil
+}
+
+func (p UserProfile) toData() ProfileData {
+	data := ProfileData{
+		Email:             p.Email,
+		Phone:             p.Phone,
+		DateOfBirth:       p.DateOfBirth,
+		HomeroomClass:     p.HomeroomClass,
+		PreferredLanguage: p.PreferredLanguage,
+	}
+	if p.StudentNumber != nil {
+		data.StudentNumber = *p.StudentNumber
+	}
+	return data
+}
+
+// getUserProfile returns the stored profile of a user, or an empty one if the user has none
+func getUserProfile(UUID string, db *gorm.DB) (UserProfile, error) {
+	p := UserProfile{UUID: UUID}
+	tx := db.Where("uuid = ?", UUID).Limit(1).Find(&p)
+	if tx.Error != nil {
+		return UserProfile{}, tx.Error
+	}
+	return p, nil
+}
+
+var ErrStudentNumberTaken = errors.New("student number belongs to another user")
+
+// SetProfile validates and saves the profile of a user, replacing the old one
+func SetProfile(UUID string, p ProfileData, db *gorm.DB) error {
+	if _, err := GetUser(UUID, db); err != nil {
+		return err
+	}
+	p, err := normalizeProfile(p)
+	if err != nil {
+		return err
+	}
+
+	profile := UserProfile{
+		UUID:              UUID,
+		Email:             p.Email,
+		Phone:             p.Phone,
+		DateOfBirth:       p.DateOfBirth,
+		HomeroomClass:     p.HomeroomClass,
+		PreferredLanguage: p.PreferredLanguage,
+	}
+	if p.StudentNumber != "" {
+		owner, err := GetUserByStudentNumber(p.StudentNumber, db)
+		if err == nil && owner.UUID != UUID {
+			return ErrStudentNumberTaken
+		}
+		if err != nil && err != ErrUserNotFound {
+			return err
+		}
+		profile.StudentNumber = &p.StudentNumber
+	}
+
+	// The unique index catches a concurrent write that took the student number after the check above
+	tx := db.Begin()
+	if err := tx.Save(&profile).Error; err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err) {
+			return ErrStudentNumberTaken
+		}
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// GetProfile returns the whole profile of a user. Users without a saved profile get an empty one.
+func GetProfile(UUID string, db *gorm.DB) (ProfileData, error) {
+	if _, err := GetUser(UUID, db); err != nil {
+		return ProfileData{}, err
+	}
+	p, err := getUserProfile(UUID, db)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	return p.toData(), nil
+}
+
+// GetUserByStudentNumber finds the user with a national student number
+func GetUserByStudentNumber(number string, db *gorm.DB) (User, error) {
+	var p UserProfile
+	tx := db.Where("student_number = ?", strings.TrimSpace(number)).Limit(1).Find(&p)
+	if tx.Error != nil {
+		return User{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return GetUser(p.UUID, db)
+}
+
+// visibleProfileFields returns the fields of target's profile that viewer is allowed to see
+func visibleProfileFields(viewer User, target User, db *gorm.DB) (ProfileField, error) {
+	if !viewer.IsActive() {
+		return 0, nil
+	}
+	if viewer.UUID == target.UUID {
+		return AllProfileFields, nil
+	}
+	guardian, err := IsGuardianOf(viewer.UUID, target.UUID, db)
+	if err != nil {
+		return 0, err
+	}
+	if guardian {
+		return AllProfileFields, nil
+	}
+	return profileVisibility[viewer.Role], nil
+}
+
+// filter empties the fields that are not in fields
+func (p ProfileData) filter(fields ProfileField) ProfileData {
+	if fields&ProfileEmail == 0 {
+		p.Email = ""
+	}
+	if fields&ProfilePhone == 0 {
+		p.Phone = ""
+	}
+	if fields&ProfileStudentNumber == 0 {
+		p.StudentNumber = ""
+	}
+	if fields&ProfileDateOfBirth == 0 {
+		p.DateOfBirth = 0
+	}
+	if fields&ProfileHomeroomClass == 0 {
+		p.HomeroomClass = ""
+	}
+	if fields&ProfilePreferredLanguage == 0 {
+		p.PreferredLanguage = ""
+	}
+	return p
+}
+
+// ToDataFor is like ToData but also includes the parts of the profile that viewer is allowed to see
+func (u *User) ToDataFor(viewer User, db *gorm.DB) (UserData, error) {
+	data := u.ToData()
+	fields, err := visibleProfileFields(viewer, *u, db)
+	if err != nil {
+		return UserData{}, err
+	}
+	if fields == 0 {
+		return data, nil
+	}
+	p, err := getUserProfile(u.UUID, db)
+	if err != nil {
+		return UserData{}, err
+	}
+	profile := p.toData().filter(fields)
+	data.Profile = &profile
+	return data, nil
+}
+
+// SetProfileAs saves the profile of a user if actor is allowed to do so.
+// Users editing their own profile can only change their contact details and language, the rest is managed by the staff.
+func SetProfileAs(actor User, UUID string, p ProfileData, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserEditProfile, UUID, db); err != nil {
+		return err
+	}
+	staff, err := DefaultAuthorizer.Can(actor, ActionUserEdit, UUID, db)
+	if err != nil {
+		return err
+	}
+	if !staff {
+		old, err := GetProfile(UUID, db)
+		if err != nil {
+			return err
+		}
+		normalized, err := normalizeProfile(p)
+		if err != nil {
+			return err
+		}
+		if normalized.StudentNumber != old.StudentNumber || normalized.DateOfBirth != old.DateOfBirth || normalized.HomeroomClass != old.HomeroomClass {
+			return ErrForbidden
+		}
+	}
+	return SetProfile(UUID, p, withAudit(db, actor, ActionUserEditProfile))
+}
@@ -0,0 +1,136 @@
+package wilhelmiina
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type UserSort int
+
+const SortBySurname UserSort = 0
+const SortByFirstname UserSort = 1
+
+const DEFAULT_PAGE_SIZE = 50
+const MAX_PAGE_SIZE = 500
+
+// UserQuery describes which users to list. Empty fields don't filter anything.
+type UserQuery struct {
+	Roles    []Role
+	Statuses []UserStatus
+	// Matches the beginning of the firstname, surname or username, case-insensitively also for letters like Ä
+	NamePrefix string
+	// Only members of this group
+	GroupID string
+	SortBy  UserSort
+	// Page size, DEFAULT_PAGE_SIZE if 0
+	Limit int
+	// NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// UserPage is one page of query results. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []UserData
+	NextCursor string
+}
+
+// The position of the last user on a page, users are sorted by (First, Second, UUID)
+type userCursor struct {
+	Sort   UserSort
+	First  string
+	Second string
+	UUID   string
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(c userCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (userCursor, error) {
+	var c userCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return userCursor{}, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return userCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// QueryUsers lists users matching the query one page at a time. The pagination is cursor based,
+// so pages stay stable even if users are added or removed while browsing.
+func QueryUsers(q UserQuery, db *gorm.DB) (UserPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DEFAULT_PAGE_SIZE
+	}
+	if limit > MAX_PAGE_SIZE {
+		limit = MAX_PAGE_SIZE
+	}
+	first, second := "surname", "firstname"
+	if q.SortBy == SortByFirstname {
+		first, second = "firstname", "surname"
+	}
+
+	tx := db.Model(&User{})
+	if len(q.Roles) != 0 {
+		tx = tx.Where("role IN ?", q.Roles)
+	}
+	if len(q.Statuses) != 0 {
+		tx = tx.Where("status IN ?", q.Statuses)
+	}
+	if q.NamePrefix != "" {
+		prefix := escapeLike(NormalizeUsername(q.NamePrefix)) + "%"
+		tx = tx.Where(`(firstname_key LIKE ? ESCAPE '\' OR surname_key LIKE ? ESCAPE '\' OR username_key LIKE ? ESCAPE '\')`,
+			prefix, prefix, prefix)
+	}
+	if q.GroupID != "" {
+		tx = tx.Where("uuid IN (?)", db.Model(&GroupReservation{}).Select("reserver_uuid").Where("group_id = ?", q.GroupID))
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return UserPage{}, err
+		}
+		if c.Sort != q.SortBy {
+			return UserPage{}, ErrInvalidCursor
+		}
+		tx = tx.Where(
+			"("+first+" > ? OR ("+first+" = ? AND "+second+" > ?) OR ("+first+" = ? AND "+second+" = ? AND uuid > ?))",
+			c.First, c.First, c.Second, c.First, c.Second, c.UUID,
+		)
+	}
+
+	var users []User
+	res := tx.Order(first).Order(second).Order("uuid").Limit(limit + 1).Find(&users)
+	if res.Error != nil {
+		return UserPage{}, res.Error
+	}
+
+	page := UserPage{Users: []UserData{}}
+	if len(users) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		c := userCursor{Sort: q.SortBy, First: last.Surname, Second: last.Firstname, UUID: last.UUID}
+		if q.SortBy == SortByFirstname {
+			c.First, c.Second = last.Firstname, last.Surname
+		}
+		page.NextCursor = encodeCursor(c)
+	}
+	for _, u := range users {
+		page.Users = append(page.Users, u.ToData())
+	}
+	return page, nil
+}
@@ -0,0 +1,176 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type TokenKind int
+
+const ResetToken TokenKind = 0
+const InvitationToken TokenKind = 1
+
+var PasswordResetTokenLifetime = time.Hour
+var InvitationTokenLifetime = 7 * 24 * time.Hour
+
+// PasswordResetToken lets a user choose a new password without knowing the old one. Like sessions, only the hash of the token is stored.
+type PasswordResetToken struct {
+	TokenID   string `gorm:"primaryKey"`
+	UUID      string `gorm:"index"`
+	Kind      TokenKind
+	CreatedAt int64
+	ExpiresAt int64
+	Used      bool
+	UsedAt    int64
+}
+
+func newResetToken(UUID string, kind TokenKind, lifetime time.Duration, now time.Time) (string, PasswordResetToken, error) {
+	token, err := genToken()
+	if err != nil {
+		return "", PasswordResetToken{}, err
+	}
+	t := PasswordResetToken{
+		TokenID:   hashToken(token),
+		UUID:      UUID,
+		Kind:      kind,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	}
+	return token, t, nil
+}
+
+func issueToken(UUID string, kind TokenKind, lifetime time.Duration, db *gorm.DB) (string, error) {
+	u, err := GetUser(UUID, db)
+	if err != nil {
+		return "", err
+	}
+	if u.IsService {
+		return "", ErrServiceAccount
+	}
+	now := time.Now()
+	token, t, err := newResetToken(UUID, kind, lifetime, now)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the newest token of a user is valid
+	tx := db.Begin()
+	tx.Model(PasswordResetToken{}).Where("uuid = ? AND used = ?", UUID, false).
+		Updates(map[string]interface{}{"used": true, "used_at": now.Unix()})
+	tx.Create(&t)
+	if kind == InvitationToken {
+		tx.Model(User{}).Where("uuid = ?", UUID).Update("must_change_password", true)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IssuePasswordResetToken creates a single use token the user can use to reset their password. Send it to the user e.g. as a link in an email.
+func IssuePasswordResetToken(UUID string, db *gorm.DB) (string, error) {
+	return issueToken(UUID, ResetToken, PasswordResetTokenLifetime, db)
+}
+
+// IssueInvitationToken creates a longer lived token for the first login of a new user. The user can't log in with a password before redeeming it.
+func IssueInvitationToken(UUID string, db *gorm.DB) (string, error) {
+	return issueToken(UUID, InvitationToken, InvitationTokenLifetime, db)
+}
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrTokenExpired = errors.New("token has expired")
+var ErrTokenUsed = errors.New("token has already been used")
+
+// RedeemPasswordResetToken sets a new password for the owner of the token. All sessions of the user are revoked and a possible lockout is cleared.
+func RedeemPasswordResetToken(token string, newpass string, db *gorm.DB) error {
+	var t PasswordResetToken
+	res := db.First(&t, "token_id = ?", hashToken(token))
+	if res.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	if t.Used {
+		return ErrTokenUsed
+	}
+	now := time.Now()
+	if now.Unix() >= t.ExpiresAt {
+		return ErrTokenExpired
+	}
+	newHash, err := newPasswordHash(newpass, t.UUID, db)
+	if err != nil {
+		return err
+	}
+
+	// The token is marked used only if nobody else did it first, and the password only changes together with that
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(PasswordResetToken{}).Where("token_id = ? AND used = ?", t.TokenID, false).
+			Updates(map[string]interface{}{"used": true, "used_at": now.Unix()})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrTokenUsed
+		}
+		res = tx.Model(User{}).Where("uuid = ?", t.UUID).
+			Updates(map[string]interface{}{"password": newHash, "must_change_password": false})
+		return res.Error
+	})
+	if err != nil {
+		return err
+	}
+	err = RevokeAllSessionsForUser(t.UUID, db)
+	if err != nil {
+		return err
+	}
+	return UnlockUser(t.UUID, db)
+}
+
+// SetMustChangePassword sets whether the user has to change their password the next time they log in
+func SetMustChangePassword(UUID string, mustChange bool, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Model(User{}).Where("uuid = ?", UUID).Update("must_change_password", mustChange)
+	return tx.Commit().Error
+}
+
+var ErrPasswordNotChanged = errors.New("new password must be different from the old one")
+var ErrInvitationPending = errors.New("user must set their password with their invitation token")
+
+// hasPendingInvitation reports whether the user has an invitation token they haven't redeemed. Expired invitations count too, a new one must be issued.
+func hasPendingInvitation(UUID string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&PasswordResetToken{}).Where("uuid = ? AND kind = ? AND used = ?", UUID, InvitationToken, false).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// ChangeExpiredPassword is used when Login returned ErrPasswordChangeRequired. It checks the credentials just like LoginWithCode, changes the password and returns a new session token.
+// Invited users must use RedeemPasswordResetToken instead, they get ErrInvitationPending.
+func ChangeExpiredPassword(username string, oldpass string, code string, newpass string, sourceKey string, db *gorm.DB) (string, error) {
+	user, err := authenticate(username, oldpass, code, sourceKey, db)
+	if err != nil {
+		return "", err
+	}
+	invited, err := hasPendingInvitation(user.UUID, db)
+	if err != nil {
+		return "", err
+	}
+	if invited {
+		return "", ErrInvitationPending
+	}
+	if oldpass == newpass {
+		return "", ErrPasswordNotChanged
+	}
+	err = ChangePassword(newpass, user.UUID, db)
+	if err != nil {
+		return "", err
+	}
+	err = SetMustChangePassword(user.UUID, false, db)
+	if err != nil {
+		return "", err
+	}
+	return CreateSession(user.UUID, db)
+}
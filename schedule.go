@@ -0,0 +1,153 @@
+package wilhelmiina
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ScheduleLocation is the time zone the times of day in GroupTime are in
+var ScheduleLocation = time.Local
+
+// Lesson is a single lesson of a group on a certain date, Start and End are unix times.
+// UserID is the student or teacher whose lesson it is, for guardians it tells which ward the lesson belongs to.
+type Lesson struct {
+	GroupID   string
+	GroupName string
+	CourseID  string
+	TeacherID string
+	UserID    string
+	Start     int64
+	End       int64
+}
+
+// startOfDay returns the midnight of the day of t in ScheduleLocation
+func startOfDay(t time.Time) time.Time {
+	t = t.In(ScheduleLocation)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ScheduleLocation)
+}
+
+// atTimeOfDay returns the wall clock time t (a time since midnight like GroupTime.StartTime) on the day of day in ScheduleLocation.
+// Adding t to the midnight would be an hour off on the days daylight saving time starts or ends.
+func atTimeOfDay(day time.Time, t int64) time.Time {
+	d := time.Duration(t)
+	day = day.In(ScheduleLocation)
+	return time.Date(day.Year(), day.Month(), day.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second), int(d%time.Second), ScheduleLocation)
+}
+
+// dayOfTheWeek converts a date to GroupTime.DayOfTheWeek, where monday is 0
+func dayOfTheWeek(t time.Time) int64 {
+	return int64(t.Weekday()+6) % 7
+}
+
+// expandGroup returns the lessons of a group that overlap [from, to). Lessons are held on every day from the day of the start date to the day of the end date,
+// except during holidays.
+func expandGroup(group Group, times []GroupTime, holidays []Holiday, userID string, from int64, to int64) []Lesson {
+	lessons := []Lesson{}
+	if len(times) == 0 {
+		return lessons
+	}
+	first := startOfDay(time.Unix(group.StartDate, 0))
+	if f := startOfDay(time.Unix(from, 0)); f.After(first) {
+		first = f
+	}
+	last := startOfDay(time.Unix(group.EndDate, 0))
+	if l := startOfDay(time.Unix(to, 0)); l.Before(last) {
+		last = l
+	}
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		if isHoliday(day, holidays) {
+			continue
+		}
+		for _, t := range times {
+			if t.DayOfTheWeek != dayOfTheWeek(day) {
+				continue
+			}
+			start := atTimeOfDay(day, t.StartTime).Unix()
+			end := atTimeOfDay(day, t.EndTime).Unix()
+			if end <= from || start >= to {
+				continue
+			}
+			lessons = append(lessons, Lesson{
+				GroupID:   group.GroupID,
+				GroupName: group.Name,
+				CourseID:  group.CourseID,
+				TeacherID: group.TeacherID,
+				UserID:    userID,
+				Start:     start,
+				End:       end,
+			})
+		}
+	}
+	return lessons
+}
+
+// scheduleUserIDs returns the users whose groups are in the schedule of a user: the wards of a guardian, otherwise the user themselves
+func scheduleUserIDs(user User, db *gorm.DB) ([]string, error) {
+	if user.Role != Guardian {
+		return []string{user.UUID}, nil
+	}
+	wards, err := GetWards(user.UUID, db)
+	if err == ErrNoWardsFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, w := range wards {
+		ids = append(ids, w.UUID)
+	}
+	return ids, nil
+}
+
+// GetSchedule returns the lessons of a user between the unix times from and to, earliest first.
+// Students get the lessons of their groups, teachers the lessons they teach and guardians the lessons of their wards.
+func GetSchedule(userID string, from int64, to int64, db *gorm.DB) ([]Lesson, error) {
+	if to <= from {
+		return nil, ErrInvalidDateRange
+	}
+	user, err := GetUser(userID, db)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scheduleUserIDs(user, db)
+	if err != nil {
+		return nil, err
+	}
+	holidays, err := GetHolidays(from, to, db)
+	if err != nil {
+		return nil, err
+	}
+
+	lessons := []Lesson{}
+	for _, id := range ids {
+		groups, err := getScheduledGroups(id, db)
+		if err != nil {
+			return nil, err
+		}
+		times, err := getTimesOfGroups(groups, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			lessons = append(lessons, expandGroup(g, times[g.GroupID], holidays, id, from, to)...)
+		}
+	}
+
+	sort.SliceStable(lessons, func(i, j int) bool {
+		if lessons[i].Start != lessons[j].Start {
+			return lessons[i].Start < lessons[j].Start
+		}
+		return lessons[i].GroupName < lessons[j].GroupName
+	})
+	return lessons, nil
+}
+
+// GetWeekSchedule returns the lessons of a user during the week of t, from monday to sunday
+func GetWeekSchedule(userID string, t int64, db *gorm.DB) ([]Lesson, error) {
+	day := startOfDay(time.Unix(t, 0))
+	monday := day.AddDate(0, 0, -int(dayOfTheWeek(day)))
+	return GetSchedule(userID, monday.Unix(), monday.AddDate(0, 0, 7).Unix(), db)
+}
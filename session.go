@@ -0,0 +1,251 @@
+package wilhelmiina
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const SESSION_TOKEN_BYTES = 32
+
+// SessionIdleTimeout is how long a session stays valid without being used. Every successful ValidateSession pushes the expiry forward by this amount.
+var SessionIdleTimeout = 30 * time.Minute
+
+// SessionMaxLifetime is the absolute lifetime of a session, no matter how actively it is used.
+var SessionMaxLifetime = 12 * time.Hour
+
+// Session is a login session. Only the hash of the session token is stored, so a database leak doesn't leak usable tokens.
+// Revoked sessions are kept in the table so there is a record of every login.
+type Session struct {
+	SessionID      string `gorm:"primaryKey"`
+	UUID           string `gorm:"index"`
+	CreatedAt      int64
+	LastSeen       int64
+	ExpiresAt      int64
+	AbsoluteExpiry int64
+	Revoked        bool
+	RevokedAt      int64
+}
+
+func genToken() (string, error) {
+	b := make([]byte, SESSION_TOKEN_BYTES)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Login checks the username and password and creates a new session for the user. The returned token is what the client should send back on every request.
+// If the password hash was created with an outdated hash policy it is upgraded on the fly.
+func Login(username string, password string, db *gorm.DB) (string, error) {
+	return LoginFrom(username, password, "", db)
+}
+
+// LoginFrom is like Login but also throttles failed attempts by sourceKey, which is usually the IP address of the client.
+// Users with two-factor authentication get ErrTwoFactorRequired and must log in using LoginWithCode instead.
+func LoginFrom(username string, password string, sourceKey string, db *gorm.DB) (string, error) {
+	return login(username, password, "", sourceKey, db)
+}
+
+// LoginWithCode logs in a user with two-factor authentication, code can be a TOTP code or a recovery code.
+func LoginWithCode(username string, password string, code string, sourceKey string, db *gorm.DB) (string, error) {
+	return login(username, password, code, sourceKey, db)
+}
+
+var ErrPasswordChangeRequired = errors.New("user must change their password before logging in")
+
+func login(username string, password string, code string, sourceKey string, db *gorm.DB) (string, error) {
+	user, err := authenticate(username, password, code, sourceKey, db)
+	if err != nil {
+		return "", err
+	}
+	if user.MustChangePassword {
+		return "", ErrPasswordChangeRequired
+	}
+	return CreateSession(user.UUID, db)
+}
+
+// authenticate checks all credentials of the user and records the attempt
+func authenticate(username string, password string, code string, sourceKey string, db *gorm.DB) (User, error) {
+	now := time.Now()
+	user, err := GetUserByUn(username, db)
+	if err != nil && err != ErrUserNotFound {
+		return User{}, err
+	}
+	err = checkLoginAllowed(user, username, sourceKey, now, db)
+	if err != nil {
+		return User{}, err
+	}
+	if user.UUID == "" {
+		if err := checkDummyPassword(password); err != nil {
+			return User{}, err
+		}
+		err = loginFailed(user, username, sourceKey, AttemptUnknownUser, now, db)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCredentials
+	}
+	if user.IsService {
+		if err := checkDummyPassword(password); err != nil {
+			return User{}, err
+		}
+		err = loginFailed(user, username, sourceKey, AttemptServiceAccount, now, db)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCredentials
+	}
+
+	ok, err := user.CheckPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		err = loginFailed(user, username, sourceKey, AttemptInvalidPassword, now, db)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCredentials
+	}
+	if !user.IsActive() {
+		err = recordAttempt(user, username, sourceKey, AttemptInactive, now, db)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrUserInactive
+	}
+	err = checkSecondFactor(user, code, db)
+	if err == ErrInvalidCode {
+		err = loginFailed(user, username, sourceKey, AttemptInvalidCode, now, db)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCode
+	}
+	if err != nil {
+		return User{}, err
+	}
+	err = loginSucceeded(user, username, sourceKey, now, db)
+	if err != nil {
+		return User{}, err
+	}
+	err = rehashPassword(&user, password, db)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// CreateSession creates a session for user without checking any credentials. Use Login unless the user has already been authenticated some other way.
+func CreateSession(UUID string, db *gorm.DB) (string, error) {
+	token, err := genToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s := Session{
+		SessionID:      hashToken(token),
+		UUID:           UUID,
+		CreatedAt:      now.Unix(),
+		LastSeen:       now.Unix(),
+		ExpiresAt:      now.Add(SessionIdleTimeout).Unix(),
+		AbsoluteExpiry: now.Add(SessionMaxLifetime).Unix(),
+	}
+
+	tx := db.Begin()
+	tx.Create(&s)
+	err = tx.Commit().Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+var ErrSessionNotFound = errors.New("session not found")
+var ErrSessionExpired = errors.New("session has expired")
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// ValidateSession returns the user the session token belongs to and slides the session expiry forward.
+func ValidateSession(token string, db *gorm.DB) (User, error) {
+	var s Session
+	res := db.First(&s, "session_id = ?", hashToken(token))
+	if res.RowsAffected == 0 {
+		return User{}, ErrSessionNotFound
+	}
+	if s.Revoked {
+		return User{}, ErrSessionRevoked
+	}
+	now := time.Now()
+	if now.Unix() >= s.ExpiresAt || now.Unix() >= s.AbsoluteExpiry {
+		return User{}, ErrSessionExpired
+	}
+
+	user, err := GetUser(s.UUID, db)
+	if err != nil {
+		return User{}, err
+	}
+	if !user.IsActive() {
+		return User{}, ErrUserInactive
+	}
+
+	expires := now.Add(SessionIdleTimeout).Unix()
+	if expires > s.AbsoluteExpiry {
+		expires = s.AbsoluteExpiry
+	}
+	tx := db.Begin()
+	tx.Model(Session{}).Where("session_id = ?", s.SessionID).
+		Updates(map[string]interface{}{"last_seen": now.Unix(), "expires_at": expires})
+	err = tx.Commit().Error
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// RevokeSession invalidates a single session, for example when the user logs out.
+func RevokeSession(token string, db *gorm.DB) error {
+	tx := db.Begin()
+	res := tx.Model(Session{}).Where("session_id = ? AND revoked = ?", hashToken(token), false).
+		Updates(map[string]interface{}{"revoked": true, "revoked_at": time.Now().Unix()})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessionsForUser invalidates every session of the user, should be called e.g. after a password change.
+func RevokeAllSessionsForUser(UUID string, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Model(Session{}).Where("uuid = ? AND revoked = ?", UUID, false).
+		Updates(map[string]interface{}{"revoked": true, "revoked_at": time.Now().Unix()})
+	return tx.Commit().Error
+}
+
+// GetSessionsForUser returns all sessions of a user, including expired and revoked ones.
+func GetSessionsForUser(UUID string, db *gorm.DB) ([]Session, error) {
+	var data []Session
+	tx := db.Model(Session{}).Where("uuid = ?", UUID).Order("created_at").Scan(&data)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return data, nil
+}
@@ -36,8 +36,8 @@ func CreateSubject(name string, shortname string, desc string, db *gorm.DB) (Sub
 
 func ChangeSubjectName(new string, subjectid string, db *gorm.DB) error {
 	tx := db.Begin()
-	tx.Model(User{}).Where("subject_id = ?", subjectid).
-		Update("name", new)
+	tx.Model(Subject{}).Where("subject_id = ?", subjectid).
+		Update("subject_name", new)
 
 	err := tx.Commit().Error
 	return err
@@ -45,7 +45,7 @@ func ChangeSubjectName(new string, subjectid string, db *gorm.DB) error {
 
 func ChangeSubjectShortName(new string, subjectid string, db *gorm.DB) error {
 	tx := db.Begin()
-	tx.Model(User{}).Where("subject_id = ?", subjectid).
+	tx.Model(Subject{}).Where("subject_id = ?", subjectid).
 		Update("short_name", new)
 
 	err := tx.Commit().Error
@@ -54,7 +54,7 @@ func ChangeSubjectShortName(new string, subjectid string, db *gorm.DB) error {
 
 func ChangeSubjectDesc(new string, subjectid string, db *gorm.DB) error {
 	tx := db.Begin()
-	tx.Model(User{}).Where("subject_id = ?", subjectid).
+	tx.Model(Subject{}).Where("subject_id = ?", subjectid).
 		Update("subject_desc", new)
 
 	err := tx.Commit().Error
@@ -123,3 +123,43 @@ func GetSubject(id string, db *gorm.DB) (Subject, error) {
 func (s *Subject) Delete(db *gorm.DB) error {
 	return DeleteSubject(s.SubjectID, db)
 }
+
+// CreateSubjectAs creates a subject if actor is allowed to do so
+func CreateSubjectAs(actor User, name string, shortname string, desc string, db *gorm.DB) (Subject, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectCreate, "", db); err != nil {
+		return Subject{}, err
+	}
+	return CreateSubject(name, shortname, desc, withAudit(db, actor, ActionSubjectCreate))
+}
+
+// DeleteSubjectAs deletes a subject and its courses if actor is allowed to do so
+func DeleteSubjectAs(actor User, subjectID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectDelete, subjectID, db); err != nil {
+		return err
+	}
+	return DeleteSubject(subjectID, withAudit(db, actor, ActionSubjectDelete))
+}
+
+// ChangeSubjectNameAs renames a subject if actor is allowed to do so
+func ChangeSubjectNameAs(actor User, new string, subjectid string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectEdit, subjectid, db); err != nil {
+		return err
+	}
+	return ChangeSubjectName(new, subjectid, withAudit(db, actor, ActionSubjectEdit))
+}
+
+// ChangeSubjectShortNameAs changes the short name of a subject if actor is allowed to do so
+func ChangeSubjectShortNameAs(actor User, new string, subjectid string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectEdit, subjectid, db); err != nil {
+		return err
+	}
+	return ChangeSubjectShortName(new, subjectid, withAudit(db, actor, ActionSubjectEdit))
+}
+
+// ChangeSubjectDescAs changes the description of a subject if actor is allowed to do so
+func ChangeSubjectDescAs(actor User, new string, subjectid string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionSubjectEdit, subjectid, db); err != nil {
+		return err
+	}
+	return ChangeSubjectDesc(new, subjectid, withAudit(db, actor, ActionSubjectEdit))
+}
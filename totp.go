@@ -0,0 +1,348 @@
+package wilhelmiina
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	TOTP_SECRET_BYTES   = 20
+	TOTP_DIGITS         = 6
+	TOTP_PERIOD         = 30
+	TOTP_SKEW           = 1 // How many periods before and after the current one are accepted
+	RECOVERY_CODE_COUNT = 10
+	RECOVERY_CODE_LEN   = 10
+	// Recovery codes start with a short id that is stored in plain text, so only one hash has to be checked when a code is used
+	RECOVERY_CODE_ID_LEN = 4
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPSecret is the RFC 6238 secret of a user. It is not used for logins until the user has confirmed it with a valid code.
+type TOTPSecret struct {
+	UUID         string `gorm:"primaryKey"`
+	Secret       string // Base32 encoded
+	Enabled      bool
+	LastUsedStep int64 // Codes from this step or earlier are not accepted again
+	CreatedAt    int64
+}
+
+// RecoveryCode is a single use code that can be used instead of a TOTP code, only its id and argon2 hash are stored.
+// Codes made before ids were added have an empty CodeID.
+type RecoveryCode struct {
+	gorm.Model
+	UUID   string `gorm:"index"`
+	CodeID string
+	Hash   string
+	Used   bool
+}
+
+// Roles that must use two-factor authentication to log in. Nobody is required to by default,
+// users who haven't enrolled yet can't log in after their role is required to, so have them enroll first.
+var twoFactorRoles = map[Role]bool{}
+
+// SetTwoFactorRequired changes whether users with role must use two-factor authentication
+func SetTwoFactorRequired(role Role, required bool) {
+	twoFactorRoles[role] = required
+}
+
+func TwoFactorRequired(role Role) bool {
+	return twoFactorRoles[role]
+}
+
+// hotp calculates a RFC 4226 one time password
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD
+}
+
+var ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+
+// EnrollTOTP generates a new TOTP secret for the user and returns it together with an otpauth:// URI that can be shown as a QR code.
+// The secret is not used until it has been confirmed with ConfirmTOTP.
+func EnrollTOTP(UUID string, issuer string, db *gorm.DB) (secret string, uri string, err error) {
+	user, err := GetUser(UUID, db)
+	if err != nil {
+		return "", "", err
+	}
+	enabled, err := HasTOTP(UUID, db)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	key := make([]byte, TOTP_SECRET_BYTES)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", "", err
+	}
+	secret = b32.EncodeToString(key)
+
+	s := TOTPSecret{
+		UUID:      UUID,
+		Secret:    secret,
+		CreatedAt: time.Now().Unix(),
+	}
+	tx := db.Begin()
+	tx.Save(&s)
+	err = tx.Commit().Error
+	if err != nil {
+		return "", "", err
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(TOTP_PERIOD))
+	uri = fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(user.Username), params.Encode())
+	return secret, uri, nil
+}
+
+var ErrTOTPNotEnrolled = errors.New("user has not enrolled to two-factor authentication")
+var ErrInvalidCode = errors.New("invalid two-factor authentication code")
+
+func getTOTPSecret(UUID string, db *gorm.DB) (TOTPSecret, error) {
+	var s TOTPSecret
+	tx := db.Where("uuid = ?", UUID).Limit(1).Find(&s)
+	if tx.Error != nil {
+		return TOTPSecret{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return TOTPSecret{}, ErrTOTPNotEnrolled
+	}
+	return s, nil
+}
+
+// checkTOTP returns the step the code matched, or 0 if it didn't match any
+func checkTOTP(s TOTPSecret, code string, now time.Time) (int64, error) {
+	key, err := b32.DecodeString(s.Secret)
+	if err != nil {
+		return 0, err
+	}
+	current := totpStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= s.LastUsedStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step), TOTP_DIGITS)), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, nil
+}
+
+// ConfirmTOTP enables two-factor authentication after checking the user can generate valid codes, and returns a fresh set of recovery codes
+func ConfirmTOTP(UUID string, code string, db *gorm.DB) ([]string, error) {
+	s, err := getTOTPSecret(UUID, db)
+	if err != nil {
+		return nil, err
+	}
+	if s.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	step, err := checkTOTP(s, code, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if step == 0 {
+		return nil, ErrInvalidCode
+	}
+
+	tx := db.Begin()
+	tx.Model(TOTPSecret{}).Where("uuid = ?", UUID).
+		Updates(map[string]interface{}{"enabled": true, "last_used_step": step})
+	err = tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	return RegenerateRecoveryCodes(UUID, db)
+}
+
+// HasTOTP reports whether the user has enabled two-factor authentication
+func HasTOTP(UUID string, db *gorm.DB) (bool, error) {
+	s, err := getTOTPSecret(UUID, db)
+	if err == ErrTOTPNotEnrolled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.Enabled, nil
+}
+
+// VerifyTOTP checks a code generated by the authenticator app of the user. Every code can only be used once.
+func VerifyTOTP(UUID string, code string, db *gorm.DB) (bool, error) {
+	s, err := getTOTPSecret(UUID, db)
+	if err != nil {
+		return false, err
+	}
+	if !s.Enabled {
+		return false, ErrTOTPNotEnrolled
+	}
+	step, err := checkTOTP(s, code, time.Now())
+	if err != nil || step == 0 {
+		return false, err
+	}
+
+	// The condition makes sure two concurrent logins can't both use the same code
+	tx := db.Begin()
+	res := tx.Model(TOTPSecret{}).Where("uuid = ? AND last_used_step < ?", UUID, step).Update("last_used_step", step)
+	err = tx.Commit().Error
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected != 0, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user with new ones. The codes are only returned here, so show them to the user.
+func RegenerateRecoveryCodes(UUID string, db *gorm.DB) ([]string, error) {
+	var codes []string
+	var rows []RecoveryCode
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		b := make([]byte, RECOVERY_CODE_ID_LEN+RECOVERY_CODE_LEN)
+		_, err := io.ReadFull(rand.Reader, b)
+		if err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(b32.EncodeToString(b))
+		id := raw[:RECOVERY_CODE_ID_LEN]
+		secret := raw[RECOVERY_CODE_ID_LEN : RECOVERY_CODE_ID_LEN+RECOVERY_CODE_LEN]
+		code := id + "-" + secret[:RECOVERY_CODE_LEN/2] + "-" + secret[RECOVERY_CODE_LEN/2:]
+		hash, err := genHashString(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		rows = append(rows, RecoveryCode{UUID: UUID, CodeID: id, Hash: hash})
+	}
+
+	tx := db.Begin()
+	tx.Unscoped().Where("uuid = ?", UUID).Delete(&RecoveryCode{})
+	tx.Create(&rows)
+	err := tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode checks a recovery code and marks it used if it is valid
+func UseRecoveryCode(UUID string, code string, db *gorm.DB) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	var id string
+	switch len(code) {
+	case RECOVERY_CODE_ID_LEN + RECOVERY_CODE_LEN:
+		id = code[:RECOVERY_CODE_ID_LEN]
+	case RECOVERY_CODE_LEN:
+		// Code from before ids were added
+		id = ""
+	default:
+		return false, nil
+	}
+	var rows []RecoveryCode
+	tx := db.Where("uuid = ? AND code_id = ? AND used = ?", UUID, id, false).Find(&rows)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	for _, r := range rows {
+		ok, err := validatePassword(code, r.Hash)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		// The condition makes sure two concurrent logins can't both use the same code
+		tx := db.Begin()
+		res := tx.Model(RecoveryCode{}).Where("id = ? AND used = ?", r.ID, false).Update("used", true)
+		err = tx.Commit().Error
+		if err != nil {
+			return false, err
+		}
+		return res.RowsAffected != 0, nil
+	}
+	return false, nil
+}
+
+// DisableTOTP turns two-factor authentication off and removes the secret and recovery codes of the user
+func DisableTOTP(UUID string, db *gorm.DB) error {
+	tx := db.Begin()
+	tx.Where("uuid = ?", UUID).Delete(&TOTPSecret{})
+	tx.Unscoped().Where("uuid = ?", UUID).Delete(&RecoveryCode{})
+	return tx.Commit().Error
+}
+
+var ErrTwoFactorRequired = errors.New("two-factor authentication code required")
+var ErrTwoFactorNotEnrolled = errors.New("user must enroll to two-factor authentication before logging in")
+
+// checkSecondFactor checks the TOTP or recovery code of a user whose password has already been verified
+func checkSecondFactor(user User, code string, db *gorm.DB) error {
+	enabled, err := HasTOTP(user.UUID, db)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		if TwoFactorRequired(user.Role) {
+			return ErrTwoFactorNotEnrolled
+		}
+		return nil
+	}
+	if code == "" {
+		return ErrTwoFactorRequired
+	}
+
+	// Only try the expensive recovery codes when the code doesn't look like a TOTP code
+	if len(code) == TOTP_DIGITS {
+		ok, err := VerifyTOTP(user.UUID, code, db)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		return ErrInvalidCode
+	}
+	ok, err := UseRecoveryCode(user.UUID, code, db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	return nil
+}
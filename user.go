@@ -2,18 +2,35 @@ package wilhelmiina
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type User struct {
-	UUID      string `gorm:"primaryKey"`
-	Username  string `gorm:"index:unique"`
-	Firstname string
-	Surname   string
-	Password  string
-	Role      Role
+	UUID          string `gorm:"primaryKey"`
+	Username      string `gorm:"index:unique"`
+	Firstname     string
+	Surname       string
+	Password      string
+	Role          Role
+	Status        UserStatus
+	StatusChanged int64
+	// When the reservations and messages of the user were archived, 0 if they aren't. Unlike StatusChanged this stays the same when an archived user gets another inactive status.
+	ArchivedAt int64
+	// Normalized username, see NormalizeUsername. The unique index makes sure usernames differing only by case can't exist.
+	UsernameKey string `gorm:"uniqueIndex"`
+	// Case-folded names for the NamePrefix of QueryUsers, LOWER in SQLite only folds ASCII letters. See NormalizeUsername.
+	FirstnameKey string
+	SurnameKey   string
+	// User has to choose a new password before they can log in, see ChangeExpiredPassword
+	MustChangePassword bool
+	// Service accounts are used by integrations through API keys and can't log in with a password, see CreateServiceAccount
+	IsService bool
+	// Actions the user may perform, set by AuthenticateAPIKey to the scopes of the key. Nil means the role alone decides, see Authorizer.Can
+	Scopes []Action `gorm:"-"`
 }
 
 type UserData struct {
@@ -22,6 +39,10 @@ type UserData struct {
 	Firstname string
 	Surname   string
 	Role      Role
+	Status    UserStatus
+	IsService bool
+	// Only filled by ToDataFor, nil if the viewer can't see any of the profile
+	Profile *ProfileData `gorm:"-"`
 }
 
 type GuardianData struct {
@@ -38,9 +59,58 @@ const Teacher Role = 2
 const Moderator Role = 3
 const Admin Role = 4
 
+var roleNames = map[Role]string{
+	Student:   "student",
+	Guardian:  "guardian",
+	Teacher:   "teacher",
+	Moderator: "moderator",
+	Admin:     "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+var ErrInvalidRole = errors.New("invalid role")
+
+// ParseRole parses a role name like "student" or "Teacher"
+func ParseRole(name string) (Role, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for r, n := range roleNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return 0, ErrInvalidRole
+}
+
 var ErrUserAlreadyExists = errors.New("username must be unique")
 
+// isUniqueViolation reports whether err is caused by a unique index, like the one on UsernameKey.
+// gorm doesn't translate these so the driver messages of sqlite, postgres and mysql are checked.
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") ||
+		strings.Contains(msg, "duplicate key value") ||
+		strings.Contains(msg, "Duplicate entry")
+}
+
+// usernameError maps a unique index violation to ErrUserAlreadyExists. Another request can take the username between checkUsernameFree and the write.
+func usernameError(err error) error {
+	if isUniqueViolation(err) {
+		return ErrUserAlreadyExists
+	}
+	return err
+}
+
 // Creates user and saves it to the database specified in the database argument. You should have migrated user schema to db already
+// The password must meet the password policy, otherwise a *PasswordPolicyError is returned
 func CreateUser(username string, Firstname string, Surname string, password string, role Role, database *gorm.DB) (User, error) {
 	_, err := GetUserByUn(username, database)
 	exists := err != ErrUserNotFound
@@ -50,26 +120,35 @@ func CreateUser(username string, Firstname string, Surname string, password stri
 	UUID := uuid.New()
 	UUIDString := UUID.String()
 
-	hashed, err := genHashString(password)
+	u := User{
+		UUID:         UUIDString,
+		Username:     username,
+		UsernameKey:  NormalizeUsername(username),
+		Firstname:    Firstname,
+		Surname:      Surname,
+		FirstnameKey: NormalizeUsername(Firstname),
+		SurnameKey:   NormalizeUsername(Surname),
+		Role:         role,
+	}
+	err = CheckPasswordPolicy(password, u)
 	if err != nil {
-		return User{}, nil
+		return User{}, err
 	}
-	u := User{
-		UUID:      UUIDString,
-		Username:  username,
-		Firstname: Firstname,
-		Surname:   Surname,
-		Password:  hashed,
-		Role:      role,
+	u.Password, err = genHashString(password)
+	if err != nil {
+		return User{}, err
 	}
 
 	// Save user in database
 	tx := database.Begin()
-	database.Create(&u)
+	if err := tx.Create(&u).Error; err != nil {
+		tx.Rollback()
+		return User{}, usernameError(err)
+	}
 	err = tx.Commit().Error
 
 	if err != nil {
-		return User{}, err
+		return User{}, usernameError(err)
 	}
 	return u, nil
 }
@@ -86,10 +165,10 @@ func GetUser(UUID string, database *gorm.DB) (User, error) {
 	return user, nil
 }
 
-//
+// GetUserByUn finds a user by username. The comparison is case-insensitive, see NormalizeUsername
 func GetUserByUn(un string, db *gorm.DB) (User, error) {
 	var user User
-	res := db.First(&user, "username = ?", un)
+	res := db.First(&user, "username_key = ?", NormalizeUsername(un))
 	found := res.RowsAffected != 0
 	if !found {
 		return User{}, ErrUserNotFound
@@ -97,36 +176,62 @@ func GetUserByUn(un string, db *gorm.DB) (User, error) {
 	return user, nil
 }
 
-func ChangeUserNames(firstname string, lastname string, username string, UUID string, db *gorm.DB) error {
-	if _, err := GetUserByUn(username, db); err != ErrUserNotFound {
+// checkUsernameFree returns ErrUserAlreadyExists if username is used by someone else than user UUID
+func checkUsernameFree(username string, UUID string, db *gorm.DB) error {
+	u, err := GetUserByUn(username, db)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if u.UUID != UUID {
 		return ErrUserAlreadyExists
 	}
+	return nil
+}
+
+func ChangeUserNames(firstname string, lastname string, username string, UUID string, db *gorm.DB) error {
+	if err := checkUsernameFree(username, UUID, db); err != nil {
+		return err
+	}
 	tx := db.Begin()
-	tx.Model(User{}).Where("uuid = ?", UUID).
-		Update("firstname", firstname).
-		Update("lastname", lastname).
-		Update("username", username)
+	err := tx.Model(User{}).Where("uuid = ?", UUID).
+		Updates(map[string]interface{}{
+			"firstname":     firstname,
+			"surname":       lastname,
+			"firstname_key": NormalizeUsername(firstname),
+			"surname_key":   NormalizeUsername(lastname),
+			"username":      username,
+			"username_key":  NormalizeUsername(username),
+		}).Error
+	if err != nil {
+		tx.Rollback()
+		return usernameError(err)
+	}
 
-	err := tx.Commit().Error
-	return err
+	return usernameError(tx.Commit().Error)
 }
 
 func ChangeUsername(username string, UUID string, db *gorm.DB) error {
-	if _, err := GetUserByUn(username, db); err != ErrUserNotFound {
-		return ErrUserAlreadyExists
+	if err := checkUsernameFree(username, UUID, db); err != nil {
+		return err
 	}
 	tx := db.Begin()
-	tx.Model(User{}).Where("uuid = ?", UUID).
-		Update("username", username)
+	err := tx.Model(User{}).Where("uuid = ?", UUID).
+		Updates(map[string]interface{}{"username": username, "username_key": NormalizeUsername(username)}).Error
+	if err != nil {
+		tx.Rollback()
+		return usernameError(err)
+	}
 
-	err := tx.Commit().Error
-	return err
+	return usernameError(tx.Commit().Error)
 }
 
 func ChangeFirstName(firstname string, UUID string, db *gorm.DB) error {
 	tx := db.Begin()
 	tx.Model(User{}).Where("uuid = ?", UUID).
-		Update("firstname", firstname)
+		Updates(map[string]interface{}{"firstname": firstname, "firstname_key": NormalizeUsername(firstname)})
 
 	err := tx.Commit().Error
 	return err
@@ -135,14 +240,28 @@ func ChangeFirstName(firstname string, UUID string, db *gorm.DB) error {
 func ChangeLastName(surname string, UUID string, db *gorm.DB) error {
 	tx := db.Begin()
 	tx.Model(User{}).Where("uuid = ?", UUID).
-		Update("lastname", surname)
+		Updates(map[string]interface{}{"surname": surname, "surname_key": NormalizeUsername(surname)})
 
 	err := tx.Commit().Error
 	return err
 }
 
+// newPasswordHash checks the new password of a user against the password policy and hashes it
+func newPasswordHash(newpass string, UUID string, db *gorm.DB) (string, error) {
+	u, err := GetUser(UUID, db)
+	if err != nil {
+		return "", err
+	}
+	err = CheckPasswordPolicy(newpass, u)
+	if err != nil {
+		return "", err
+	}
+	return genHashString(newpass)
+}
+
+// ChangePassword changes the password of a user, the new password must meet the password policy
 func ChangePassword(newpass string, UUID string, db *gorm.DB) error {
-	newHash, err := genHashString(newpass)
+	newHash, err := newPasswordHash(newpass, UUID, db)
 	if err != nil {
 		return err
 	}
@@ -153,11 +272,9 @@ func ChangePassword(newpass string, UUID string, db *gorm.DB) error {
 	return err
 }
 
+// DeleteUser archives the user by setting their status to Left, it can be undone with RestoreUser. Use PurgeUser to remove the user for good.
 func DeleteUser(UUID string, db *gorm.DB) error {
-	tx := db.Begin()
-	tx.Where("uuid = ?").Delete(&User{})
-	err := tx.Commit().Error
-	return err
+	return SetUserStatus(UUID, Left, db)
 }
 
 func (u *User) GetGroups(db *gorm.DB) ([]Group, error) {
@@ -193,9 +310,12 @@ func (u *User) ToData() UserData {
 		Firstname: u.Firstname,
 		Surname:   u.Surname,
 		Role:      u.Role,
+		Status:    u.Status,
+		IsService: u.IsService,
 	}
 }
 
+// GetUserList returns every user at once, use QueryUsers to browse large schools a page at a time
 func GetUserList(db *gorm.DB) ([]UserData, error) {
 	ul := []User{}
 	udl := []UserData{}
@@ -209,10 +329,11 @@ func GetUserList(db *gorm.DB) ([]UserData, error) {
 	return udl, nil
 }
 
+// GetTeacherList returns all active teachers
 func GetTeacherList(db *gorm.DB) ([]UserData, error) {
 	ul := []User{}
 	udl := []UserData{}
-	tx := db.Model(&User{}).Select("*").Where("role = ?", Teacher).Scan(&ul)
+	tx := db.Model(&User{}).Select("*").Where("role = ? AND status = ?", Teacher, Active).Scan(&ul)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -221,3 +342,59 @@ func GetTeacherList(db *gorm.DB) ([]UserData, error) {
 	}
 	return udl, nil
 }
+
+// CreateUserAs creates a user if actor is allowed to do so
+func CreateUserAs(actor User, username string, Firstname string, Surname string, password string, role Role, database *gorm.DB) (User, error) {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserCreate, "", database); err != nil {
+		return User{}, err
+	}
+	return CreateUser(username, Firstname, Surname, password, role, withAudit(database, actor, ActionUserCreate))
+}
+
+// ChangeUserNamesAs changes the names of a user if actor is allowed to do so
+func ChangeUserNamesAs(actor User, firstname string, lastname string, username string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserEdit, UUID, db); err != nil {
+		return err
+	}
+	return ChangeUserNames(firstname, lastname, username, UUID, withAudit(db, actor, ActionUserEdit))
+}
+
+// ChangeUsernameAs changes the username of a user if actor is allowed to do so
+func ChangeUsernameAs(actor User, username string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserEdit, UUID, db); err != nil {
+		return err
+	}
+	return ChangeUsername(username, UUID, withAudit(db, actor, ActionUserEdit))
+}
+
+// ChangeFirstNameAs changes the first name of a user if actor is allowed to do so
+func ChangeFirstNameAs(actor User, firstname string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserEdit, UUID, db); err != nil {
+		return err
+	}
+	return ChangeFirstName(firstname, UUID, withAudit(db, actor, ActionUserEdit))
+}
+
+// ChangeLastNameAs changes the surname of a user if actor is allowed to do so
+func ChangeLastNameAs(actor User, surname string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserEdit, UUID, db); err != nil {
+		return err
+	}
+	return ChangeLastName(surname, UUID, withAudit(db, actor, ActionUserEdit))
+}
+
+// ChangePasswordAs changes the password of a user if actor is allowed to do so
+func ChangePasswordAs(actor User, newpass string, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserChangePassword, UUID, db); err != nil {
+		return err
+	}
+	return ChangePassword(newpass, UUID, withAudit(db, actor, ActionUserChangePassword))
+}
+
+// DeleteUserAs deletes a user if actor is allowed to do so
+func DeleteUserAs(actor User, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserDelete, UUID, db); err != nil {
+		return err
+	}
+	return DeleteUser(UUID, withAudit(db, actor, ActionUserDelete))
+}
@@ -0,0 +1,204 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type UserStatus int
+
+const Active UserStatus = 0
+const Suspended UserStatus = 1
+const Graduated UserStatus = 2
+const Left UserStatus = 3
+
+var ErrInvalidStatus = errors.New("invalid user status")
+var ErrUserInactive = errors.New("user is not active")
+
+// archives reports whether reservations and messages of the user are archived when they get this status.
+// Suspended users keep everything, they just can't log in.
+func (s UserStatus) archives() bool {
+	return s == Graduated || s == Left
+}
+
+// SetUserStatus changes the status of a user. Inactive users can't log in and their sessions are revoked.
+// Graduated users and users who have left are also removed from their groups and waitlists and their received messages are archived, RestoreUser brings them back.
+// The places they leave go to the users on the waitlists of the groups.
+func SetUserStatus(UUID string, status UserStatus, db *gorm.DB) error {
+	if status < Active || status > Left {
+		return ErrInvalidStatus
+	}
+	if status == Active {
+		return RestoreUser(UUID, db)
+	}
+	user, err := GetUser(UUID, db)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	archive := status.archives() && user.ArchivedAt == 0
+	var groupIDs []string
+	if archive {
+		if err := db.Model(&GroupReservation{}).Where("reserver_uuid = ?", UUID).Pluck("group_id", &groupIDs).Error; err != nil {
+			return err
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"status": status, "status_changed": now.Unix()}
+		if archive {
+			// Rows are marked with the archive time so RestoreUser only brings back what was archived
+			archived := time.Unix(now.Unix(), 0)
+			updates["archived_at"] = archived.Unix()
+			if err := tx.Model(GroupReservation{}).Where("reserver_uuid = ?", UUID).Update("deleted_at", archived).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(MessageReciever{}).Where("uuid = ?", UUID).Update("deleted_at", archived).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("uuid = ?", UUID).Delete(&WaitlistEntry{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(User{}).Where("uuid = ?", UUID).Updates(updates).Error
+	})
+	if err != nil {
+		return err
+	}
+	err = RevokeAllSessionsForUser(UUID, db)
+	if err != nil {
+		return err
+	}
+	for _, id := range groupIDs {
+		if err := promoteFromWaitlist(id, db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreUser makes an archived or suspended user active again and restores the group reservations and messages archived with them.
+// If a group has filled up in the meantime the user is put on its waitlist instead.
+func RestoreUser(UUID string, db *gorm.DB) error {
+	user, err := GetUser(UUID, db)
+	if err != nil {
+		return err
+	}
+	if user.Status == Active {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if user.ArchivedAt != 0 {
+			archived := time.Unix(user.ArchivedAt, 0)
+			if err := restoreReservations(UUID, archived, tx); err != nil {
+				return err
+			}
+			// Messages deleted with DeleteMessage while the user was archived stay deleted
+			messages := tx.Model(&Message{}).Select("message_id")
+			if err := tx.Unscoped().Model(MessageReciever{}).Where("uuid = ? AND deleted_at >= ? AND message_id IN (?)", UUID, archived, messages).Update("deleted_at", nil).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(User{}).Where("uuid = ?", UUID).
+			Updates(map[string]interface{}{"status": Active, "status_changed": time.Now().Unix(), "archived_at": 0}).Error
+	})
+}
+
+// restoreReservations brings back the reservations archived at or after archived, as long as the groups have room
+func restoreReservations(UUID string, archived time.Time, tx *gorm.DB) error {
+	var reservations []GroupReservation
+	if err := tx.Unscoped().Where("reserver_uuid = ? AND deleted_at >= ?", UUID, archived).Find(&reservations).Error; err != nil {
+		return err
+	}
+	for _, r := range reservations {
+		group, err := getGroupInfo(r.GroupID, tx)
+		if err == ErrGroupNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		free, err := freePlaces(group, tx)
+		if err != nil {
+			return err
+		}
+		if free == 0 {
+			if err := tx.Unscoped().Delete(&r).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&WaitlistEntry{GroupID: r.GroupID, UUID: UUID}).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tx.Unscoped().Model(&r).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeUser removes the user and everything related to them from the database permanently. Messages the user has sent are kept for their recievers.
+// The audit events of the user are kept, but the names and profile data logged in them are cleared.
+func PurgeUser(UUID string, db *gorm.DB) error {
+	if _, err := GetUser(UUID, db); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		results := []*gorm.DB{
+			tx.Unscoped().Where("reserver_uuid = ?", UUID).Delete(&GroupReservation{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&MessageReciever{}),
+			tx.Unscoped().Where("uuid = ? OR guardian_of = ?", UUID, UUID).Delete(&GuardianData{}),
+			tx.Where("uuid = ?", UUID).Delete(&Session{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&LoginAttempt{}),
+			tx.Where("throttle_key = ?", userThrottleKey(UUID)).Delete(&LoginThrottle{}),
+			tx.Where("uuid = ?", UUID).Delete(&TOTPSecret{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&RecoveryCode{}),
+			tx.Where("uuid = ?", UUID).Delete(&PasswordResetToken{}),
+			tx.Where("uuid = ?", UUID).Delete(&UserProfile{}),
+			tx.Where("uuid = ?", UUID).Delete(&APIKey{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&ClassMember{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&CourseCompletion{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&WaitlistEntry{}),
+			tx.Unscoped().Where("uuid = ?", UUID).Delete(&SelectionChoice{}),
+			tx.Where("uuid = ?", UUID).Delete(&User{}),
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		return scrubAuditEvents(UUID, tx)
+	})
+}
+
+func (u *User) IsActive() bool {
+	return u.Status == Active
+}
+
+// SetUserStatusAs changes the status of a user if actor is allowed to do so
+func SetUserStatusAs(actor User, UUID string, status UserStatus, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserSetStatus, UUID, db); err != nil {
+		return err
+	}
+	return SetUserStatus(UUID, status, withAudit(db, actor, ActionUserSetStatus))
+}
+
+// RestoreUserAs restores a user if actor is allowed to do so
+func RestoreUserAs(actor User, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserSetStatus, UUID, db); err != nil {
+		return err
+	}
+	return RestoreUser(UUID, withAudit(db, actor, ActionUserSetStatus))
+}
+
+// PurgeUserAs permanently removes a user if actor is allowed to do so
+func PurgeUserAs(actor User, UUID string, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionUserPurge, UUID, db); err != nil {
+		return err
+	}
+	return PurgeUser(UUID, withAudit(db, actor, ActionUserPurge))
+}
@@ -0,0 +1,137 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// NormalizeUsername returns the form of a username used for uniqueness checks and lookups.
+// Usernames that only differ by case or by Unicode representation, like "Äijä" and "äijä", normalize to the same string.
+func NormalizeUsername(username string) string {
+	return cases.Fold().String(norm.NFKC.String(strings.TrimSpace(username)))
+}
+
+// Letters that don't decompose into a base letter and a combining mark
+var transliterations = map[rune]string{
+	'ß': "ss",
+	'æ': "ae",
+	'ø': "o",
+	'œ': "oe",
+	'ł': "l",
+	'đ': "d",
+	'ð': "d",
+	'þ': "th",
+	'ı': "i",
+}
+
+// transliterate converts a name to lowercase ASCII suitable for usernames, e.g. "Väinö Åkerström" becomes "vainoakerstrom"
+func transliterate(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Combining marks like the dots of ä are dropped
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-'):
+			b.WriteRune(r)
+		default:
+			b.WriteString(transliterations[r])
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+var ErrCannotGenerateUsername = errors.New("cannot generate username from the given names")
+
+// UsernameExists reports whether a username that normalizes to the same string as username is taken
+func UsernameExists(username string, db *gorm.DB) (bool, error) {
+	var count int64
+	tx := db.Model(&User{}).Where("username_key = ?", NormalizeUsername(username)).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count != 0, nil
+}
+
+// GenerateUsername creates a free username of the form firstname.surname from the names of a user.
+// Diacritics are removed and if the username is already taken a number is added to the end, e.g. "matti.meikalainen2".
+func GenerateUsername(firstname string, surname string, db *gorm.DB) (string, error) {
+	var parts []string
+	for i, name := range []string{firstname, surname} {
+		// Only the first of multiple first names is used, but surnames with many words are kept whole
+		fields := strings.Fields(name)
+		if len(fields) == 0 {
+			continue
+		}
+		if i == 0 {
+			fields = fields[:1]
+		}
+		if part := transliterate(strings.Join(fields, "")); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", ErrCannotGenerateUsername
+	}
+	base := strings.Join(parts, ".")
+
+	username := base
+	for n := 2; ; n++ {
+		exists, err := UsernameExists(username, db)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%d", base, n)
+	}
+}
+
+// migrateUsernameKeys adds the username_key column to an existing users table and fills it, so that the unique index can be created
+func migrateUsernameKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&User{}) || m.HasColumn(&User{}, "UsernameKey") {
+		return nil
+	}
+	err := m.AddColumn(&User{}, "UsernameKey")
+	if err != nil {
+		return err
+	}
+
+	var users []User
+	tx := db.Model(&User{}).Select("uuid", "username").Find(&users)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	tx = db.Begin()
+	for _, u := range users {
+		tx.Model(&User{}).Where("uuid = ?", u.UUID).Update("username_key", NormalizeUsername(u.Username))
+	}
+	return tx.Commit().Error
+}
+
+// migrateNameKeys fills the firstname_key and surname_key columns of users created before they existed
+func migrateNameKeys(db *gorm.DB) error {
+	var users []User
+	tx := db.Model(&User{}).Select("uuid", "firstname", "surname").
+		Where("(firstname_key = '' AND firstname <> '') OR (surname_key = '' AND surname <> '')").Find(&users)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, u := range users {
+			err := tx.Model(&User{}).Where("uuid = ?", u.UUID).
+				Updates(map[string]interface{}{"firstname_key": NormalizeUsername(u.Firstname), "surname_key": NormalizeUsername(u.Surname)}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
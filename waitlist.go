@@ -0,0 +1,266 @@
+package wilhelmiina
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// WaitlistEntry is a place in the queue of a full group. The queue is in the order the entries were created.
+type WaitlistEntry struct {
+	gorm.Model
+	GroupID string `gorm:"index"`
+	UUID    string `gorm:"index"`
+}
+
+// SystemSenderID is the sender of the messages wilhelmiina sends by itself, like waitlist notifications
+var SystemSenderID = "system"
+
+var ErrGroupFull = errors.New("group is full")
+
+func getGroupInfo(groupID string, db *gorm.DB) (Group, error) {
+	var group Group
+	tx := db.Where("group_id = ?", groupID).Limit(1).Find(&group)
+	if tx.Error != nil {
+		return Group{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return Group{}, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+// freePlaces returns how many users still fit in the group, or -1 if the group has no capacity limit
+func freePlaces(group Group, db *gorm.DB) (int, error) {
+	if group.Capacity <= 0 {
+		return -1, nil
+	}
+	var count int64
+	tx := db.Model(&GroupReservation{}).Where("group_id = ?", group.GroupID).Count(&count)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	free := group.Capacity - int(count)
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+func isGroupFull(groupID string, db *gorm.DB) (bool, error) {
+	group, err := getGroupInfo(groupID, db)
+	if err == ErrGroupNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	free, err := freePlaces(group, db)
+	if err != nil {
+		return false, err
+	}
+	return free == 0, nil
+}
+
+// SetGroupCapacity changes the maximum size of a group, 0 removes the limit. If the group gets bigger, users on the waitlist get the new places.
+func SetGroupCapacity(groupID string, capacity int, db *gorm.DB) error {
+	if _, err := getGroupInfo(groupID, db); err != nil {
+		return err
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	tx := db.Begin()
+	tx.Model(Group{}).Where("group_id = ?", groupID).Update("capacity", capacity)
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	return promoteFromWaitlist(groupID, db)
+}
+
+var ErrGroupNotFull = errors.New("group has free places, join it directly")
+var ErrAlreadyOnWaitlist = errors.New("user is already on the waitlist")
+var ErrAlreadyInGroup = errors.New("user is already in the group")
+
+// JoinWaitlist puts the user in the queue of a full group. The user gets a message when they get a place in the group.
+// Inactive users can't join, like they can't join groups.
+func JoinWaitlist(UUID string, groupID string, db *gorm.DB) (WaitlistEntry, error) {
+	group, err := getGroupInfo(groupID, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	err = checkUserActive(UUID, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	free, err := freePlaces(group, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	if free != 0 {
+		return WaitlistEntry{}, ErrGroupNotFull
+	}
+	var count int64
+	tx := db.Model(&GroupReservation{}).Where("group_id = ? AND reserver_uuid = ?", groupID, UUID).Count(&count)
+	if tx.Error != nil {
+		return WaitlistEntry{}, tx.Error
+	}
+	if count != 0 {
+		return WaitlistEntry{}, ErrAlreadyInGroup
+	}
+	pos, err := GetWaitlistPosition(UUID, groupID, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	if pos != 0 {
+		return WaitlistEntry{}, ErrAlreadyOnWaitlist
+	}
+	err = checkEnrollmentOpen(UUID, groupID, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	err = checkReservationPrerequisites(UUID, groupID, db)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+
+	entry := WaitlistEntry{GroupID: groupID, UUID: UUID}
+	tx = db.Begin()
+	tx.Create(&entry)
+	err = tx.Commit().Error
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	return entry, nil
+}
+
+var ErrNotOnWaitlist = errors.New("user is not on the waitlist")
+
+func LeaveWaitlist(UUID string, groupID string, db *gorm.DB) error {
+	tx := db.Begin()
+	res := tx.Where("group_id = ? AND uuid = ?", groupID, UUID).Delete(&WaitlistEntry{})
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotOnWaitlist
+	}
+	return nil
+}
+
+// GetWaitlist returns the waitlist of a group, first in line first
+func GetWaitlist(groupID string, db *gorm.DB) ([]WaitlistEntry, error) {
+	entries := []WaitlistEntry{}
+	tx := db.Where("group_id = ?", groupID).Order("id").Find(&entries)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return entries, nil
+}
+
+// GetWaitlistPosition returns the place of the user in the queue starting from 1, or 0 if they are not on the waitlist
+func GetWaitlistPosition(UUID string, groupID string, db *gorm.DB) (int, error) {
+	entries, err := GetWaitlist(groupID, db)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range entries {
+		if e.UUID == UUID {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// promoteFromWaitlist moves users from the waitlist to the group while there is room and lets them know with a message.
+// Users who can't join the group right now, for example because of a schedule conflict, keep their place in the queue.
+func promoteFromWaitlist(groupID string, db *gorm.DB) error {
+	group, err := getGroupInfo(groupID, db)
+	if err == ErrGroupNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	free, err := freePlaces(group, db)
+	if err != nil || free == 0 {
+		return err
+	}
+	entries, err := GetWaitlist(groupID, db)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err = checkReservation(e.UUID, groupID, db)
+		if reservationRefused(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		promoted := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&e).Error; err != nil {
+				return err
+			}
+			_, err := saveReservation(e.UUID, groupID, tx)
+			if err == ErrAlreadyInGroup {
+				return nil
+			}
+			promoted = err == nil
+			return err
+		})
+		if err == ErrGroupFull {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !promoted {
+			continue
+		}
+		title := fmt.Sprintf("You got a place in %s", group.Name)
+		contents := fmt.Sprintf("A place became free in %s and you were moved there from the waitlist.", group.Name)
+		_, err = SendMessage(SystemSenderID, []string{e.UUID}, title, contents, "", db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetGroupCapacityAs changes the capacity of a group if actor is allowed to do so
+func SetGroupCapacityAs(actor User, groupID string, capacity int, db *gorm.DB) error {
+	if err := DefaultAuthorizer.Authorize(actor, ActionGroupEdit, groupID, db); err != nil {
+		return err
+	}
+	return SetGroupCapacity(groupID, capacity, withAudit(db, actor, ActionGroupEdit))
+}
+
+// JoinWaitlistAs puts user UUID on the waitlist if actor is allowed to do so
+func JoinWaitlistAs(actor User, UUID string, groupID string, db *gorm.DB) (WaitlistEntry, error) {
+	action := ActionReservationCreate
+	if actor.UUID == UUID {
+		action = ActionReservationCreateOwn
+	}
+	if err := DefaultAuthorizer.Authorize(actor, action, groupID, db); err != nil {
+		return WaitlistEntry{}, err
+	}
+	return JoinWaitlist(UUID, groupID, withAudit(db, actor, action))
+}
+
+// LeaveWaitlistAs removes user UUID from the waitlist if actor is allowed to do so
+func LeaveWaitlistAs(actor User, UUID string, groupID string, db *gorm.DB) error {
+	action := ActionReservationCancel
+	if actor.UUID == UUID {
+		action = ActionReservationCancelOwn
+	}
+	if err := DefaultAuthorizer.Authorize(actor, action, groupID, db); err != nil {
+		return err
+	}
+	return LeaveWaitlist(UUID, groupID, withAudit(db, actor, action))
+}
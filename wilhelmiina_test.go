@@ -1,12 +1,27 @@
 package wilhelmiina
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
 )
 
+// Hashing with the default policy takes seconds per password, so tests use a much cheaper one
+var testHashPolicy = HashPolicy{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestMain(m *testing.M) {
+	if err := SetHashPolicy(testHashPolicy); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func getTestDatabase(t *testing.T) *gorm.DB {
 	db, _ := InitDatabase(t.TempDir() + "/test.db")
 	CreateTables(db)
@@ -439,3 +454,2300 @@ func TestWilhelmiina(t *testing.T) {
 	_, err = mab2group.GetUsers(db)
 	assert_not(err, nil, t)
 }
+
+func TestSessions(t *testing.T) {
+	db := getTestDatabase(t)
+
+	user, err := CreateUser("session.user", "Sanni", "Sessio", "password1", Student, db)
+	assert(err, nil, t)
+
+	_, err = Login("session.user", "wrongpassword", db)
+	assert(err, ErrInvalidCredentials, t)
+
+	_, err = Login("nonexistant", "password1", db)
+	assert(err, ErrInvalidCredentials, t)
+	// Unknown users are checked against a dummy hash made with the current policy
+	_, ok := dummyHashes[GetHashPolicy()]
+	assert(ok, true, t)
+
+	token, err := Login("session.user", "password1", db)
+	assert(err, nil, t)
+
+	sessionUser, err := ValidateSession(token, db)
+	assert(err, nil, t)
+	assert(sessionUser.UUID, user.UUID, t)
+
+	_, err = ValidateSession("notatoken", db)
+	assert(err, ErrSessionNotFound, t)
+
+	err = RevokeSession(token, db)
+	assert(err, nil, t)
+	_, err = ValidateSession(token, db)
+	assert(err, ErrSessionRevoked, t)
+
+	token2, err := CreateSession(user.UUID, db)
+	assert(err, nil, t)
+	db.Model(Session{}).Where("session_id = ?", hashToken(token2)).Update("expires_at", time.Now().Add(-time.Minute).Unix())
+	_, err = ValidateSession(token2, db)
+	assert(err, ErrSessionExpired, t)
+
+	token3, err := CreateSession(user.UUID, db)
+	assert(err, nil, t)
+	db.Model(Session{}).Where("session_id = ?", hashToken(token3)).Update("absolute_expiry", time.Now().Add(-time.Minute).Unix())
+	_, err = ValidateSession(token3, db)
+	assert(err, ErrSessionExpired, t)
+
+	token4, err := CreateSession(user.UUID, db)
+	assert(err, nil, t)
+	err = RevokeAllSessionsForUser(user.UUID, db)
+	assert(err, nil, t)
+	_, err = ValidateSession(token4, db)
+	assert(err, ErrSessionRevoked, t)
+
+	sessions, err := GetSessionsForUser(user.UUID, db)
+	assert(err, nil, t)
+	assert(len(sessions), 4, t)
+}
+
+func TestPermissions(t *testing.T) {
+	db := getTestDatabase(t)
+
+	admin := User{UUID: "admin", Role: Admin}
+	teacher := User{UUID: "teacher", Role: Teacher}
+	otherTeacher := User{UUID: "teacher2", Role: Teacher}
+	student := User{UUID: "student", Role: Student}
+
+	_, err := CreateUserAs(student, "new.user", "New", "User", "password", Student, db)
+	assert(err, ErrForbidden, t)
+
+	_, err = CreateSubjectAs(teacher, "Fysiikka", "FY", "", db)
+	assert(err, ErrForbidden, t)
+
+	g, err := NewGroupAs(admin, "FY1.1", "c1", time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+
+	err = g.AssingTeacherAs(teacher, teacher.UUID, db)
+	assert(err, ErrForbidden, t)
+	err = g.AssingTeacherAs(admin, teacher.UUID, db)
+	assert(err, nil, t)
+
+	err = ChangeGroupNameAs(otherTeacher, "FY1.2", g.GroupID, db)
+	assert(err, ErrForbidden, t)
+	err = ChangeGroupNameAs(teacher, "FY1.2", g.GroupID, db)
+	assert(err, nil, t)
+	renamed, err := getGroupInfo(g.GroupID, db)
+	assert(err, nil, t)
+	assert(renamed.Name, "FY1.2", t)
+
+	_, err = CreateReservationAs(student, "someoneelse", g.GroupID, db)
+	assert(err, ErrForbidden, t)
+	_, err = CreateReservationAs(student, student.UUID, g.GroupID, db)
+	assert(err, nil, t)
+	_, err = CreateReservationAs(teacher, "student2", g.GroupID, db)
+	assert(err, nil, t)
+	_, err = CreateReservationAs(otherTeacher, "student3", g.GroupID, db)
+	assert(err, ErrForbidden, t)
+
+	msg, err := SendMessageAs(teacher, []string{student.UUID}, "Hei", "Muista läksyt", "", db)
+	assert(err, nil, t)
+	err = DeleteMessageAs(student, msg.MessageID, db)
+	assert(err, ErrForbidden, t)
+	err = DeleteMessageAs(teacher, msg.MessageID, db)
+	assert(err, nil, t)
+
+	err = DeleteUserAs(teacher, student.UUID, db)
+	assert(err, ErrForbidden, t)
+
+	subj, err := CreateSubjectAs(admin, "Fysiikka", "FY", "", db)
+	assert(err, nil, t)
+	err = ChangeSubjectNameAs(teacher, "Kemia", subj.SubjectID, db)
+	assert(err, ErrForbidden, t)
+	err = ChangeSubjectNameAs(admin, "Kemia", subj.SubjectID, db)
+	assert(err, nil, t)
+	subj, err = GetSubject(subj.SubjectID, db)
+	assert(err, nil, t)
+	assert(subj.SubjectName, "Kemia", t)
+	course, err := NewCourseAs(admin, "Kemian perusteet", "KE1", "", subj.SubjectID, db)
+	assert(err, nil, t)
+	err = course.SetNameAs(student, "Aine ja energia", db)
+	assert(err, ErrForbidden, t)
+	err = course.SetNameAs(admin, "Aine ja energia", db)
+	assert(err, nil, t)
+	u, err := CreateUser("perm.user", "Perm", "User", "password1", Student, db)
+	assert(err, nil, t)
+	err = ChangeLastNameAs(student, "Changed", u.UUID, db)
+	assert(err, ErrForbidden, t)
+	err = ChangeLastNameAs(admin, "Changed", u.UUID, db)
+	assert(err, nil, t)
+	u, err = GetUser(u.UUID, db)
+	assert(err, nil, t)
+	assert(u.Surname, "Changed", t)
+
+	// Moderators can't manage users with a higher role
+	mod, err := CreateUser("perm.mod", "Perm", "Moderator", "password1", Moderator, db)
+	assert(err, nil, t)
+	realAdmin, err := CreateUser("perm.admin", "Perm", "Admin", "password1", Admin, db)
+	assert(err, nil, t)
+	err = SetUserStatusAs(mod, realAdmin.UUID, Suspended, db)
+	assert(err, ErrForbidden, t)
+	err = ChangeUserNamesAs(mod, "Perm", "Admin", "hijack", realAdmin.UUID, db)
+	assert(err, ErrForbidden, t)
+	err = SetProfileAs(mod, realAdmin.UUID, ProfileData{Email: "mod@example.com"}, db)
+	assert(err, ErrForbidden, t)
+	err = ChangeLastNameAs(mod, "Changed again", u.UUID, db)
+	assert(err, nil, t)
+	err = SetUserStatusAs(realAdmin, mod.UUID, Suspended, db)
+	assert(err, nil, t)
+
+	ok, err := DefaultAuthorizer.Can(admin, Action("unknown.action"), "", db)
+	assert(err, nil, t)
+	assert(ok, false, t)
+
+	a := NewAuthorizer()
+	a.SetPermission(ActionSubjectCreate, Permission{Roles: []Role{Teacher}})
+	err = a.Authorize(teacher, ActionSubjectCreate, "", db)
+	assert(err, nil, t)
+	err = a.Authorize(admin, ActionSubjectCreate, "", db)
+	assert(err, ErrForbidden, t)
+}
+
+func TestGuardians(t *testing.T) {
+	db := getTestDatabase(t)
+
+	teacher, err := CreateUser("teacher", "Olli", "Opettaja", "teacher", Teacher, db)
+	assert(err, nil, t)
+	student, err := CreateUser("student", "Oona", "Oppilas", "password1", Student, db)
+	assert(err, nil, t)
+	guardian, err := CreateUser("guardian", "Hanna", "Huoltaja", "password2", Guardian, db)
+	assert(err, nil, t)
+
+	_, err = LinkGuardian(teacher.UUID, student.UUID, db)
+	assert(err, ErrNotAGuardian, t)
+	_, err = LinkGuardian(guardian.UUID, teacher.UUID, db)
+	assert(err, ErrNotAStudent, t)
+
+	_, err = GetWardGroups(guardian.UUID, student.UUID, db)
+	assert(err, ErrNotGuardianOf, t)
+
+	_, err = LinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, ErrGuardianAlreadyLinked, t)
+
+	guardians, err := student.GetGuardians(db)
+	assert(err, nil, t)
+	assert(len(guardians), 1, t)
+	assert(guardians[0].UUID, guardian.UUID, t)
+
+	wards, err := guardian.GetWards(db)
+	assert(err, nil, t)
+	assert(len(wards), 1, t)
+	assert(wards[0].UUID, student.UUID, t)
+
+	g, err := NewGroup("ENA1.1", "c1", time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{{StartTime: int64(time.Hour * 8), EndTime: int64(time.Hour * 9), DayOfTheWeek: 1}}, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+
+	wardGroups, err := GetWardGroups(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+	assert(len(wardGroups), 1, t)
+	schedule, err := GetWardSchedule(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+	assert(len(schedule[0].GroupTimes), 1, t)
+
+	// Teacher messages to minors are copied to guardians
+	msg, err := teacher.SendMessage([]string{student.UUID}, "Poissaolot", "Oona oli poissa tänään", "", db)
+	assert(err, nil, t)
+	guardianMessages, err := guardian.GetMessages(db)
+	assert(err, nil, t)
+	assert(len(guardianMessages), 1, t)
+	assert(guardianMessages[0].MessageID, msg.MessageID, t)
+
+	wardMessages, err := GetWardMessages(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+	assert(len(wardMessages), 1, t)
+
+	// Messages between students are not
+	_, err = student.SendMessage([]string{student.UUID}, "Muistiinpano", "", "", db)
+	assert(err, nil, t)
+	guardianMessages, err = guardian.GetMessages(db)
+	assert(err, nil, t)
+	assert(len(guardianMessages), 1, t)
+
+	err = UnlinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+	_, err = GetWards(guardian.UUID, db)
+	assert(err, ErrNoWardsFound, t)
+	err = UnlinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, ErrNotGuardianOf, t)
+}
+
+func TestHashPolicy(t *testing.T) {
+	db := getTestDatabase(t)
+	defer SetHashPolicy(testHashPolicy)
+
+	user, err := CreateUser("hash.user", "Hannu", "Hash", "password1", Student, db)
+	assert(err, nil, t)
+	_, _, p, err := decodeHash(user.Password)
+	assert(err, nil, t)
+	assert(p, testHashPolicy, t)
+
+	err = SetHashPolicy(HashPolicy{Time: 0, Memory: 16 * 1024, Threads: 2, SaltLen: 32, KeyLen: 64})
+	assert(err, ErrInvalidHashPolicy, t)
+	assert(GetHashPolicy(), testHashPolicy, t)
+	newPolicy := HashPolicy{Time: 2, Memory: 16 * 1024, Threads: 2, SaltLen: 32, KeyLen: 64}
+	err = SetHashPolicy(newPolicy)
+	assert(err, nil, t)
+
+	// Stored hashes with parameters argon2 can't handle are rejected instead of hashed with
+	for _, params := range []string{"m=8192,t=0,p=1", "m=8192,t=1,p=0", "m=4294967295,t=1,p=1"} {
+		bad := strings.Replace(user.Password, fmt.Sprintf("m=%d,t=%d,p=%d", testHashPolicy.Memory, testHashPolicy.Time, testHashPolicy.Threads), params, 1)
+		_, err = validatePassword("password1", bad)
+		assert(err, ErrInvalidHash, t)
+	}
+
+	// Old hashes keep working after the policy has changed
+	ok, err := user.CheckPassword("password1")
+	assert(err, nil, t)
+	assert(ok, true, t)
+
+	outdated, err := needsRehash(user.Password)
+	assert(err, nil, t)
+	assert(outdated, true, t)
+
+	_, err = Login("hash.user", "wrongpassword", db)
+	assert(err, ErrInvalidCredentials, t)
+	user, err = GetUser(user.UUID, db)
+	assert(err, nil, t)
+	_, _, p, err = decodeHash(user.Password)
+	assert(err, nil, t)
+	assert(p, testHashPolicy, t)
+
+	_, err = Login("hash.user", "password1", db)
+	assert(err, nil, t)
+	user, err = GetUser(user.UUID, db)
+	assert(err, nil, t)
+	_, _, p, err = decodeHash(user.Password)
+	assert(err, nil, t)
+	assert(p, newPolicy, t)
+
+	ok, err = user.CheckPassword("password1")
+	assert(err, nil, t)
+	assert(ok, true, t)
+
+	_, err = validatePassword("password1", "$argon2i$v=19$m=1,t=1,p=1$abc$abc")
+	assert(err, ErrInvalidHash, t)
+	_, err = validatePassword("password1", "notahash")
+	assert(err, ErrInvalidHash, t)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	db := getTestDatabase(t)
+	defer SetPasswordPolicy(DefaultPasswordPolicy)
+
+	_, err := CreateUser("empty.password", "Tyhjä", "Salasana", "", Student, db)
+	assert(errors.Is(err, ErrWeakPassword), true, t)
+
+	policy := RecommendedPasswordPolicy()
+	denyList := t.TempDir() + "/common.txt"
+	err = os.WriteFile(denyList, []byte("# common passwords\nSalasana123\n\nqwerty\n"), 0644)
+	assert(err, nil, t)
+	err = policy.LoadDenyList(denyList)
+	assert(err, nil, t)
+	SetPasswordPolicy(policy)
+
+	_, err = CreateUser("oona.oppilas", "Oona", "Oppilas", "short", Student, db)
+	policyErr, ok := err.(*PasswordPolicyError)
+	assert(ok, true, t)
+	codes := map[ViolationCode]bool{}
+	for _, v := range policyErr.Violations {
+		codes[v.Code] = true
+	}
+	assert(codes[ViolationTooShort], true, t)
+	assert(codes[ViolationMissingUpper], true, t)
+	assert(codes[ViolationMissingDigit], true, t)
+	assert(codes[ViolationMissingLower], false, t)
+
+	err = CheckPasswordPolicy("OonaOppilas2021", User{Username: "oona.oppilas", Firstname: "Oona", Surname: "Oppilas"})
+	policyErr, ok = err.(*PasswordPolicyError)
+	assert(ok, true, t)
+	assert(policyErr.Violations[0].Code, ViolationContainsPersonalInfo, t)
+
+	err = CheckPasswordPolicy("salasana123", User{})
+	policyErr, ok = err.(*PasswordPolicyError)
+	assert(ok, true, t)
+	assert(policyErr.Violations[len(policyErr.Violations)-1].Code, ViolationCommonPassword, t)
+
+	user, err := CreateUser("oona.oppilas", "Oona", "Oppilas", "Kirahvi4Ever", Student, db)
+	assert(err, nil, t)
+
+	err = ChangePassword("kirahvi", user.UUID, db)
+	assert(errors.Is(err, ErrWeakPassword), true, t)
+	err = ChangePassword("Kirahvi5Ever", user.UUID, db)
+	assert(err, nil, t)
+	err = ChangePassword("Kirahvi5Ever", "nonexistant", db)
+	assert(err, ErrUserNotFound, t)
+}
+
+func TestLockout(t *testing.T) {
+	db := getTestDatabase(t)
+	defer SetLockoutPolicy(DefaultLockoutPolicy)
+	SetLockoutPolicy(LockoutPolicy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		LockoutAfter: 4,
+	})
+
+	assert(backoffDelay(2, GetLockoutPolicy()), time.Duration(0), t)
+	assert(backoffDelay(3, GetLockoutPolicy()), time.Minute, t)
+	assert(backoffDelay(5, GetLockoutPolicy()), 4*time.Minute, t)
+	assert(backoffDelay(100, GetLockoutPolicy()), time.Hour, t)
+
+	user, err := CreateUser("lock.user", "Lauri", "Lukko", "password1", Student, db)
+	assert(err, nil, t)
+
+	for i := 0; i < 2; i++ {
+		_, err = LoginFrom("lock.user", "wrong", "10.0.0.1", db)
+		assert(err, ErrInvalidCredentials, t)
+	}
+	// Third failure starts the backoff
+	_, err = LoginFrom("lock.user", "wrong", "10.0.0.1", db)
+	assert(err, ErrInvalidCredentials, t)
+
+	_, err = LoginFrom("lock.user", "password1", "10.0.0.2", db)
+	throttleErr, ok := err.(*ThrottleError)
+	assert(ok, true, t)
+	assert(throttleErr.RetryAfter > 0, true, t)
+	assert(errors.Is(err, ErrTooManyAttempts), true, t)
+
+	// The source is throttled too, even for other usernames
+	_, err = LoginFrom("someone.else", "password", "10.0.0.1", db)
+	assert(errors.Is(err, ErrTooManyAttempts), true, t)
+
+	// Pretend the backoff has passed
+	db.Model(LoginThrottle{}).Where("throttle_key = ?", userThrottleKey(user.UUID)).Update("blocked_until", 0)
+	_, err = LoginFrom("lock.user", "wrong", "10.0.0.3", db)
+	assert(err, ErrInvalidCredentials, t)
+
+	locked, err := IsLocked(user.UUID, db)
+	assert(err, nil, t)
+	assert(locked, true, t)
+	_, err = LoginFrom("lock.user", "password1", "10.0.0.3", db)
+	assert(err, ErrAccountLocked, t)
+
+	err = UnlockUserAs(user, user.UUID, db)
+	assert(err, ErrForbidden, t)
+	err = UnlockUser(user.UUID, db)
+	assert(err, nil, t)
+
+	_, err = LoginFrom("lock.user", "password1", "10.0.0.3", db)
+	assert(err, nil, t)
+
+	attempts, err := GetLoginAttempts(user.UUID, db)
+	assert(err, nil, t)
+	assert(len(attempts), 7, t)
+	assert(attempts[0].Success, true, t)
+	assert(attempts[1].Reason, AttemptLocked, t)
+
+	sourceAttempts, err := GetLoginAttemptsFromSource("10.0.0.1", db)
+	assert(err, nil, t)
+	assert(len(sourceAttempts), 4, t)
+	assert(sourceAttempts[0].Reason, AttemptThrottled, t)
+	assert(sourceAttempts[0].UUID, "", t)
+
+	// Locks end on their own unless the policy says otherwise
+	assert(DefaultLockoutPolicy.LockoutDuration > 0, true, t)
+	SetLockoutPolicy(LockoutPolicy{LockoutAfter: 2, LockoutDuration: time.Hour})
+	key := userThrottleKey("temporary")
+	for i := 0; i < 2; i++ {
+		err = recordFailure(key, true, time.Now(), db)
+		assert(err, nil, t)
+	}
+	throttle, err := getThrottle(key, db)
+	assert(err, nil, t)
+	assert(throttle.Failures, 2, t)
+	assert(throttle.Locked, true, t)
+	err = checkThrottle(key, time.Now(), db)
+	assert(err, ErrAccountLocked, t)
+	err = checkThrottle(key, time.Now().Add(2*time.Hour), db)
+	assert(err, nil, t)
+}
+
+func TestTOTP(t *testing.T) {
+	db := getTestDatabase(t)
+
+	// RFC 6238 test vector for SHA1
+	assert(hotp([]byte("12345678901234567890"), uint64(59/TOTP_PERIOD), 8), "94287082", t)
+	assert(hotp([]byte("12345678901234567890"), uint64(1111111109/TOTP_PERIOD), 8), "07081804", t)
+
+	teacher, err := CreateUser("teacher", "Olli", "Opettaja", "teacher", Teacher, db)
+	assert(err, nil, t)
+
+	// Two-factor authentication is opt-in
+	assert(TwoFactorRequired(Teacher), false, t)
+	SetTwoFactorRequired(Teacher, true)
+	defer SetTwoFactorRequired(Teacher, false)
+	_, err = Login("teacher", "teacher", db)
+	assert(err, ErrTwoFactorNotEnrolled, t)
+
+	secret, uri, err := EnrollTOTP(teacher.UUID, "Wilhelmiina", db)
+	assert(err, nil, t)
+	assert(strings.HasPrefix(uri, "otpauth://totp/Wilhelmiina:teacher?"), true, t)
+	assert(strings.Contains(uri, "secret="+secret), true, t)
+
+	key, err := b32.DecodeString(secret)
+	assert(err, nil, t)
+	step := totpStep(time.Now())
+
+	_, err = ConfirmTOTP(teacher.UUID, "abcdef", db)
+	assert(err, ErrInvalidCode, t)
+	codes, err := ConfirmTOTP(teacher.UUID, hotp(key, uint64(step), TOTP_DIGITS), db)
+	assert(err, nil, t)
+	assert(len(codes), RECOVERY_CODE_COUNT, t)
+
+	_, _, err = EnrollTOTP(teacher.UUID, "Wilhelmiina", db)
+	assert(err, ErrTOTPAlreadyEnabled, t)
+
+	_, err = Login("teacher", "teacher", db)
+	assert(err, ErrTwoFactorRequired, t)
+
+	// The code used for confirming can't be used again
+	_, err = LoginWithCode("teacher", "teacher", hotp(key, uint64(step), TOTP_DIGITS), "", db)
+	assert(err, ErrInvalidCode, t)
+
+	token, err := LoginWithCode("teacher", "teacher", hotp(key, uint64(step+1), TOTP_DIGITS), "", db)
+	assert(err, nil, t)
+	_, err = ValidateSession(token, db)
+	assert(err, nil, t)
+
+	_, err = LoginWithCode("teacher", "teacher", strings.ToUpper(codes[0]), "", db)
+	assert(err, nil, t)
+	_, err = LoginWithCode("teacher", "teacher", codes[0], "", db)
+	assert(err, ErrInvalidCode, t)
+	ok, err := UseRecoveryCode(teacher.UUID, codes[0], db)
+	assert(err, nil, t)
+	assert(ok, false, t)
+
+	_, err = LoginWithCode("teacher", "wrongpassword", codes[1], "", db)
+	assert(err, ErrInvalidCredentials, t)
+
+	attempts, err := GetLoginAttempts(teacher.UUID, db)
+	assert(err, nil, t)
+	assert(attempts[1].Reason, AttemptInvalidCode, t)
+
+	err = DisableTOTP(teacher.UUID, db)
+	assert(err, nil, t)
+	SetTwoFactorRequired(Teacher, false)
+	_, err = Login("teacher", "teacher", db)
+	assert(err, nil, t)
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := getTestDatabase(t)
+
+	user, err := CreateUser("reset.user", "Riikka", "Reset", "password1", Student, db)
+	assert(err, nil, t)
+
+	token, err := IssuePasswordResetToken(user.UUID, db)
+	assert(err, nil, t)
+	sessionToken, err := Login("reset.user", "password1", db)
+	assert(err, nil, t)
+
+	err = RedeemPasswordResetToken("notatoken", "password2", db)
+	assert(err, ErrInvalidToken, t)
+	err = RedeemPasswordResetToken(token, "", db)
+	assert(errors.Is(err, ErrWeakPassword), true, t)
+
+	err = RedeemPasswordResetToken(token, "password2", db)
+	assert(err, nil, t)
+	err = RedeemPasswordResetToken(token, "password3", db)
+	assert(err, ErrTokenUsed, t)
+
+	_, err = ValidateSession(sessionToken, db)
+	assert(err, ErrSessionRevoked, t)
+	_, err = Login("reset.user", "password1", db)
+	assert(err, ErrInvalidCredentials, t)
+	_, err = Login("reset.user", "password2", db)
+	assert(err, nil, t)
+
+	// Issuing a new token invalidates the old one
+	token1, err := IssuePasswordResetToken(user.UUID, db)
+	assert(err, nil, t)
+	token2, err := IssuePasswordResetToken(user.UUID, db)
+	assert(err, nil, t)
+	err = RedeemPasswordResetToken(token1, "password4", db)
+	assert(err, ErrTokenUsed, t)
+	db.Model(PasswordResetToken{}).Where("token_id = ?", hashToken(token2)).Update("expires_at", time.Now().Add(-time.Minute).Unix())
+	err = RedeemPasswordResetToken(token2, "password4", db)
+	assert(err, ErrTokenExpired, t)
+
+	_, err = IssuePasswordResetToken("nonexistant", db)
+	assert(err, ErrUserNotFound, t)
+
+	// Invitations force the user to choose a password before logging in
+	invited, err := CreateUser("invited.user", "Iida", "Invited", "temporary", Student, db)
+	assert(err, nil, t)
+	invitation, err := IssueInvitationToken(invited.UUID, db)
+	assert(err, nil, t)
+	_, err = Login("invited.user", "temporary", db)
+	assert(err, ErrPasswordChangeRequired, t)
+	_, err = ChangeExpiredPassword("invited.user", "temporary", "", "otherpassword", "", db)
+	assert(err, ErrInvitationPending, t)
+	err = RedeemPasswordResetToken(invitation, "chosenpassword", db)
+	assert(err, nil, t)
+	_, err = Login("invited.user", "chosenpassword", db)
+	assert(err, nil, t)
+
+	err = SetMustChangePassword(invited.UUID, true, db)
+	assert(err, nil, t)
+	_, err = Login("invited.user", "chosenpassword", db)
+	assert(err, ErrPasswordChangeRequired, t)
+	_, err = ChangeExpiredPassword("invited.user", "wrongpassword", "", "newpassword", "", db)
+	assert(err, ErrInvalidCredentials, t)
+	_, err = ChangeExpiredPassword("invited.user", "chosenpassword", "", "chosenpassword", "", db)
+	assert(err, ErrPasswordNotChanged, t)
+	newSession, err := ChangeExpiredPassword("invited.user", "chosenpassword", "", "newpassword", "", db)
+	assert(err, nil, t)
+	_, err = ValidateSession(newSession, db)
+	assert(err, nil, t)
+	_, err = Login("invited.user", "newpassword", db)
+	assert(err, nil, t)
+}
+
+func TestImportRoster(t *testing.T) {
+	db := getTestDatabase(t)
+
+	_, err := CreateUser("existing.student", "Essi", "Olemassa", "password1", Student, db)
+	assert(err, nil, t)
+
+	invalidCSV := `username,firstname,surname,password,role,guardian_of
+new.student,Niko,Uusi,password1,student,
+new.student,Niko,Toinen,password1,student,
+existing.student,Essi,Olemassa,password1,student,
+bad.role,Bad,Role,password1,principal,
+not.guardian,Not,Guardian,password1,teacher,new.student
+`
+	rows, err := ParseRosterCSV(strings.NewReader(invalidCSV))
+	assert(err, nil, t)
+	assert(len(rows), 5, t)
+
+	report, err := ImportRoster(rows, false, db)
+	assert(err, ErrInvalidRoster, t)
+	assert(report.Created, 0, t)
+	assert(len(report.Rows[0].Errors), 0, t)
+	assert(len(report.Rows[1].Errors), 1, t)
+	assert(len(report.Rows[2].Errors), 1, t)
+	assert(len(report.Rows[3].Errors), 1, t)
+	assert(len(report.Rows[4].Errors), 1, t)
+	_, err = GetUserByUn("new.student", db)
+	assert(err, ErrUserNotFound, t)
+
+	validCSV := `role,username,firstname,surname,password,guardian_of
+guardian,new.guardian,Hilkka,Huoltaja,password2,new.student;existing.student
+student,new.student,Niko,Uusi,password1,
+student,invited.student,Iivo,Kutsuttu,,
+`
+	rows, err = ParseRosterCSV(strings.NewReader(validCSV))
+	assert(err, nil, t)
+
+	report, err = ImportRoster(rows, true, db)
+	assert(err, nil, t)
+	assert(report.Valid(), true, t)
+	assert(report.Created, 0, t)
+	_, err = GetUserByUn("new.student", db)
+	assert(err, ErrUserNotFound, t)
+
+	report, err = ImportRoster(rows, false, db)
+	assert(err, nil, t)
+	assert(report.Created, 3, t)
+
+	guardian, err := GetUserByUn("new.guardian", db)
+	assert(err, nil, t)
+	assert(guardian.Role, Guardian, t)
+	wards, err := guardian.GetWards(db)
+	assert(err, nil, t)
+	assert(len(wards), 2, t)
+
+	_, err = Login("new.student", "password1", db)
+	assert(err, nil, t)
+
+	assert(report.Rows[2].InvitationToken != "", true, t)
+	err = RedeemPasswordResetToken(report.Rows[2].InvitationToken, "mypassword", db)
+	assert(err, nil, t)
+	_, err = Login("invited.student", "mypassword", db)
+	assert(err, nil, t)
+
+	jsonRoster := `[{"username": "json.teacher", "firstname": "Jaana", "surname": "Json", "password": "password3", "role": "teacher"}]`
+	rows, err = ParseRosterJSON(strings.NewReader(jsonRoster))
+	assert(err, nil, t)
+	report, err = ImportRoster(rows, false, db)
+	assert(err, nil, t)
+	teacher, err := GetUser(report.Rows[0].UUID, db)
+	assert(err, nil, t)
+	assert(teacher.Username, "json.teacher", t)
+	assert(teacher.Role, Teacher, t)
+
+	_, err = ParseRosterCSV(strings.NewReader("username,firstname\n"))
+	assert_not(err, nil, t)
+
+	// A failing insert rolls back the whole import
+	rows, err = ParseRosterCSV(strings.NewReader("username,firstname,surname,password,role\nrollback.one,Rolf,Back,password1,student\nrollback.two,Rita,Back,,student\n"))
+	assert(err, nil, t)
+	err = db.Migrator().DropTable(&PasswordResetToken{})
+	assert(err, nil, t)
+	_, err = ImportRoster(rows, false, db)
+	assert_not(err, nil, t)
+	_, err = GetUserByUn("rollback.one", db)
+	assert(err, ErrUserNotFound, t)
+}
+
+func TestUsernames(t *testing.T) {
+	db := getTestDatabase(t)
+
+	assert(transliterate("Väinö"), "vaino", t)
+	assert(transliterate("Åkerström"), "akerstrom", t)
+	assert(transliterate("Łukasz Øster-Straße"), "lukaszoster-strasse", t)
+	// Decomposed form of "Äijä"
+	assert(NormalizeUsername("A\u0308ija\u0308"), NormalizeUsername("äijä"), t)
+	assert(NormalizeUsername("Matti.MEIKÄLÄINEN"), "matti.meikäläinen", t)
+
+	un, err := GenerateUsername("Matti Juhani", "Meikäläinen", db)
+	assert(err, nil, t)
+	assert(un, "matti.meikalainen", t)
+
+	_, err = CreateUser(un, "Matti", "Meikäläinen", "password1", Student, db)
+	assert(err, nil, t)
+
+	un, err = GenerateUsername("Matti", "Meikäläinen", db)
+	assert(err, nil, t)
+	assert(un, "matti.meikalainen2", t)
+	_, err = CreateUser(un, "Matti", "Meikäläinen", "password1", Student, db)
+	assert(err, nil, t)
+	un, err = GenerateUsername("MATTI", "MEIKÄLÄINEN", db)
+	assert(err, nil, t)
+	assert(un, "matti.meikalainen3", t)
+
+	un, err = GenerateUsername("Åsa", "", db)
+	assert(err, nil, t)
+	assert(un, "asa", t)
+	_, err = GenerateUsername("", "!!!", db)
+	assert(err, ErrCannotGenerateUsername, t)
+
+	// Usernames are unique regardless of case and Unicode form
+	_, err = CreateUser("Matti.Meikalainen", "Toinen", "Matti", "password1", Student, db)
+	assert(err, ErrUserAlreadyExists, t)
+	user, err := CreateUser("Äijä", "Äijä", "Äijänen", "password1", Student, db)
+	assert(err, nil, t)
+	found, err := GetUserByUn("ÄIJÄ", db)
+	assert(err, nil, t)
+	assert(found.UUID, user.UUID, t)
+
+	// Uniqueness is enforced by the database too
+	tx := db.Create(&User{UUID: "duplicate", Username: "äijä", UsernameKey: NormalizeUsername("äijä")})
+	assert_not(tx.Error, nil, t)
+	// and reported as a taken username when a concurrent write gets there first
+	assert(usernameError(tx.Error), ErrUserAlreadyExists, t)
+
+	// Changing names keeps the username if it is unchanged
+	err = ChangeUserNames("Äijä", "Uusinimi", "Äijä", user.UUID, db)
+	assert(err, nil, t)
+	err = ChangeUsername("matti.meikalainen", user.UUID, db)
+	assert(err, ErrUserAlreadyExists, t)
+	err = ChangeUsername("aija", user.UUID, db)
+	assert(err, nil, t)
+	found, err = GetUserByUn("AIJA", db)
+	assert(err, nil, t)
+	assert(found.UUID, user.UUID, t)
+	assert(found.Surname, "Uusinimi", t)
+}
+
+func TestUsernameKeyMigration(t *testing.T) {
+	db, err := InitDatabase(t.TempDir() + "/old.db")
+	assert(err, nil, t)
+	db.Exec("CREATE TABLE users (uuid text PRIMARY KEY, username text, firstname text, surname text, password text, role integer)")
+	db.Exec("INSERT INTO users (uuid, username, firstname, surname, password, role) VALUES ('u1', 'Old.User', 'Old', 'User', '', 0), ('u2', 'other.user', 'Other', 'User', '', 0)")
+
+	err = CreateTables(db)
+	assert(err, nil, t)
+	u, err := GetUserByUn("old.user", db)
+	assert(err, nil, t)
+	assert(u.UUID, "u1", t)
+	exists, err := UsernameExists("OTHER.USER", db)
+	assert(err, nil, t)
+	assert(exists, true, t)
+	// Names of old users can be searched too
+	page, err := QueryUsers(UserQuery{NamePrefix: "oth"}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 1, t)
+}
+
+func TestUserStatus(t *testing.T) {
+	db := getTestDatabase(t)
+
+	admin := User{UUID: "admin", Role: Admin}
+	student, err := CreateUser("status.student", "Saara", "Status", "password1", Student, db)
+	assert(err, nil, t)
+	other, err := CreateUser("other.student", "Otto", "Toinen", "password1", Student, db)
+	assert(err, nil, t)
+	guardian, err := CreateUser("status.guardian", "Heikki", "Huoltaja", "password1", Guardian, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+
+	g, err := NewGroup("BI1.1", "c1", time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+	_, err = other.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+	_, err = SendMessage(other.UUID, []string{student.UUID, other.UUID}, "Moi", "Mitä kuuluu", "", db)
+	assert(err, nil, t)
+
+	token, err := Login("status.student", "password1", db)
+	assert(err, nil, t)
+
+	// Suspended users can't log in but keep their groups
+	err = SetUserStatus(student.UUID, Suspended, db)
+	assert(err, nil, t)
+	_, err = ValidateSession(token, db)
+	assert(err, ErrSessionRevoked, t)
+	_, err = Login("status.student", "password1", db)
+	assert(err, ErrUserInactive, t)
+	members, err := g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 2, t)
+
+	suspended, err := GetUser(student.UUID, db)
+	assert(err, nil, t)
+	_, err = CreateReservationAs(suspended, suspended.UUID, g.GroupID, db)
+	assert(err, ErrForbidden, t)
+
+	// Graduation archives reservations and messages
+	err = SetUserStatus(student.UUID, Graduated, db)
+	assert(err, nil, t)
+	members, err = g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 1, t)
+	_, err = GetMessagesForId(student.UUID, db)
+	assert(err, ErrNoMessagesFound, t)
+	graduated, err := GetUser(student.UUID, db)
+	assert(err, nil, t)
+	assert_not(graduated.ArchivedAt, int64(0), t)
+	// Messages deleted while the user is archived are not restored
+	removed, err := SendMessage(other.UUID, []string{student.UUID}, "Poistettu", "", "", db)
+	assert(err, nil, t)
+	err = DeleteMessage(removed.MessageID, db)
+	assert(err, nil, t)
+
+	// Later status changes don't move the archive time, so everything is still restored
+	db.Model(User{}).Where("uuid = ?", student.UUID).Update("archived_at", graduated.ArchivedAt-60)
+	err = SetUserStatus(student.UUID, Left, db)
+	assert(err, nil, t)
+	err = SetUserStatus(student.UUID, Suspended, db)
+	assert(err, nil, t)
+	left, err := GetUser(student.UUID, db)
+	assert(err, nil, t)
+	assert(left.ArchivedAt, graduated.ArchivedAt-60, t)
+
+	err = RestoreUser(student.UUID, db)
+	assert(err, nil, t)
+	members, err = g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 2, t)
+	messages, err := GetMessagesForId(student.UUID, db)
+	assert(err, nil, t)
+	assert(len(messages), 1, t)
+	assert(messages[0].Title, "Moi", t)
+	restored, err := GetUser(student.UUID, db)
+	assert(err, nil, t)
+	assert(restored.ArchivedAt, int64(0), t)
+	_, err = Login("status.student", "password1", db)
+	assert(err, nil, t)
+
+	// DeleteUser is a soft delete
+	err = DeleteUserAs(admin, other.UUID, db)
+	assert(err, nil, t)
+	deleted, err := GetUser(other.UUID, db)
+	assert(err, nil, t)
+	assert(deleted.Status, Left, t)
+	members, err = g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 1, t)
+
+	err = SetUserStatus(other.UUID, UserStatus(42), db)
+	assert(err, ErrInvalidStatus, t)
+
+	err = PurgeUserAs(User{UUID: "moderator", Role: Moderator}, student.UUID, db)
+	assert(err, ErrForbidden, t)
+	err = SetProfile(student.UUID, ProfileData{Email: "status.student@example.com", Phone: "0401234567"}, db)
+	assert(err, nil, t)
+	err = PurgeUserAs(admin, student.UUID, db)
+	assert(err, nil, t)
+	_, err = GetUser(student.UUID, db)
+	assert(err, ErrUserNotFound, t)
+	// The audit log keeps the events but not the personal data
+	for _, table := range []string{"users", "user_profiles"} {
+		events, err := GetEntityHistory(table, student.UUID, db)
+		assert(err, nil, t)
+		assert(len(events) > 1, true, t)
+		for _, e := range events {
+			assert(e.Before, "", t)
+			assert(e.After, "", t)
+		}
+	}
+	_, err = guardian.GetWards(db)
+	assert(err, ErrNoWardsFound, t)
+	var reservations int64
+	db.Unscoped().Model(GroupReservation{}).Where("reserver_uuid = ?", student.UUID).Count(&reservations)
+	assert(reservations, int64(0), t)
+}
+
+func TestUserQuery(t *testing.T) {
+	db := getTestDatabase(t)
+
+	names := [][2]string{
+		{"Aino", "Virtanen"}, {"Eino", "Virtanen"}, {"Matti", "Korhonen"}, {"Liisa", "Mäkinen"},
+		{"Aino", "Nieminen"}, {"Pekka", "Mäkelä"}, {"Ville", "Hämäläinen"}, {"Aino", "Virtanen"},
+	}
+	var students []User
+	for _, n := range names {
+		un, err := GenerateUsername(n[0], n[1], db)
+		assert(err, nil, t)
+		u, err := CreateUser(un, n[0], n[1], "password1", Student, db)
+		assert(err, nil, t)
+		students = append(students, u)
+	}
+	teacher, err := CreateUser("opettaja", "Olli", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+
+	// Walking through all pages returns everyone exactly once in order
+	seen := map[string]bool{}
+	var all []UserData
+	q := UserQuery{Limit: 3}
+	for {
+		page, err := QueryUsers(q, db)
+		assert(err, nil, t)
+		all = append(all, page.Users...)
+		if page.NextCursor == "" {
+			break
+		}
+		assert(len(page.Users), 3, t)
+		q.Cursor = page.NextCursor
+	}
+	assert(len(all), len(names)+1, t)
+	for i, u := range all {
+		assert(seen[u.UUID], false, t)
+		seen[u.UUID] = true
+		if i > 0 && all[i-1].Surname > u.Surname {
+			t.Fatalf("users not sorted by surname: %s before %s", all[i-1].Surname, u.Surname)
+		}
+	}
+
+	page, err := QueryUsers(UserQuery{SortBy: SortByFirstname, Limit: 3}, db)
+	assert(err, nil, t)
+	assert(page.Users[0].Firstname, "Aino", t)
+	assert(page.Users[2].Firstname, "Aino", t)
+	assert(page.Users[0].Surname, "Nieminen", t)
+	_, err = QueryUsers(UserQuery{SortBy: SortBySurname, Cursor: page.NextCursor}, db)
+	assert(err, ErrInvalidCursor, t)
+	_, err = QueryUsers(UserQuery{Cursor: "not a cursor"}, db)
+	assert(err, ErrInvalidCursor, t)
+
+	page, err = QueryUsers(UserQuery{Roles: []Role{Teacher}}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 1, t)
+	assert(page.Users[0].UUID, teacher.UUID, t)
+
+	page, err = QueryUsers(UserQuery{NamePrefix: "virt"}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 3, t)
+	page, err = QueryUsers(UserQuery{NamePrefix: "aino.v"}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 2, t)
+	page, err = QueryUsers(UserQuery{NamePrefix: "%"}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 0, t)
+
+	// Letters outside ASCII are matched case-insensitively too
+	aijala, err := CreateUser("aijala", "Äimä", "Äijälä", "password1", Student, db)
+	assert(err, nil, t)
+	for _, prefix := range []string{"äij", "Äij", "ÄIJÄ", "äim"} {
+		page, err = QueryUsers(UserQuery{NamePrefix: prefix}, db)
+		assert(err, nil, t)
+		assert(len(page.Users), 1, t)
+		assert(page.Users[0].UUID, aijala.UUID, t)
+	}
+	err = ChangeLastName("Öhman", aijala.UUID, db)
+	assert(err, nil, t)
+	page, err = QueryUsers(UserQuery{NamePrefix: "öh"}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 1, t)
+	err = DeleteUser(aijala.UUID, db)
+	assert(err, nil, t)
+
+	g, err := NewGroup("MAA1.1", "c1", time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	for _, u := range students[:4] {
+		_, err = u.JoinGroup(g.GroupID, db)
+		assert(err, nil, t)
+	}
+	err = CancelReservation(students[0].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	err = SetUserStatus(students[1].UUID, Suspended, db)
+	assert(err, nil, t)
+
+	page, err = QueryUsers(UserQuery{GroupID: g.GroupID}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 3, t)
+	page, err = QueryUsers(UserQuery{GroupID: g.GroupID, Statuses: []UserStatus{Active}}, db)
+	assert(err, nil, t)
+	assert(len(page.Users), 2, t)
+	assert(page.NextCursor, "", t)
+}
+
+func TestProfiles(t *testing.T) {
+	db := getTestDatabase(t)
+
+	student, err := CreateUser("profile.student", "Pia", "Profiili", "password1", Student, db)
+	assert(err, nil, t)
+	other, err := CreateUser("other.student", "Olli", "Oppilas", "password1", Student, db)
+	assert(err, nil, t)
+	teacher, err := CreateUser("profile.teacher", "Terttu", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+	guardian, err := CreateUser("profile.guardian", "Hannu", "Huoltaja", "password1", Guardian, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+
+	empty, err := GetProfile(student.UUID, db)
+	assert(err, nil, t)
+	assert(empty, ProfileData{}, t)
+	_, err = GetProfile("nobody", db)
+	assert(err, ErrUserNotFound, t)
+
+	dob := time.Now().AddDate(-16, 0, 0).Unix()
+	err = SetProfile(student.UUID, ProfileData{
+		Email:             " pia@example.com ",
+		Phone:             "+358 40 123-4567",
+		StudentNumber:     "1.2.246.562.24.12345678901",
+		DateOfBirth:       dob,
+		HomeroomClass:     "1A",
+		PreferredLanguage: "FI",
+	}, db)
+	assert(err, nil, t)
+	p, err := GetProfile(student.UUID, db)
+	assert(err, nil, t)
+	assert(p.Email, "pia@example.com", t)
+	assert(p.Phone, "+358401234567", t)
+	assert(p.PreferredLanguage, "fi", t)
+	found, err := GetUserByStudentNumber("1.2.246.562.24.12345678901", db)
+	assert(err, nil, t)
+	assert(found.UUID, student.UUID, t)
+
+	invalid := []struct {
+		p   ProfileData
+		err error
+	}{
+		{ProfileData{Email: "not an email"}, ErrInvalidEmail},
+		{ProfileData{Email: "Pia <pia@example.com>"}, ErrInvalidEmail},
+		{ProfileData{Phone: "12ab"}, ErrInvalidPhone},
+		{ProfileData{StudentNumber: "123456"}, ErrInvalidStudentNumber},
+		{ProfileData{DateOfBirth: time.Now().Add(time.Hour).Unix()}, ErrInvalidDateOfBirth},
+		{ProfileData{HomeroomClass: strings.Repeat("A", 40)}, ErrInvalidHomeroomClass},
+		{ProfileData{PreferredLanguage: "finnish"}, ErrInvalidLanguage},
+	}
+	for _, c := range invalid {
+		assert(SetProfile(other.UUID, c.p, db), c.err, t)
+	}
+
+	// Student numbers are unique but profiles without one don't conflict
+	err = SetProfile(other.UUID, ProfileData{StudentNumber: "1.2.246.562.24.12345678901"}, db)
+	assert(err, ErrStudentNumberTaken, t)
+	// The database enforces it even if the lookup misses a concurrent write
+	taken := "1.2.246.562.24.12345678901"
+	tx := db.Save(&UserProfile{UUID: other.UUID, StudentNumber: &taken})
+	assert_not(tx.Error, nil, t)
+	assert(isUniqueViolation(tx.Error), true, t)
+	err = SetProfile(other.UUID, ProfileData{Email: "olli@example.com"}, db)
+	assert(err, nil, t)
+	err = SetProfile(teacher.UUID, ProfileData{Email: "terttu@example.com"}, db)
+	assert(err, nil, t)
+
+	data, err := student.ToDataFor(student, db)
+	assert(err, nil, t)
+	assert(data.Profile.DateOfBirth, dob, t)
+	data, err = student.ToDataFor(guardian, db)
+	assert(err, nil, t)
+	assert(data.Profile.StudentNumber, "1.2.246.562.24.12345678901", t)
+	data, err = student.ToDataFor(teacher, db)
+	assert(err, nil, t)
+	assert(data.Profile.Phone, "+358401234567", t)
+	assert(data.Profile.DateOfBirth, int64(0), t)
+	data, err = student.ToDataFor(other, db)
+	assert(err, nil, t)
+	assert(data.Profile.Email, "pia@example.com", t)
+	assert(data.Profile.Phone, "", t)
+	assert(data.Profile.StudentNumber, "", t)
+	assert(student.ToData().Profile == nil, true, t)
+
+	// Users can edit their own contact details but not the data managed by the school
+	err = SetProfileAs(student, student.UUID, ProfileData{Email: "pia.p@example.com", StudentNumber: p.StudentNumber, DateOfBirth: dob, HomeroomClass: "1A"}, db)
+	assert(err, nil, t)
+	err = SetProfileAs(student, student.UUID, ProfileData{Email: "pia.p@example.com", StudentNumber: p.StudentNumber, DateOfBirth: dob, HomeroomClass: "2B"}, db)
+	assert(err, ErrForbidden, t)
+	err = SetProfileAs(other, student.UUID, ProfileData{}, db)
+	assert(err, ErrForbidden, t)
+	err = SetProfileAs(User{UUID: "admin", Role: Admin}, student.UUID, ProfileData{StudentNumber: p.StudentNumber, HomeroomClass: "2B", DateOfBirth: time.Now().AddDate(-19, 0, 0).Unix()}, db)
+	assert(err, nil, t)
+
+	// Guardians of adult students are no longer added to teachers' messages
+	minor, err := isMinor(student, db)
+	assert(err, nil, t)
+	assert(minor, false, t)
+	_, err = SendMessage(teacher.UUID, []string{student.UUID}, "Tiedote", "Huomenna ei ole koulua", "", db)
+	assert(err, nil, t)
+	_, err = GetMessagesForId(guardian.UUID, db)
+	assert(err, ErrNoMessagesFound, t)
+
+	err = PurgeUser(student.UUID, db)
+	assert(err, nil, t)
+	_, err = GetUserByStudentNumber("1.2.246.562.24.12345678901", db)
+	assert(err, ErrUserNotFound, t)
+}
+
+func TestAuditLog(t *testing.T) {
+	db := getTestDatabase(t)
+	start := time.Now().Unix()
+
+	admin, err := CreateUser("audit.admin", "Aatu", "Admin", "password1", Admin, db)
+	assert(err, nil, t)
+	user, err := CreateUserAs(admin, "audit.user", "Ulla", "Käyttäjä", "password1", Student, db)
+	assert(err, nil, t)
+
+	events, err := GetEntityHistory("users", user.UUID, db)
+	assert(err, nil, t)
+	assert(len(events), 1, t)
+	assert(events[0].ActorID, admin.UUID, t)
+	assert(events[0].Action, string(ActionUserCreate), t)
+	assert(events[0].Operation, AuditCreate, t)
+	assert(strings.Contains(events[0].After, `"username":"audit.user"`), true, t)
+	assert(strings.Contains(events[0].After, `"password":"[redacted]"`), true, t)
+
+	// Updates only record the columns that changed
+	err = ChangeUserNamesAs(admin, "Ulla", "Uusinimi", "audit.user", user.UUID, db)
+	assert(err, nil, t)
+	events, err = GetEntityHistory("users", user.UUID, db)
+	assert(err, nil, t)
+	assert(len(events), 2, t)
+	assert(events[1].Operation, AuditUpdate, t)
+	assert(events[1].Before, `{"surname":"Käyttäjä","surname_key":"käyttäjä"}`, t)
+	assert(events[1].After, `{"surname":"Uusinimi","surname_key":"uusinimi"}`, t)
+
+	// Changes made without an actor are logged too
+	s, err := CreateSubject("Maantieto", "GE", "", db)
+	assert(err, nil, t)
+	c, err := NewCourse("Maailma muutoksessa", "GE1", "", s.SubjectID, db)
+	assert(err, nil, t)
+	err = c.SetName("Maailma", db)
+	assert(err, nil, t)
+	err = DeleteCourseAs(admin, c.CourseID, db)
+	assert(err, nil, t)
+	events, err = GetEntityHistory("courses", c.CourseID, db)
+	assert(err, nil, t)
+	assert(len(events), 3, t)
+	assert(events[0].ActorID, "", t)
+	assert(events[1].After, `{"course_name":"Maailma"}`, t)
+	assert(events[2].Operation, AuditDelete, t)
+	assert(events[2].ActorID, admin.UUID, t)
+	assert(strings.Contains(events[2].Before, `"course_name":"Maailma"`), true, t)
+
+	err = ChangeFirstName("Uljas", user.UUID, WithActor(db, "import-job"))
+	assert(err, nil, t)
+	events, err = GetAuditEvents(AuditQuery{ActorID: "import-job"}, db)
+	assert(err, nil, t)
+	assert(len(events), 1, t)
+	assert(events[0].EntityID, user.UUID, t)
+
+	events, err = GetAuditEvents(AuditQuery{ActorID: admin.UUID, From: start, To: time.Now().Unix()}, db)
+	assert(err, nil, t)
+	assert(len(events), 3, t)
+	events, err = GetAuditEvents(AuditQuery{From: time.Now().Add(time.Hour).Unix()}, db)
+	assert(err, nil, t)
+	assert(len(events), 0, t)
+
+	// Sessions are not logged
+	_, err = Login("audit.user", "password1", db)
+	assert(err, nil, t)
+	events, err = GetAuditEvents(AuditQuery{EntityType: "sessions"}, db)
+	assert(err, nil, t)
+	assert(len(events), 0, t)
+
+	// The log is append-only
+	err = db.Model(&AuditEvent{}).Where("actor_id = ?", admin.UUID).Update("actor_id", "someone").Error
+	assert(err, ErrAuditLogImmutable, t)
+	err = db.Where("actor_id = ?", admin.UUID).Delete(&AuditEvent{}).Error
+	assert(err, ErrAuditLogImmutable, t)
+	events, err = GetAuditEvents(AuditQuery{ActorID: admin.UUID}, db)
+	assert(err, nil, t)
+	assert(len(events), 3, t)
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := getTestDatabase(t)
+
+	admin := User{UUID: "admin", Role: Admin}
+	student, err := CreateUser("api.student", "Sami", "Oppilas", "password1", Student, db)
+	assert(err, nil, t)
+	_, err = CreateServiceAccountAs(student, "lms-sync", "LMS sync", Moderator, db)
+	assert(err, ErrForbidden, t)
+	service, err := CreateServiceAccountAs(admin, "lms-sync", "LMS sync", Moderator, db)
+	assert(err, nil, t)
+	assert(service.IsService, true, t)
+	_, err = CreateServiceAccount("LMS-Sync", "Other", Moderator, db)
+	assert(err, ErrUserAlreadyExists, t)
+
+	// Service accounts can't log in or reset a password
+	_, err = Login("lms-sync", "", db)
+	assert(err, ErrInvalidCredentials, t)
+	_, err = IssuePasswordResetToken(service.UUID, db)
+	assert(err, ErrServiceAccount, t)
+
+	_, _, err = CreateAPIKey(student.UUID, "key", []Action{ActionUserEdit}, 0, db)
+	assert(err, ErrNotAServiceAccount, t)
+	_, _, err = CreateAPIKey(service.UUID, "key", []Action{"no.such.action"}, 0, db)
+	assert(err, ErrInvalidScope, t)
+	_, _, err = CreateAPIKey(service.UUID, "key", nil, 0, db)
+	assert(err, ErrInvalidScope, t)
+
+	key, k, err := CreateAPIKeyAs(admin, service.UUID, "Sync", []Action{ActionUserEdit, ActionUserDelete}, 0, db)
+	assert(err, nil, t)
+	assert(strings.HasPrefix(key, "wsm_"+k.KeyID+"_"), true, t)
+	assert_not(k.Hash, key, t)
+
+	u, authKey, err := AuthenticateAPIKey(key, db)
+	assert(err, nil, t)
+	assert(u.UUID, service.UUID, t)
+	assert(authKey.KeyID, k.KeyID, t)
+	_, _, err = AuthenticateAPIKey(key+"x", db)
+	assert(err, ErrInvalidAPIKey, t)
+	_, _, err = AuthenticateAPIKey("garbage", db)
+	assert(err, ErrInvalidAPIKey, t)
+
+	// Both the scope and the role of the account must allow the action
+	actor, err := AuthorizeAPIKey(key, ActionUserEdit, student.UUID, db)
+	assert(err, nil, t)
+	err = ChangeUserNamesAs(actor, "Sami", "Synkattu", "api.student", student.UUID, db)
+	assert(err, nil, t)
+	// and the scopes stay with the account returned for the key
+	err = SetUserStatusAs(actor, student.UUID, Suspended, db)
+	assert(err, ErrForbidden, t)
+	_, err = AuthorizeAPIKey(key, ActionSubjectCreate, "", db)
+	assert(err, ErrForbidden, t)
+	_, err = AuthorizeAPIKey(key, ActionUserDelete, student.UUID, db)
+	assert(err, ErrForbidden, t)
+
+	expiring, _, err := CreateAPIKey(service.UUID, "Short", []Action{ActionUserEdit}, time.Second, db)
+	assert(err, nil, t)
+	db.Model(&APIKey{}).Where("name = ?", "Short").Update("expires_at", time.Now().Add(-time.Minute).Unix())
+	_, _, err = AuthenticateAPIKey(expiring, db)
+	assert(err, ErrAPIKeyExpired, t)
+
+	err = RevokeAPIKeyAs(student, k.KeyID, db)
+	assert(err, ErrForbidden, t)
+	err = RevokeAPIKeyAs(admin, k.KeyID, db)
+	assert(err, nil, t)
+	_, _, err = AuthenticateAPIKey(key, db)
+	assert(err, ErrAPIKeyRevoked, t)
+	err = RevokeAPIKey(k.KeyID, db)
+	assert(err, ErrAPIKeyNotFound, t)
+
+	keys, err := GetAPIKeys(service.UUID, db)
+	assert(err, nil, t)
+	assert(len(keys), 2, t)
+
+	// Keys of suspended accounts stop working
+	key, _, err = CreateAPIKey(service.UUID, "New", []Action{ActionUserEdit}, 0, db)
+	assert(err, nil, t)
+	err = SetUserStatus(service.UUID, Suspended, db)
+	assert(err, nil, t)
+	_, _, err = AuthenticateAPIKey(key, db)
+	assert(err, ErrUserInactive, t)
+}
+
+func TestClasses(t *testing.T) {
+	db := getTestDatabase(t)
+
+	admin := User{UUID: "admin", Role: Admin}
+	teacher, err := CreateUser("class.teacher", "Tuula", "Luokanvalvoja", "password1", Teacher, db)
+	assert(err, nil, t)
+	otherTeacher, err := CreateUser("other.teacher", "Oskari", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+	var students []User
+	for _, un := range []string{"aada.a", "bertta.b", "cecilia.c"} {
+		s, err := CreateUser(un, un[:len(un)-2], un[len(un)-1:], "password1", Student, db)
+		assert(err, nil, t)
+		students = append(students, s)
+	}
+	guardian, err := CreateUser("class.guardian", "Kaisa", "Huoltaja", "password1", Guardian, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, students[0].UUID, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, students[1].UUID, db)
+	assert(err, nil, t)
+
+	_, err = NewClass("1A", 2021, students[0].UUID, db)
+	assert(err, ErrNotATeacher, t)
+	_, err = NewClassAs(teacher, "1A", 2021, teacher.UUID, db)
+	assert(err, ErrForbidden, t)
+	a, err := NewClassAs(admin, "1A", 2021, teacher.UUID, db)
+	assert(err, nil, t)
+	b, err := NewClass("1B", 2021, "", db)
+	assert(err, nil, t)
+	c, err := NewClass("2A", 2020, otherTeacher.UUID, db)
+	assert(err, nil, t)
+	classes, err := GetClasses(2021, db)
+	assert(err, nil, t)
+	assert(len(classes), 2, t)
+	assert(classes[0].Name, "1A", t)
+
+	// The homeroom teacher manages the members of their own class
+	for _, s := range students {
+		_, err = AddClassMemberAs(teacher, a.ClassID, s.UUID, db)
+		assert(err, nil, t)
+	}
+	_, err = AddClassMemberAs(otherTeacher, a.ClassID, students[0].UUID, db)
+	assert(err, ErrForbidden, t)
+	_, err = AddClassMember(a.ClassID, guardian.UUID, db)
+	assert(err, ErrNotAStudent, t)
+	members, err := GetClassMembers(a.ClassID, db)
+	assert(err, nil, t)
+	assert(len(members), 3, t)
+	profile, err := GetProfile(students[0].UUID, db)
+	assert(err, nil, t)
+	assert(profile.HomeroomClass, "1A", t)
+
+	// Moving to another class leaves the old one
+	_, err = AddClassMember(b.ClassID, students[2].UUID, db)
+	assert(err, nil, t)
+	class, err := GetStudentClass(students[2].UUID, db)
+	assert(err, nil, t)
+	assert(class.ClassID, b.ClassID, t)
+	members, err = GetClassMembers(a.ClassID, db)
+	assert(err, nil, t)
+	assert(len(members), 2, t)
+	profile, err = GetProfile(students[2].UUID, db)
+	assert(err, nil, t)
+	assert(profile.HomeroomClass, "1B", t)
+
+	// A homeroom teacher can't take students from classes they don't manage
+	_, err = AddClassMemberAs(otherTeacher, c.ClassID, students[0].UUID, db)
+	assert(err, ErrForbidden, t)
+	class, err = GetStudentClass(students[0].UUID, db)
+	assert(err, nil, t)
+	assert(class.ClassID, a.ClassID, t)
+
+	guardians, err := GetClassGuardians(a.ClassID, db)
+	assert(err, nil, t)
+	assert(len(guardians), 1, t)
+	assert(guardians[0].UUID, guardian.UUID, t)
+
+	_, err = SendClassMessage(teacher.UUID, b.ClassID, "Tervetuloa", "", false, db)
+	assert(err, nil, t)
+	_, err = SendClassMessageAs(otherTeacher, a.ClassID, "Hei", "", true, db)
+	assert(err, ErrForbidden, t)
+	// Guardians of minors are not added when the teacher leaves them out
+	_, err = SendClassMessageAs(teacher, a.ClassID, "Retki", "", false, db)
+	assert(err, nil, t)
+	_, err = GetMessagesForId(guardian.UUID, db)
+	assert(err, ErrNoMessagesFound, t)
+	m, err := SendClassMessageAs(teacher, a.ClassID, "Vanhempainilta", "Tervetuloa vanhempainiltaan", true, db)
+	assert(err, nil, t)
+	var recievers int64
+	db.Model(&MessageReciever{}).Where("message_id = ?", m.MessageID).Count(&recievers)
+	assert(recievers, int64(4), t)
+	messages, err := GetMessagesForId(guardian.UUID, db)
+	assert(err, nil, t)
+	assert(len(messages), 1, t)
+	messages, err = GetMessagesForId(students[2].UUID, db)
+	assert(err, nil, t)
+	assert(len(messages), 1, t)
+
+	err = RemoveClassMember(a.ClassID, students[2].UUID, db)
+	assert(err, ErrNotClassMember, t)
+	err = RemoveClassMemberAs(teacher, a.ClassID, students[1].UUID, db)
+	assert(err, nil, t)
+	_, err = GetStudentClass(students[1].UUID, db)
+	assert(err, ErrNoClass, t)
+
+	err = SetHomeroomTeacherAs(admin, a.ClassID, otherTeacher.UUID, db)
+	assert(err, nil, t)
+	_, err = AddClassMemberAs(teacher, a.ClassID, students[1].UUID, db)
+	assert(err, ErrForbidden, t)
+
+	err = DeleteClassAs(admin, a.ClassID, db)
+	assert(err, nil, t)
+	profile, err = GetProfile(students[0].UUID, db)
+	assert(err, nil, t)
+	assert(profile.HomeroomClass, "", t)
+	_, err = GetClass(a.ClassID, db)
+	assert(err, ErrClassNotFound, t)
+}
+
+func TestPeriods(t *testing.T) {
+	db := getTestDatabase(t)
+
+	date := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	admin := User{UUID: "admin", Role: Admin}
+
+	_, err := NewSchoolYear("2021-2022", date(2022, 6, 1), date(2021, 8, 1), db)
+	assert(err, ErrInvalidDateRange, t)
+	_, err = NewSchoolYearAs(User{UUID: "teacher", Role: Teacher}, "2021-2022", date(2021, 8, 1), date(2022, 6, 1), db)
+	assert(err, ErrForbidden, t)
+	year, err := NewSchoolYearAs(admin, "2021-2022", date(2021, 8, 1), date(2022, 6, 1), db)
+	assert(err, nil, t)
+	_, err = NewSchoolYear("Overlapping", date(2022, 5, 1), date(2023, 6, 1), db)
+	assert(err, ErrSchoolYearOverlap, t)
+
+	p1, err := NewPeriodAs(admin, year.SchoolYearID, 1, "Period 1", date(2021, 8, 11), date(2021, 10, 15), db)
+	assert(err, nil, t)
+	p3, err := NewPeriod(year.SchoolYearID, 3, "Period 3", date(2021, 12, 1), date(2022, 2, 10), db)
+	assert(err, nil, t)
+	p2, err := NewPeriod(year.SchoolYearID, 2, "Period 2", date(2021, 10, 18), date(2021, 11, 30), db)
+	assert(err, nil, t)
+	_, err = NewPeriod(year.SchoolYearID, 2, "Period 2 again", date(2022, 2, 11), date(2022, 3, 1), db)
+	assert(err, ErrPeriodExists, t)
+	_, err = NewPeriod(year.SchoolYearID, 4, "Period 4", date(2022, 2, 1), date(2022, 3, 31), db)
+	assert(err, ErrPeriodOverlap, t)
+	_, err = NewPeriod(year.SchoolYearID, 5, "Period 5", date(2022, 4, 1), date(2022, 6, 30), db)
+	assert(err, ErrPeriodOutsideSchoolYear, t)
+
+	periods, err := GetPeriods(year.SchoolYearID, db)
+	assert(err, nil, t)
+	assert(len(periods), 3, t)
+	assert(periods[1].PeriodID, p2.PeriodID, t)
+	current, err := GetPeriodAt(date(2021, 11, 1), db)
+	assert(err, nil, t)
+	assert(current.PeriodID, p2.PeriodID, t)
+	_, err = GetPeriodAt(date(2021, 10, 16), db)
+	assert(err, ErrPeriodNotFound, t)
+
+	g1, err := NewGroupInPeriod("MAA3.1", "c1", p3.PeriodID, []GroupTimeData{}, db)
+	assert(err, nil, t)
+	assert(g1.StartDate, p3.StartDate, t)
+	g2, err := NewGroup("ENA1.1", "c2", date(2021, 8, 11), date(2021, 10, 1), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	err = SetGroupPeriod(g2.GroupID, p2.PeriodID, db)
+	assert(err, ErrGroupOutsidePeriod, t)
+	err = SetGroupPeriodAs(admin, g2.GroupID, p1.PeriodID, db)
+	assert(err, nil, t)
+	err = SetGroupPeriod("nogroup", p1.PeriodID, db)
+	assert(err, ErrGroupNotFound, t)
+
+	groups, err := GetGroupsInPeriod(p3.PeriodID, db)
+	assert(err, nil, t)
+	assert(len(groups), 1, t)
+	assert(groups[0].GroupID, g1.GroupID, t)
+	groups, err = GetGroupsInSchoolYear(year.SchoolYearID, db)
+	assert(err, nil, t)
+	assert(len(groups), 2, t)
+
+	err = DeletePeriod(p1.PeriodID, db)
+	assert(err, ErrPeriodHasGroups, t)
+	err = DeletePeriodAs(admin, p2.PeriodID, db)
+	assert(err, nil, t)
+	err = DeleteSchoolYear(year.SchoolYearID, db)
+	assert(err, ErrSchoolYearHasPeriods, t)
+}
+
+func TestCredits(t *testing.T) {
+	db := getTestDatabase(t)
+
+	student, err := CreateUser("credit.student", "Kalle", "Kurssilainen", "password1", Student, db)
+	assert(err, nil, t)
+	teacher, err := CreateUser("credit.teacher", "Outi", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+	math, err := CreateSubject("Matematiikka", "MA", "", db)
+	assert(err, nil, t)
+	english, err := CreateSubject("Englanti", "EN", "", db)
+	assert(err, nil, t)
+
+	newCourse := func(name string, subjectID string, credits int, courseType CourseType, level string) Course {
+		c, err := NewCourse(name, name, "", subjectID, db)
+		assert(err, nil, t)
+		err = c.SetStudyInfo(credits, courseType, level, db)
+		assert(err, nil, t)
+		return c
+	}
+	maa2 := newCourse("MAA2", math.SubjectID, 3, Mandatory, "pitkä")
+	maa3 := newCourse("MAA3", math.SubjectID, 2, Mandatory, "pitkä")
+	maa12 := newCourse("MAA12", math.SubjectID, 2, NationalElective, "pitkä")
+	ena1 := newCourse("ENA1", english.SubjectID, 2, Mandatory, "A")
+	ena9 := newCourse("ENA9", english.SubjectID, 2, SchoolElective, "A")
+
+	course, err := GetCourse(maa2.CourseID, db)
+	assert(err, nil, t)
+	assert(course.Credits, 3, t)
+	assert(course.Level, "pitkä", t)
+	assert(maa12.Type.String(), "national_elective", t)
+	assert(maa2.SetStudyInfo(-1, Mandatory, "", db), ErrInvalidCredits, t)
+	assert(maa2.SetStudyInfo(2, CourseType(9), "", db), ErrInvalidCourseType, t)
+
+	_, err = RecordCompletion(student.UUID, maa2.CourseID, 11, 0, db)
+	assert(err, ErrInvalidGrade, t)
+	_, err = RecordCompletion(teacher.UUID, maa2.CourseID, 8, 0, db)
+	assert(err, ErrNotAStudent, t)
+
+	// Only teachers of the course can grade it
+	_, err = RecordCompletionAs(teacher, student.UUID, maa2.CourseID, 8, 0, db)
+	assert(err, ErrForbidden, t)
+	g, err := NewGroup("MAA2.1", maa2.CourseID, time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	err = g.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	// and only the students of their own groups
+	_, err = RecordCompletionAs(teacher, student.UUID, maa2.CourseID, 8, 0, db)
+	assert(err, ErrForbidden, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+	_, err = RecordCompletionAs(teacher, student.UUID, maa2.CourseID, 8, 0, db)
+	assert(err, nil, t)
+
+	// A failed course doesn't count but a passed retake does, and only once
+	_, err = RecordCompletion(student.UUID, maa3.CourseID, 4, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, maa12.CourseID, 7, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, ena1.CourseID, 9, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, ena1.CourseID, 10, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, ena9.CourseID, 6, 0, db)
+	assert(err, nil, t)
+
+	best, err := GetBestGrades(student.UUID, db)
+	assert(err, nil, t)
+	assert(best[ena1.CourseID], 10, t)
+	summary, err := GetCreditSummary(student.UUID, db)
+	assert(err, nil, t)
+	assert(summary.Total, 9, t)
+	assert(summary.Mandatory, 5, t)
+	assert(summary.NationalElective, 2, t)
+	assert(summary.SchoolElective, 2, t)
+	assert(summary.BySubject[math.SubjectID], 5, t)
+
+	_, err = AddSubjectRequirementAs(teacher, math.SubjectID, "pitkä", Mandatory, 5, db)
+	assert(err, ErrForbidden, t)
+	_, err = AddSubjectRequirementAs(User{UUID: "admin", Role: Admin}, math.SubjectID, "pitkä", Mandatory, 5, db)
+	assert(err, nil, t)
+	_, err = AddSubjectRequirement(english.SubjectID, "A", Mandatory, 2, db)
+	assert(err, nil, t)
+
+	status, err := CheckCurriculum(student.UUID, db)
+	assert(err, nil, t)
+	assert(len(status.Requirements), 2, t)
+	assert(status.Requirements[0].Credits, 3, t)
+	assert(status.Requirements[0].Met, false, t)
+	assert(status.Requirements[1].Met, true, t)
+	assert(status.Complete, false, t)
+
+	_, err = RecordCompletion(student.UUID, maa3.CourseID, 5, 0, db)
+	assert(err, nil, t)
+	RequiredTotalCredits, RequiredNationalElectiveCredits = 10, 2
+	defer func() { RequiredTotalCredits, RequiredNationalElectiveCredits = 150, 20 }()
+	status, err = CheckCurriculum(student.UUID, db)
+	assert(err, nil, t)
+	assert(status.Requirements[0].Met, true, t)
+	assert(status.Credits.Total, 11, t)
+	assert(status.Complete, true, t)
+}
+
+func TestPrerequisites(t *testing.T) {
+	db := getTestDatabase(t)
+
+	student, err := CreateUser("prereq.student", "Pekka", "Pohjatieto", "password1", Student, db)
+	assert(err, nil, t)
+	math, err := CreateSubject("Matematiikka", "MA", "", db)
+	assert(err, nil, t)
+	newCourse := func(name string) Course {
+		c, err := NewCourse(name, name, "", math.SubjectID, db)
+		assert(err, nil, t)
+		return c
+	}
+	maa1, maa2, maa3, mab2, maa4 := newCourse("MAA1"), newCourse("MAA2"), newCourse("MAA3"), newCourse("MAB2"), newCourse("MAA4")
+
+	_, err = AddPrerequisite(maa4.CourseID, AllOf, nil, 0, db)
+	assert(err, ErrInvalidPrerequisite, t)
+	_, err = AddPrerequisite(maa4.CourseID, AllOf, []string{maa1.CourseID}, 3, db)
+	assert(err, ErrInvalidGrade, t)
+	_, err = AddPrerequisite(maa4.CourseID, AllOf, []string{"nocourse"}, 0, db)
+	assert(err, ErrCourseNotFound, t)
+	_, err = AddPrerequisiteAs(User{UUID: "teacher", Role: Teacher}, maa4.CourseID, AllOf, []string{maa1.CourseID}, 0, db)
+	assert(err, ErrForbidden, t)
+
+	// MAA4 needs MAA1 and MAA3 with at least 7, and either MAA2 or MAB2
+	_, err = AddPrerequisiteAs(User{UUID: "admin", Role: Admin}, maa4.CourseID, AllOf, []string{maa1.CourseID, maa3.CourseID}, 7, db)
+	assert(err, nil, t)
+	_, err = AddPrerequisite(maa4.CourseID, AnyOf, []string{maa2.CourseID, mab2.CourseID}, 0, db)
+	assert(err, nil, t)
+	_, err = AddPrerequisite(maa3.CourseID, AllOf, []string{maa1.CourseID}, 0, db)
+	assert(err, nil, t)
+	_, err = AddPrerequisite(maa1.CourseID, AllOf, []string{maa4.CourseID}, 0, db)
+	assert(err, ErrPrerequisiteCycle, t)
+	_, err = AddPrerequisite(maa1.CourseID, AllOf, []string{maa1.CourseID}, 0, db)
+	assert(err, ErrPrerequisiteCycle, t)
+
+	g, err := NewGroup("MAA4.1", maa4.CourseID, time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(errors.Is(err, ErrPrerequisitesNotMet), true, t)
+	var perr *PrerequisitesError
+	assert(errors.As(err, &perr), true, t)
+	assert(len(perr.Missing), 2, t)
+	assert(len(perr.Missing[0].Courses), 2, t)
+	assert(err.Error(), "prerequisites not met: requires all of MAA1, MAA3 with grade 7 or better; one of MAA2, MAB2", t)
+
+	_, err = RecordCompletion(student.UUID, maa1.CourseID, 9, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, maa3.CourseID, 6, 0, db)
+	assert(err, nil, t)
+	_, err = RecordCompletion(student.UUID, mab2.CourseID, 5, 0, db)
+	assert(err, nil, t)
+	err = CheckPrerequisites(student.UUID, maa4.CourseID, db)
+	assert(errors.As(err, &perr), true, t)
+	assert(len(perr.Missing), 1, t)
+	assert(perr.Missing[0].Courses[0].CourseID, maa3.CourseID, t)
+
+	_, err = RecordCompletion(student.UUID, maa3.CourseID, 8, 0, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+
+	// Teachers are not students of the course
+	teacher, err := CreateUser("prereq.teacher", "Tiina", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+	_, err = teacher.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+
+	// Owner rules get the course of the rule as target, so teachers can be allowed to edit their own courses
+	editPermission, _ := DefaultAuthorizer.GetPermission(ActionCourseEdit)
+	DefaultAuthorizer.SetPermission(ActionCourseEdit, Permission{Roles: staffRoles, OwnerRoles: []Role{Teacher}, IsOwner: isCourseTeacher})
+	defer DefaultAuthorizer.SetPermission(ActionCourseEdit, editPermission)
+	maa3Rules, err := GetPrerequisites(maa3.CourseID, db)
+	assert(err, nil, t)
+	err = RemovePrerequisiteAs(teacher, maa3Rules[0].ID, db)
+	assert(err, ErrForbidden, t)
+	h, err := NewGroup("MAA3.1", maa3.CourseID, time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	err = h.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	err = RemovePrerequisiteAs(teacher, maa3Rules[0].ID, db)
+	assert(err, nil, t)
+	err = RemovePrerequisiteAs(teacher, maa3Rules[0].ID, db)
+	assert(err, ErrPrerequisiteNotFound, t)
+
+	// Deleting a course removes it from the rules that require it and drops rules left empty
+	_, err = AddPrerequisite(maa3.CourseID, AllOf, []string{maa1.CourseID}, 0, db)
+	assert(err, nil, t)
+	err = DeleteCourse(maa1.CourseID, db)
+	assert(err, nil, t)
+	rules, err := GetPrerequisites(maa3.CourseID, db)
+	assert(err, nil, t)
+	assert(len(rules), 0, t)
+	rules, err = GetPrerequisites(maa4.CourseID, db)
+	assert(err, nil, t)
+	assert(len(rules), 2, t)
+	assert(rules[0].RequiredCourses, maa3.CourseID, t)
+	err = DeleteCourse(mab2.CourseID, db)
+	assert(err, nil, t)
+	rules, err = GetPrerequisites(maa4.CourseID, db)
+	assert(err, nil, t)
+	assert(rules[1].RequiredCourses, maa2.CourseID, t)
+}
+
+func TestWaitlist(t *testing.T) {
+	db := getTestDatabase(t)
+
+	var students []User
+	for _, un := range []string{"w.one", "w.two", "w.three", "w.four"} {
+		s, err := CreateUser(un, "Wait", un, "password1", Student, db)
+		assert(err, nil, t)
+		students = append(students, s)
+	}
+	g, err := NewGroup("FY1.1", "c1", time.Now().Unix(), time.Now().Add(24*time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	err = SetGroupCapacityAs(User{UUID: "teacher", Role: Teacher}, g.GroupID, 2, db)
+	assert(err, ErrForbidden, t)
+	err = SetGroupCapacity(g.GroupID, 2, db)
+	assert(err, nil, t)
+
+	_, err = JoinWaitlist(students[0].UUID, g.GroupID, db)
+	assert(err, ErrGroupNotFull, t)
+	_, err = students[0].JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+	_, err = students[1].JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+	_, err = students[2].JoinGroup(g.GroupID, db)
+	assert(err, ErrGroupFull, t)
+
+	_, err = JoinWaitlist(students[0].UUID, g.GroupID, db)
+	assert(err, ErrAlreadyInGroup, t)
+	_, err = JoinWaitlistAs(students[2], students[2].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	// Inactive users can't join the waitlist
+	err = SetUserStatus(students[3].UUID, Suspended, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(students[3].UUID, g.GroupID, db)
+	assert(err, ErrUserInactive, t)
+	err = RestoreUser(students[3].UUID, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(students[3].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(students[3].UUID, g.GroupID, db)
+	assert(err, ErrAlreadyOnWaitlist, t)
+	pos, err := GetWaitlistPosition(students[3].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	assert(pos, 2, t)
+
+	// The first one in line gets the free place and a message about it
+	err = CancelReservation(students[0].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	members, err := g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 2, t)
+	waitlist, err := GetWaitlist(g.GroupID, db)
+	assert(err, nil, t)
+	assert(len(waitlist), 1, t)
+	assert(waitlist[0].UUID, students[3].UUID, t)
+	messages, err := GetMessagesForId(students[2].UUID, db)
+	assert(err, nil, t)
+	assert(len(messages), 1, t)
+	assert(messages[0].From, SystemSenderID, t)
+	assert(messages[0].Title, "You got a place in FY1.1", t)
+	_, err = GetMessagesForId(students[3].UUID, db)
+	assert(err, ErrNoMessagesFound, t)
+
+	err = LeaveWaitlistAs(students[3], students[3].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	err = LeaveWaitlist(students[3].UUID, g.GroupID, db)
+	assert(err, ErrNotOnWaitlist, t)
+
+	// Growing the group promotes from the waitlist too
+	_, err = JoinWaitlist(students[0].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	err = SetGroupCapacity(g.GroupID, 0, db)
+	assert(err, nil, t)
+	members, err = g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 3, t)
+	waitlist, err = GetWaitlist(g.GroupID, db)
+	assert(err, nil, t)
+	assert(len(waitlist), 0, t)
+	_, err = students[0].JoinGroup(g.GroupID, db)
+	assert(err, ErrAlreadyInGroup, t)
+
+	// Promotion skips users who can't join the group, they keep their place in the queue
+	err = SetGroupCapacity(g.GroupID, 3, db)
+	assert(err, nil, t)
+	suspended, err := CreateUser("w.five", "Wait", "five", "password1", Student, db)
+	assert(err, nil, t)
+	next, err := CreateUser("w.six", "Wait", "six", "password1", Student, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(suspended.UUID, g.GroupID, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(next.UUID, g.GroupID, db)
+	assert(err, nil, t)
+	_, err = JoinWaitlist(students[1].UUID, g.GroupID, db)
+	assert(err, ErrAlreadyInGroup, t)
+	err = SetUserStatus(suspended.UUID, Suspended, db)
+	assert(err, nil, t)
+
+	// A graduating student frees their place
+	err = SetUserStatus(students[1].UUID, Graduated, db)
+	assert(err, nil, t)
+	waitlist, err = GetWaitlist(g.GroupID, db)
+	assert(err, nil, t)
+	assert(len(waitlist), 1, t)
+	assert(waitlist[0].UUID, suspended.UUID, t)
+	pos, err = GetWaitlistPosition(next.UUID, g.GroupID, db)
+	assert(err, nil, t)
+	assert(pos, 0, t)
+
+	// and gets back in the queue instead of overfilling the group when they are restored
+	err = RestoreUser(students[1].UUID, db)
+	assert(err, nil, t)
+	members, err = g.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 3, t)
+	pos, err = GetWaitlistPosition(students[1].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	assert(pos, 2, t)
+
+	// Archived users leave the waitlists
+	err = SetUserStatus(suspended.UUID, Left, db)
+	assert(err, nil, t)
+	pos, err = GetWaitlistPosition(students[1].UUID, g.GroupID, db)
+	assert(err, nil, t)
+	assert(pos, 1, t)
+}
+
+func TestEnrollment(t *testing.T) {
+	db := getTestDatabase(t)
+
+	now := time.Now()
+	year, err := NewSchoolYear("This year", now.Add(-24*time.Hour).Unix(), now.Add(300*24*time.Hour).Unix(), db)
+	assert(err, nil, t)
+	period, err := NewPeriod(year.SchoolYearID, 1, "Period 1", year.StartDate, now.Add(60*24*time.Hour).Unix(), db)
+	assert(err, nil, t)
+	g1, err := NewGroupInPeriod("MAA2.1", "c1", period.PeriodID, []GroupTimeData{}, db)
+	assert(err, nil, t)
+	g2, err := NewGroupInPeriod("MAA2.2", "c1", period.PeriodID, []GroupTimeData{}, db)
+	assert(err, nil, t)
+	var students []User
+	for _, un := range []string{"e.one", "e.two", "e.three", "e.four"} {
+		s, err := CreateUser(un, "Enroll", un, "password1", Student, db)
+		assert(err, nil, t)
+		students = append(students, s)
+	}
+	teacher, err := CreateUser("e.teacher", "Enroll", "Teacher", "password1", Teacher, db)
+	assert(err, nil, t)
+
+	// A closed period window closes every group of the period, a group window overrides it
+	_, err = AddPeriodEnrollmentWindowAs(students[0], period.PeriodID, now.Add(24*time.Hour).Unix(), now.Add(48*time.Hour).Unix(), db)
+	assert(err, ErrForbidden, t)
+	_, err = AddPeriodEnrollmentWindow(period.PeriodID, now.Add(24*time.Hour).Unix(), now.Add(48*time.Hour).Unix(), db)
+	assert(err, nil, t)
+	_, err = students[0].JoinGroup(g1.GroupID, db)
+	assert(err, ErrEnrollmentClosed, t)
+	_, err = CreateReservation(teacher.UUID, g1.GroupID, db)
+	assert(err, nil, t)
+	w, err := AddGroupEnrollmentWindow(g2.GroupID, now.Add(-time.Hour).Unix(), now.Add(time.Hour).Unix(), db)
+	assert(err, nil, t)
+	_, err = students[0].JoinGroup(g2.GroupID, db)
+	assert(err, nil, t)
+	err = RemoveEnrollmentWindow(w.ID, db)
+	assert(err, nil, t)
+	open, err := IsEnrollmentOpen(g2.GroupID, now.Unix(), db)
+	assert(err, nil, t)
+	assert(open, false, t)
+
+	// Selection round
+	err = SetGroupCapacity(g1.GroupID, 3, db)
+	assert(err, nil, t)
+	err = SetGroupCapacity(g2.GroupID, 2, db)
+	assert(err, nil, t)
+	round, err := NewSelectionRoundAs(User{UUID: "admin", Role: Admin}, period.PeriodID, "Autumn selection", now.Add(-time.Hour).Unix(), now.Add(time.Hour).Unix(), 1, db)
+	assert(err, nil, t)
+
+	err = SubmitChoices(round.RoundID, students[1].UUID, []string{g1.GroupID, g1.GroupID}, db)
+	assert(err, ErrDuplicateChoice, t)
+	other, err := NewGroup("Other", "c1", now.Unix(), now.Add(time.Hour).Unix(), []GroupTimeData{}, db)
+	assert(err, nil, t)
+	err = SubmitChoices(round.RoundID, students[1].UUID, []string{other.GroupID}, db)
+	assert(err, ErrGroupNotInRound, t)
+	err = SubmitChoicesAs(students[2], round.RoundID, students[1].UUID, []string{g1.GroupID}, db)
+	assert(err, ErrForbidden, t)
+	err = SubmitChoices(round.RoundID, teacher.UUID, []string{g1.GroupID}, db)
+	assert(err, ErrNotAStudent, t)
+	for _, s := range students[1:] {
+		err = SubmitChoicesAs(s, round.RoundID, s.UUID, []string{g1.GroupID}, db)
+		assert(err, nil, t)
+	}
+	// Resubmitting replaces the earlier choices
+	err = SubmitChoices(round.RoundID, students[3].UUID, []string{g1.GroupID, g2.GroupID}, db)
+	assert(err, nil, t)
+	choices, err := GetChoices(round.RoundID, students[3].UUID, db)
+	assert(err, nil, t)
+	assert(len(choices), 2, t)
+	assert(choices[0], g1.GroupID, t)
+
+	_, err = AllocateRound(round.RoundID, 1, db)
+	assert(err, ErrRoundStillOpen, t)
+	db.Model(SelectionRound{}).Where("round_id = ?", round.RoundID).Update("closes", now.Add(-time.Minute).Unix())
+	err = SubmitChoices(round.RoundID, students[0].UUID, []string{g1.GroupID}, db)
+	assert(err, ErrRoundClosed, t)
+
+	// g1 has two free places for three students who all want it, g2 has one
+	result, err := AllocateRoundAs(User{UUID: "admin", Role: Admin}, round.RoundID, 42, db)
+	assert(err, nil, t)
+	inG1 := 0
+	for _, s := range students[1:] {
+		groups := result.Assigned[s.UUID]
+		if len(groups) == 1 && groups[0] == g1.GroupID {
+			inG1++
+		}
+	}
+	assert(inG1, 2, t)
+	if len(result.Assigned[students[3].UUID]) == 1 && result.Assigned[students[3].UUID][0] == g1.GroupID {
+		assert(len(result.Unplaced), 1, t)
+	} else {
+		assert(result.Assigned[students[3].UUID][0], g2.GroupID, t)
+		assert(len(result.Unplaced), 0, t)
+	}
+	members, err := g1.GetUsers(db)
+	assert(err, nil, t)
+	assert(len(members), 3, t)
+	_, err = AllocateRound(round.RoundID, 42, db)
+	assert(err, ErrRoundAllocated, t)
+
+	// If another allocation of the round finishes first, nothing is saved
+	var before, after int64
+	db.Model(GroupReservation{}).Count(&before)
+	db.Model(SelectionRound{}).Where("round_id = ?", round.RoundID).Update("allocated", false)
+	db.Callback().Update().Before("gorm:update").Register("test:concurrent_allocation", func(tx *gorm.DB) {
+		if tx.Statement.Table == "selection_rounds" {
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE selection_rounds SET allocated = ? WHERE round_id = ?", true, round.RoundID)
+		}
+	})
+	_, err = AllocateRound(round.RoundID, 42, db)
+	assert(err, ErrRoundAllocated, t)
+	db.Callback().Update().Remove("test:concurrent_allocation")
+	db.Model(GroupReservation{}).Count(&after)
+	assert(after, before, t)
+
+	// The order is reversed for the second choices, so with two single places both students get one group
+	monday := func(start, end time.Duration) []GroupTimeData {
+		return []GroupTimeData{{StartTime: int64(start), EndTime: int64(end), DayOfTheWeek: 0}}
+	}
+	popular, err := NewGroupInPeriod("FY1.1", "c1", period.PeriodID, monday(8*time.Hour, 9*time.Hour), db)
+	assert(err, nil, t)
+	second, err := NewGroupInPeriod("KE1.1", "c1", period.PeriodID, monday(12*time.Hour, 13*time.Hour), db)
+	assert(err, nil, t)
+	overlapping, err := NewGroupInPeriod("BI1.1", "c1", period.PeriodID, monday(8*time.Hour+30*time.Minute, 10*time.Hour), db)
+	assert(err, nil, t)
+	assert(SetGroupCapacity(popular.GroupID, 1, db), nil, t)
+	assert(SetGroupCapacity(second.GroupID, 1, db), nil, t)
+	round2, err := NewSelectionRound(period.PeriodID, "Second selection", now.Add(-time.Hour).Unix(), now.Add(time.Hour).Unix(), 2, db)
+	assert(err, nil, t)
+	for _, s := range students[:2] {
+		err = SubmitChoices(round2.RoundID, s.UUID, []string{popular.GroupID, second.GroupID}, db)
+		assert(err, nil, t)
+	}
+	// A student already in a group at the same time is not placed in an overlapping one
+	db.Create(&GroupReservation{GroupID: popular.GroupID, ReserverUUID: students[2].UUID})
+	assert(SetGroupCapacity(popular.GroupID, 2, db), nil, t)
+	err = SubmitChoices(round2.RoundID, students[2].UUID, []string{overlapping.GroupID}, db)
+	assert(err, nil, t)
+	// Inactive students are left out
+	err = SubmitChoices(round2.RoundID, students[3].UUID, []string{overlapping.GroupID}, db)
+	assert(err, nil, t)
+	err = SetUserStatus(students[3].UUID, Suspended, db)
+	assert(err, nil, t)
+	db.Model(SelectionRound{}).Where("round_id = ?", round2.RoundID).Update("closes", now.Add(-time.Minute).Unix())
+
+	result, err = AllocateRound(round2.RoundID, 7, db)
+	assert(err, nil, t)
+	assert(len(result.Assigned[students[0].UUID]), 1, t)
+	assert(len(result.Assigned[students[1].UUID]), 1, t)
+	assert(len(result.Assigned[students[2].UUID]), 0, t)
+	assert(len(result.Assigned[students[3].UUID]), 0, t)
+	assert(len(result.Unplaced), 3, t)
+}
+
+func TestScheduleConflicts(t *testing.T) {
+	db := getTestDatabase(t)
+
+	student, err := CreateUser("c.student", "Conflict", "Student", "password1", Student, db)
+	assert(err, nil, t)
+	teacher, err := CreateUser("c.teacher", "Conflict", "Teacher", "password1", Teacher, db)
+	assert(err, nil, t)
+	now := time.Now()
+	monthLater := now.Add(30 * 24 * time.Hour).Unix()
+	lesson := func(day int64, start time.Duration, end time.Duration) GroupTimeData {
+		return GroupTimeData{StartTime: int64(start), EndTime: int64(end), DayOfTheWeek: day}
+	}
+
+	g1, err := NewGroup("MAA3.1", "c1", now.Unix(), monthLater, []GroupTimeData{lesson(0, 8*time.Hour, 9*time.Hour+15*time.Minute)}, db)
+	assert(err, nil, t)
+	g2, err := NewGroup("FY1.1", "c2", now.Unix(), monthLater, []GroupTimeData{lesson(0, 9*time.Hour, 10*time.Hour)}, db)
+	assert(err, nil, t)
+	// Starts when g1 ends
+	g3, err := NewGroup("KE1.1", "c3", now.Unix(), monthLater, []GroupTimeData{lesson(0, 9*time.Hour+15*time.Minute, 10*time.Hour)}, db)
+	assert(err, nil, t)
+	// Same time as g1 but a later period
+	g4, err := NewGroup("MAA4.1", "c4", monthLater+1, monthLater+30*24*3600, []GroupTimeData{lesson(0, 8*time.Hour, 9*time.Hour)}, db)
+	assert(err, nil, t)
+
+	_, err = student.JoinGroup(g1.GroupID, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g2.GroupID, db)
+	assert(errors.Is(err, ErrScheduleConflict), true, t)
+	assert(err.Error(), "schedule conflict: FY1.1 overlaps MAA3.1 on Monday 09:00-09:15", t)
+	_, err = student.JoinGroup(g3.GroupID, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g4.GroupID, db)
+	assert(err, nil, t)
+
+	err = g1.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	err = g2.AssingTeacher(teacher.UUID, db)
+	assert(errors.Is(err, ErrScheduleConflict), true, t)
+	assert(g2.TeacherID, "", t)
+	conflicts, err := FindConflicts(teacher.UUID, g2.GroupID, db)
+	assert(err, nil, t)
+	assert(len(conflicts), 1, t)
+	assert(conflicts[0].Other.GroupID, g1.GroupID, t)
+
+	// Changing times can't make the lessons of members or the teacher overlap
+	conflicts, err = GetScheduleConflicts(student.UUID, db)
+	assert(err, nil, t)
+	assert(len(conflicts), 0, t)
+	err = UpdateGroupTimes(g3.GroupID, []GroupTimeData{lesson(0, 8*time.Hour, 9*time.Hour)}, db)
+	assert(errors.Is(err, ErrScheduleConflict), true, t)
+	assert(err.Error(), "schedule conflict: KE1.1 overlaps MAA3.1 on Monday 08:00-09:00", t)
+	times, err := GetGroupTimes(g3.GroupID, db)
+	assert(err, nil, t)
+	assert(times[0].StartTime, int64(9*time.Hour+15*time.Minute), t)
+	err = UpdateGroupTimes(g3.GroupID, []GroupTimeData{lesson(1, 8*time.Hour, 9*time.Hour)}, db)
+	assert(err, nil, t)
+	err = UpdateGroupTimes(g2.GroupID, []GroupTimeData{lesson(0, 8*time.Hour, 9*time.Hour)}, db)
+	assert(err, nil, t)
+
+	// Overlaps made some other way show up in the report
+	db.Where("group_id = ?", g3.GroupID).Delete(&GroupTime{})
+	db.Create(&GroupTime{GroupID: g3.GroupID, StartTime: int64(8 * time.Hour), EndTime: int64(9 * time.Hour), DayOfTheWeek: 0})
+	conflicts, err = GetScheduleConflicts(student.UUID, db)
+	assert(err, nil, t)
+	assert(len(conflicts), 1, t)
+	assert(conflicts[0].StartTime, int64(8*time.Hour), t)
+	assert(conflicts[0].EndTime, int64(9*time.Hour), t)
+}
+
+func TestSchedule(t *testing.T) {
+	db := getTestDatabase(t)
+	defer func(loc *time.Location) { ScheduleLocation = loc }(ScheduleLocation)
+	ScheduleLocation = time.UTC
+	date := func(month time.Month, day int, hour int) int64 {
+		return time.Date(2021, month, day, hour, 0, 0, 0, time.UTC).Unix()
+	}
+
+	student, err := CreateUser("s.student", "Schedule", "Student", "password1", Student, db)
+	assert(err, nil, t)
+	teacher, err := CreateUser("s.teacher", "Schedule", "Teacher", "password1", Teacher, db)
+	assert(err, nil, t)
+	guardian, err := CreateUser("s.guardian", "Schedule", "Guardian", "password1", Guardian, db)
+	assert(err, nil, t)
+	_, err = LinkGuardian(guardian.UUID, student.UUID, db)
+	assert(err, nil, t)
+
+	// September 2021 starts on a wednesday
+	g, err := NewGroup("ENA1.1", "c1", date(time.September, 1, 0), date(time.September, 30, 0), []GroupTimeData{
+		{StartTime: int64(8 * time.Hour), EndTime: int64(9 * time.Hour), DayOfTheWeek: 0},
+		{StartTime: int64(10 * time.Hour), EndTime: int64(11 * time.Hour), DayOfTheWeek: 2},
+	}, db)
+	assert(err, nil, t)
+	err = g.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(g.GroupID, db)
+	assert(err, nil, t)
+
+	lessons, err := GetSchedule(student.UUID, date(time.September, 1, 0), date(time.September, 8, 0), db)
+	assert(err, nil, t)
+	assert(len(lessons), 2, t)
+	assert(lessons[0].Start, date(time.September, 1, 10), t)
+	assert(lessons[0].End, date(time.September, 1, 11), t)
+	assert(lessons[1].Start, date(time.September, 6, 8), t)
+	assert(lessons[1].TeacherID, teacher.UUID, t)
+
+	// Four mondays and five wednesdays, nothing outside the dates of the group
+	lessons, err = GetSchedule(teacher.UUID, date(time.August, 1, 0), date(time.December, 1, 0), db)
+	assert(err, nil, t)
+	assert(len(lessons), 9, t)
+	lessons, err = GetSchedule(guardian.UUID, date(time.August, 1, 0), date(time.December, 1, 0), db)
+	assert(err, nil, t)
+	assert(len(lessons), 9, t)
+	assert(lessons[0].UserID, student.UUID, t)
+
+	lessons, err = GetWeekSchedule(student.UUID, date(time.September, 16, 12), db)
+	assert(err, nil, t)
+	assert(len(lessons), 2, t)
+	assert(lessons[0].Start, date(time.September, 13, 8), t)
+
+	_, err = GetSchedule(student.UUID, date(time.September, 8, 0), date(time.September, 1, 0), db)
+	assert(err, ErrInvalidDateRange, t)
+
+	// Lessons keep their wall clock time on the day daylight saving time ends
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	ScheduleLocation = helsinki
+	dst, err := NewGroup("ENA2.1", "c1", date(time.October, 30, 0), date(time.November, 1, 0), []GroupTimeData{
+		{StartTime: int64(8 * time.Hour), EndTime: int64(9 * time.Hour), DayOfTheWeek: 6},
+	}, db)
+	assert(err, nil, t)
+	err = dst.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	lessons, err = GetSchedule(teacher.UUID, date(time.October, 30, 0), date(time.November, 1, 0), db)
+	assert(err, nil, t)
+	assert(len(lessons), 1, t)
+	assert(lessons[0].GroupID, dst.GroupID, t)
+	assert(lessons[0].Start, time.Date(2021, time.October, 31, 8, 0, 0, 0, helsinki).Unix(), t)
+}
+
+func TestICalendar(t *testing.T) {
+	db := getTestDatabase(t)
+	defer func(loc *time.Location) { ScheduleLocation = loc }(ScheduleLocation)
+	ScheduleLocation = time.UTC
+	date := func(month time.Month, day int) int64 {
+		return time.Date(2021, month, day, 0, 0, 0, 0, time.UTC).Unix()
+	}
+
+	teacher, err := CreateUser("i.teacher", "Maija", "Meikäläinen", "password1", Teacher, db)
+	assert(err, nil, t)
+	course, err := NewCourse("Funktiot ja yhtälöt, osa 1; erittäin pitkä nimi joka ei mahdu yhdelle riville", "MAA2", "", "s1", db)
+	assert(err, nil, t)
+	g, err := NewGroup("MAA2.1", course.CourseID, date(time.September, 1), date(time.September, 30), []GroupTimeData{
+		{StartTime: int64(8 * time.Hour), EndTime: int64(9*time.Hour + 15*time.Minute), DayOfTheWeek: 0},
+	}, db)
+	assert(err, nil, t)
+	err = g.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	_, err = NewHolidayAs(User{UUID: "s", Role: Student}, "Syysloma", date(time.September, 13), date(time.September, 17), db)
+	assert(err, ErrForbidden, t)
+	holiday, err := NewHoliday("Syysloma", date(time.September, 13), date(time.September, 17), db)
+	assert(err, nil, t)
+
+	lessons, err := GetSchedule(teacher.UUID, date(time.September, 1), date(time.October, 1), db)
+	assert(err, nil, t)
+	assert(len(lessons), 3, t)
+
+	cal, err := GroupCalendar(g.GroupID, db)
+	assert(err, nil, t)
+	for _, l := range strings.Split(strings.TrimSuffix(cal, "\r\n"), "\r\n") {
+		if len(l) > ICAL_LINE_LENGTH || !utf8.ValidString(l) {
+			t.Fatalf("Badly folded line %q", l)
+		}
+	}
+	unfolded := strings.ReplaceAll(cal, "\r\n ", "")
+	assert(strings.HasPrefix(unfolded, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"), true, t)
+	assert(strings.Contains(unfolded, "\r\nUID:"+g.GroupID+"-MO-0800@wilhelmiina\r\n"), true, t)
+	assert(strings.Contains(unfolded, "\r\nDTSTART:20210906T080000Z\r\nDTEND:20210906T091500Z\r\n"), true, t)
+	assert(strings.Contains(unfolded, "\r\nRRULE:FREQ=WEEKLY;BYDAY=MO;UNTIL=20210927T080000Z\r\n"), true, t)
+	assert(strings.Contains(unfolded, "\r\nEXDATE:20210913T080000Z\r\n"), true, t)
+	assert(strings.Contains(unfolded, `SUMMARY:MAA2 Funktiot ja yhtälöt\, osa 1\; erittäin pitkä nimi joka ei mahdu yhdelle riville (MAA2.1)\, Maija Meikäläinen`), true, t)
+	assert(strings.HasSuffix(cal, "END:VEVENT\r\nEND:VCALENDAR\r\n"), true, t)
+
+	// The same events come from the calendar of the teacher
+	userCal, err := UserCalendar(teacher.UUID, db)
+	assert(err, nil, t)
+	assert(strings.Count(userCal, "BEGIN:VEVENT"), 1, t)
+	assert(strings.Contains(userCal, "UID:"+g.GroupID+"-MO-0800@wilhelmiina"), true, t)
+
+	err = DeleteHoliday(holiday.HolidayID, db)
+	assert(err, nil, t)
+	cal, err = GroupCalendar(g.GroupID, db)
+	assert(err, nil, t)
+	assert(strings.Contains(cal, "EXDATE"), false, t)
+	assert(strings.Contains(cal, "VTIMEZONE"), false, t)
+
+	// Named time zones are described with a VTIMEZONE that covers the daylight saving time change
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	ScheduleLocation = helsinki
+	dst, err := NewGroup("MAA3.1", course.CourseID, date(time.October, 25), date(time.November, 7), []GroupTimeData{
+		{StartTime: int64(8 * time.Hour), EndTime: int64(9 * time.Hour), DayOfTheWeek: 0},
+	}, db)
+	assert(err, nil, t)
+	cal, err = GroupCalendar(dst.GroupID, db)
+	assert(err, nil, t)
+	assert(strings.Contains(cal, "BEGIN:VTIMEZONE\r\nTZID:Europe/Helsinki\r\nBEGIN:DAYLIGHT\r\n"), true, t)
+	assert(strings.Contains(cal, "BEGIN:STANDARD\r\nDTSTART:20211031T040000\r\nTZOFFSETFROM:+0300\r\nTZOFFSETTO:+0200\r\nTZNAME:EET\r\nEND:STANDARD\r\nEND:VTIMEZONE\r\n"), true, t)
+	assert(strings.Contains(cal, "\r\nDTSTART;TZID=Europe/Helsinki:20211025T080000\r\nDTEND;TZID=Europe/Helsinki:20211025T090000\r\n"), true, t)
+	assert(strings.Contains(cal, "UNTIL=20211101T060000Z"), true, t)
+
+	// Holidays on the day of the change are excluded at the wall clock time of the lesson
+	sunday, err := NewGroup("MAA3.2", course.CourseID, date(time.October, 25), date(time.November, 7), []GroupTimeData{
+		{StartTime: int64(10 * time.Hour), EndTime: int64(11 * time.Hour), DayOfTheWeek: 6},
+	}, db)
+	assert(err, nil, t)
+	day := time.Date(2021, time.October, 31, 0, 0, 0, 0, helsinki).Unix()
+	_, err = NewHoliday("Pyhäinpäivä", day, day, db)
+	assert(err, nil, t)
+	cal, err = GroupCalendar(sunday.GroupID, db)
+	assert(err, nil, t)
+	assert(strings.Contains(cal, "\r\nEXDATE;TZID=Europe/Helsinki:20211031T100000\r\n"), true, t)
+}
+
+func TestICalendarImport(t *testing.T) {
+	db := getTestDatabase(t)
+	defer func(loc *time.Location) { ScheduleLocation = loc }(ScheduleLocation)
+	ScheduleLocation = time.UTC
+
+	course, err := NewCourse("Funktiot ja yhtälöt", "MAA2", "", "s1", db)
+	assert(err, nil, t)
+	calendar := func(wednesday string) string {
+		return strings.Join([]string{
+			"BEGIN:VCALENDAR",
+			"VERSION:2.0",
+			"PRODID:-//scheduler//EN",
+			"BEGIN:VEVENT",
+			"UID:1@scheduler",
+			"DTSTART:20210906T080000Z",
+			"DTEND:20210906T091500Z",
+			"RRULE:FREQ=WEEKLY;BYDAY=MO;UNTIL=20210927T080000Z",
+			"SUMMARY:MAA2.1",
+			"END:VEVENT",
+			"BEGIN:VEVENT",
+			"UID:2@scheduler",
+			"DTSTART:" + wednesday,
+			"DTEND:" + strings.Replace(wednesday, "T10", "T11", 1),
+			"RRULE:FREQ=WEEKLY;COUNT=4",
+			"SUMMARY:MAA2.1",
+			"END:VEVENT",
+			"BEGIN:VEVENT",
+			"UID:3@scheduler",
+			"DTSTART:20210906T120000Z",
+			"DTEND:20210906T130000Z",
+			"RRULE:FREQ=WEEKLY;COUNT=4",
+			"SUMMARY:XYZ1.1",
+			"END:VEVENT",
+			"BEGIN:VEVENT",
+			"UID:4@scheduler",
+			"DTSTART:20210907T120000Z",
+			"DTEND:20210907T130000Z",
+			"SUMMARY:Vanhempainilta",
+			"END:VEVENT",
+			"END:VCALENDAR",
+		}, "\r\n") + "\r\n"
+	}
+
+	_, err = ImportCalendar(strings.NewReader("BEGIN:VEVENT\r\nEND:VEVENT\r\n"), true, db)
+	assert(err, ErrInvalidCalendar, t)
+
+	// Nothing is saved in a dry run
+	report, err := ImportCalendar(strings.NewReader(calendar("20210908T100000Z")), true, db)
+	assert(err, nil, t)
+	assert(len(report.Changes), 1, t)
+	assert(report.Changes[0].Action, ImportCreate, t)
+	assert(report.Changes[0].CourseID, course.CourseID, t)
+	assert(len(report.Changes[0].Added), 2, t)
+	assert(len(report.Warnings), 2, t)
+	groups, err := GetGroupsForCourse(course.CourseID, db)
+	assert(err, nil, t)
+	assert(len(groups), 0, t)
+
+	_, err = ImportCalendarAs(User{UUID: "s", Role: Student}, strings.NewReader(calendar("20210908T100000Z")), false, db)
+	assert(err, ErrForbidden, t)
+	report, err = ImportCalendarAs(User{UUID: "admin", Role: Admin}, strings.NewReader(calendar("20210908T100000Z")), false, db)
+	assert(err, nil, t)
+	groupID := report.Changes[0].GroupID
+	group, err := GetGroup(groupID, db)
+	assert(err, nil, t)
+	assert(group.GroupInfo.Name, "MAA2.1", t)
+	assert(group.GroupInfo.StartDate, time.Date(2021, 9, 6, 0, 0, 0, 0, time.UTC).Unix(), t)
+	assert(group.GroupInfo.EndDate, time.Date(2021, 9, 29, 0, 0, 0, 0, time.UTC).Unix(), t)
+	assert(len(group.GroupTimes), 2, t)
+
+	// Moving the wednesday lessons to thursday
+	report, err = ImportCalendar(strings.NewReader(calendar("20210909T100000Z")), true, db)
+	assert(err, nil, t)
+	assert(report.Changes[0].Action, ImportUpdate, t)
+	assert(report.Changes[0].GroupID, groupID, t)
+	assert(report.Changes[0].String(), "update MAA2.1\n  ~ 2021-09-06 - 2021-09-29 -> 2021-09-06 - 2021-09-30\n  + Thursday 10:00-11:00\n  - Wednesday 10:00-11:00\n", t)
+	_, err = ImportCalendar(strings.NewReader(calendar("20210909T100000Z")), false, db)
+	assert(err, nil, t)
+	group, err = GetGroup(groupID, db)
+	assert(err, nil, t)
+	assert(len(group.GroupTimes), 2, t)
+
+	// Exported calendars are recognized by their UIDs
+	cal, err := GroupCalendar(groupID, db)
+	assert(err, nil, t)
+	report, err = ImportCalendar(strings.NewReader(cal), false, db)
+	assert(err, nil, t)
+	assert(len(report.Changes), 1, t)
+	assert(report.Changes[0].Action, ImportUnchanged, t)
+	assert(report.Changes[0].GroupID, groupID, t)
+	assert(len(report.Warnings), 0, t)
+
+	// Updating a group needs permission to edit it
+	createPermission, _ := DefaultAuthorizer.GetPermission(ActionGroupCreate)
+	DefaultAuthorizer.SetPermission(ActionGroupCreate, Permission{Roles: []Role{Teacher, Moderator, Admin}})
+	defer DefaultAuthorizer.SetPermission(ActionGroupCreate, createPermission)
+	teacher, err := CreateUser("import.teacher", "Tuomas", "Opettaja", "password1", Teacher, db)
+	assert(err, nil, t)
+	longer := strings.Replace(cal, "UNTIL=20210927T080000Z", "UNTIL=20211004T080000Z", 1)
+	_, err = ImportCalendarAs(teacher, strings.NewReader(longer), true, db)
+	assert(err, ErrForbidden, t)
+	err = group.GroupInfo.AssingTeacher(teacher.UUID, db)
+	assert(err, nil, t)
+	report, err = ImportCalendarAs(teacher, strings.NewReader(longer), true, db)
+	assert(err, nil, t)
+	assert(report.Changes[0].Action, ImportUpdate, t)
+
+	// Groups are not moved outside their period
+	year, err := NewSchoolYear("2021-2022", time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC).Unix(), time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC).Unix(), db)
+	assert(err, nil, t)
+	period, err := NewPeriod(year.SchoolYearID, 1, "Period 1", time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC).Unix(), time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC).Unix(), db)
+	assert(err, nil, t)
+	err = SetGroupPeriod(groupID, period.PeriodID, db)
+	assert(err, nil, t)
+	report, err = ImportCalendar(strings.NewReader(longer), false, db)
+	assert(err, nil, t)
+	assert(len(report.Changes), 0, t)
+	assert(report.Warnings[0], "MAA2.1: group dates are not within the period", t)
+	group, err = GetGroup(groupID, db)
+	assert(err, nil, t)
+	assert(group.GroupInfo.EndDate, time.Date(2021, 9, 30, 0, 0, 0, 0, time.UTC).Unix(), t)
+
+	// or made to overlap the other lessons of their members
+	student, err := CreateUser("import.student", "Iida", "Opiskelija", "password1", Student, db)
+	assert(err, nil, t)
+	other, err := NewGroup("FY1.1", "c2", group.GroupInfo.StartDate, group.GroupInfo.EndDate, []GroupTimeData{{StartTime: int64(10 * time.Hour), EndTime: int64(11 * time.Hour), DayOfTheWeek: 1}}, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(groupID, db)
+	assert(err, nil, t)
+	_, err = student.JoinGroup(other.GroupID, db)
+	assert(err, nil, t)
+	tuesday := strings.NewReplacer("BYDAY=TH", "BYDAY=TU", "20210909T", "20210907T", "20210930T", "20210928T").Replace(cal)
+	report, err = ImportCalendar(strings.NewReader(tuesday), false, db)
+	assert(err, nil, t)
+	assert(len(report.Changes), 0, t)
+	assert(report.Warnings[0], "schedule conflict: MAA2.1 overlaps FY1.1 on Tuesday 10:00-11:00", t)
+	times, err := GetGroupTimes(groupID, db)
+	assert(err, nil, t)
+	assert(times[1].DayOfTheWeek, int64(3), t)
+
+	// Huge counts are refused
+	huge := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"DTSTART:20210906T080000Z",
+		"DTEND:20210906T090000Z",
+		"RRULE:FREQ=WEEKLY;COUNT=2000000000",
+		"SUMMARY:MAA2.2",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n") + "\r\n"
+	report, err = ImportCalendar(strings.NewReader(huge), true, db)
+	assert(err, nil, t)
+	assert(report.Warnings[0], "MAA2.2: invalid count 2000000000", t)
+
+	// A failure in the middle of an import saves nothing
+	db.Callback().Create().Before("gorm:create").Register("test:fail_group", func(tx *gorm.DB) {
+		if g, ok := tx.Statement.Dest.(*Group); ok && g.Name == "MAA2.3" {
+			tx.AddError(errors.New("insert failed"))
+		}
+	})
+	two := strings.Replace(huge, "COUNT=2000000000", "COUNT=4", 1)
+	two = strings.Replace(two, "END:VCALENDAR", strings.Join([]string{
+		"BEGIN:VEVENT",
+		"DTSTART:20210906T120000Z",
+		"DTEND:20210906T130000Z",
+		"RRULE:FREQ=WEEKLY;COUNT=4",
+		"SUMMARY:MAA2.3",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n"), 1)
+	_, err = ImportCalendar(strings.NewReader(two), false, db)
+	assert(err.Error(), "insert failed", t)
+	groups, err = GetGroupsForCourse(course.CourseID, db)
+	assert(err, nil, t)
+	assert(len(groups), 1, t)
+}